@@ -1,10 +1,12 @@
 package apoclient
 
 import (
+	"apollo/utils"
 	"github.com/jarcoal/httpmock"
 	"github.com/petergtz/pegomock"
 	. "gopkg.in/check.v1"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -58,3 +60,33 @@ no-url-here
 	url = LookupServerFromUserData()
 	c.Assert(url, Equals, "")
 }
+
+func (s *ApolloClientTests) TestMetadataOverride(c *C) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/user-data":
+			w.Write([]byte(utils.MakeNodeUserData(utils.NodeUserData{
+				ServerUrl: "apollo.local:9443", CertFingerprint: "abcd"})))
+		case "/latest/meta-data/instance-id":
+			w.Write([]byte("i-12345678\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer stub.Close()
+
+	MetadataUrl = stub.URL + "/latest"
+	defer func() {
+		MetadataUrl = DefaultMetadataUrl
+	}()
+
+	info, err := LookupNodeUserData()
+	c.Assert(err, IsNil)
+	c.Assert(info.ServerUrl, Equals, "apollo.local:9443")
+	c.Assert(info.CertFingerprint, Equals, "abcd")
+	c.Assert(LookupServerFromUserData(), Equals, "apollo.local:9443")
+
+	id, err := LookupInstanceId()
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, "i-12345678")
+}
@@ -0,0 +1,66 @@
+package apoclient
+
+import (
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restcli"
+	"apollo/proto/gen/restcli/task"
+	. "apollo/utils"
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+func MakeCancelCmd() *cobra.Command {
+	var cmdCancel = &cobra.Command{
+		DisableFlagsInUseLine: true,
+		Use:          "cancel [flags] [<task-id>, ...]",
+		Short:        "Cancel tasks",
+		Long:         `cancel the tasks (or only some of their array indexes), running instances are killed`,
+		Args:         cobra.MinimumNArgs(0),
+		SilenceUsage: true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			job := GetFlagS(cmd, "job")
+			if len(args) == 0 && job == "" {
+				return fmt.Errorf("either task IDs or a job name must be specified")
+			}
+			indexFlag, err := cmd.Flags().GetIntSlice("index")
+			if err != nil {
+				return err
+			}
+			var indexes []int64
+			for _, idx := range indexFlag {
+				indexes = append(indexes, int64(idx))
+			}
+
+			conn, err := ObtainConnection(cmd)
+			if err != nil {
+				return err
+			}
+
+			return DoCancelTasks(conn, args, job, indexes)
+		},
+	}
+	cmdCancel.Flags().SortFlags = false
+
+	cmdCancel.Flags().StringP("job", "j", "", "Cancel all the tasks of the job")
+	cmdCancel.Flags().IntSliceP("index", "i", nil,
+		"Cancel only the instances with these array indexes")
+	return cmdCancel
+}
+
+func DoCancelTasks(cli *restcli.Apollo, ids []string, job string, indexes []int64) error {
+	params := task.NewPostTaskCancelParams()
+	params.Cancellation = &models.TaskCancellation{
+		Tasks:   ids,
+		JobName: job,
+		Indexes: indexes,
+	}
+
+	res, err := cli.Task.PostTaskCancel(params, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("CANCELLED\t%d\n", res.Payload.CancelledCount)
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package apoclient
+
+import (
+	"apollo/proto/gen/restcli"
+	"apollo/proto/gen/restcli/node"
+	. "apollo/utils"
+	"fmt"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+func MakeDrainNodeCommand() *cobra.Command {
+	var cmdDrain = &cobra.Command{
+		Use:          "drain-node",
+		Short:        "Drain a node",
+		Long:         `Stop placing new tasks on the node and shut it down once its running tasks finish`,
+		Args:         cobra.MinimumNArgs(0),
+		SilenceUsage: true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			deadline, err := cmd.Flags().GetDuration("deadline")
+			if err != nil {
+				return err
+			}
+
+			conn, err := ObtainConnection(cmd)
+			if err != nil {
+				return err
+			}
+
+			return DoDrainNode(conn, GetFlagS(cmd,"node"), deadline)
+		},
+	}
+	cmdDrain.Flags().SortFlags = false
+
+	cmdDrain.Flags().StringP("node", "n", "", "Node ID")
+	cmdDrain.MarkFlagRequired("node")
+	cmdDrain.Flags().Duration("deadline", 0,
+		"Requeue the running tasks if they don't finish in time (e.g. 1h), waits forever by default")
+
+	return cmdDrain
+}
+
+func DoDrainNode(cli *restcli.Apollo, nodeId string, deadline time.Duration) error {
+	params := node.NewPostNodeDrainParams()
+	params.NodeID = nodeId
+	if deadline != 0 {
+		seconds := int64(deadline / time.Second)
+		params.DeadlineSeconds = &seconds
+	}
+
+	_, err := cli.Node.PostNodeDrain(params, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Print("DRAINING\t"+nodeId+"\n")
+
+	return nil
+}
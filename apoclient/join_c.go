@@ -0,0 +1,120 @@
+package apoclient
+
+import (
+	"apollo/proto/gen/restcli"
+	"apollo/proto/gen/restcli/login"
+	. "apollo/utils"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	client2 "github.com/go-openapi/runtime/client"
+	"github.com/juju/errors.git"
+	"github.com/spf13/cobra"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func MakeCreateJoinTokenCmd() *cobra.Command {
+	var cmdJoin = &cobra.Command{
+		Use:          "create-join-token queue",
+		Short:        "Create a token for a runner to join the queue",
+		Long:         `Create a short-lived single-use token that allows an unmanaged node ` +
+			`to join the queue with 'aporunner --join <token>', without AWS credentials`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ttl, err := cmd.Flags().GetDuration("ttl")
+			if err != nil {
+				return err
+			}
+
+			conn, token, err := ObtainConnectionWithInfo(cmd)
+			if err != nil {
+				return err
+			}
+
+			return DoCreateJoinToken(conn, token, args[0], ttl)
+		},
+	}
+	cmdJoin.Flags().Duration("ttl", time.Hour, "The time during which the token can be used")
+	return cmdJoin
+}
+
+func DoCreateJoinToken(cli *restcli.Apollo, info *ApolloTokenInfo, queue string,
+	ttl time.Duration) error {
+
+	params := login.NewPostJoinTokenParams()
+	params.Queue = queue
+	seconds := int64(ttl / time.Second)
+	params.TTLSeconds = &seconds
+
+	res, err := cli.Login.PostJoinToken(params, nil)
+	if err != nil {
+		return err
+	}
+
+	// The runner verifies the server's certificate with the fingerprint
+	joinStr := info.Host + "#" + res.Payload.JoinToken + "#" +
+		DerCertFingerprint(info.ServerCert.Raw)
+	fmt.Printf("JOIN\t%s\t%s\n", joinStr, time.Time(res.Payload.Expires).String())
+	return nil
+}
+
+type JoinRes struct {
+	ServerUrl string
+	NodeID string
+	AuthToken string
+	ServerCert string
+}
+
+// The string produced by create-join-token, it can't be used to access the
+// server: it can only be traded for a new node once.
+func DoJoin(joinStr string) (JoinRes, error) {
+	// Format is: host:port#token#fingerprint
+	components := strings.Split(joinStr, "#")
+	if len(components) != 3 {
+		return JoinRes{}, fmt.Errorf("incorrect join token format")
+	}
+	url, joinToken, fingerprint := components[0], components[1], components[2]
+
+	// The server's certificate is not known yet, so it's checked against the
+	// fingerprint instead of the CA.
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, cert := range rawCerts {
+				if DerCertFingerprint(cert) == fingerprint {
+					return nil
+				}
+			}
+			return fmt.Errorf("the server's certificate doesn't match the join token")
+		},
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	trans := client2.NewWithClient(url, "", []string{"https"}, client)
+	trans.DefaultAuthentication = &HeaderAddingRtt{}
+	cli := restcli.New(trans, nil)
+
+	params := login.NewPostJoinParams()
+	params.JoinToken = joinToken
+	res, err := cli.Login.PostJoin(params)
+	if err != nil {
+		return JoinRes{}, err
+	}
+
+	certBytes, err := base64.StdEncoding.DecodeString(res.Payload.Certificate)
+	if err != nil || DerCertFingerprint(certBytes) != fingerprint {
+		return JoinRes{}, &LoginError{errors.NewErr(
+			"The server's certificate doesn't match the join token")}
+	}
+
+	return JoinRes{
+		ServerUrl: url,
+		NodeID: res.Payload.NodeID,
+		AuthToken: res.Payload.AuthToken,
+		ServerCert: res.Payload.Certificate,
+	}, nil
+}
@@ -1,6 +1,7 @@
 package apoclient
 
 import (
+	"apollo/proto/gen/models"
 	"apollo/proto/gen/restcli"
 	"apollo/proto/gen/restcli/task"
 	. "apollo/utils"
@@ -27,18 +28,21 @@ func MakeListCmd() *cobra.Command {
 			}
 
 			return DoListTasks(conn, GetFlagS(cmd,"queue"),
-				GetFlagS(cmd,"job"), GetFlagB(cmd,"json"))
+				GetFlagS(cmd,"job"), GetFlagS(cmd,"state"), GetFlagB(cmd,"json"))
 		},
 	}
 	cmdList.Flags().SortFlags = false
 
 	cmdList.Flags().StringP("queue", "q", "", "Queue Name")
 	cmdList.Flags().StringP("job", "j", "", "Job Name")
+	cmdList.Flags().StringP("state", "s", "",
+		"Only list tasks with instances in this state (waiting, running, failed, ...)")
 	cmdList.Flags().Bool("json", false, "JSON output")
 	return cmdList
 }
 
-func DoListTasks(cli *restcli.Apollo, queue string, job string, json bool) error {
+func DoListTasks(cli *restcli.Apollo, queue string, job string, state string,
+	json bool) error {
 	params := task.NewGetTaskListParams()
 	if queue != "" {
 		params.Queue = &queue
@@ -46,6 +50,9 @@ func DoListTasks(cli *restcli.Apollo, queue string, job string, json bool) error
 	if job != "" {
 		params.Job = &job
 	}
+	if state != "" {
+		params.State = &state
+	}
 
 	tasks, err := cli.Task.GetTaskList(params, nil)
 	if err != nil {
@@ -72,14 +79,32 @@ func DoListTasks(cli *restcli.Apollo, queue string, job string, json bool) error
 	var data [][]string
 
 	for _, t := range tasks.Payload {
+		var counts = make(map[models.TaskStateEnum]int64)
+		for _, st := range t.InstanceStatus {
+			counts[st.State] = st.Count
+		}
 		progress := fmt.Sprintf("Done: %d/%d\n",
-			0, t.TaskStruct.EndArrayIndex - t.TaskStruct.StartArrayIndex)
-		progress += "A: 1 D: 2 F: 2"
+			counts[models.TaskStateEnumDone],
+			t.TaskStruct.EndArrayIndex - t.TaskStruct.StartArrayIndex)
+		progress += fmt.Sprintf("A: %d D: %d F: %d C: %d",
+			counts[models.TaskStateEnumScheduled] + counts[models.TaskStateEnumRunning],
+			counts[models.TaskStateEnumDone], counts[models.TaskStateEnumFailed],
+			counts[models.TaskStateEnumCancelled])
+		for _, st := range t.InstanceStatus {
+			if st.State == models.TaskStateEnumDone {
+				continue
+			}
+			progress += fmt.Sprintf("\n%s: %s", st.State, st.Indexes)
+		}
 
 		var job = ""
 		if t.TaskStruct.Job != nil {
 			job = t.TaskStruct.Job.JobName
-			job += fmt.Sprintf("\nMF: %d, CF: %d", t.TaskStruct.Job.MaxFailedCount, 0)
+			if t.JobState != "" {
+				job += fmt.Sprintf(" (%s)", t.JobState)
+			}
+			job += fmt.Sprintf("\nMF: %d, CF: %d", t.TaskStruct.Job.MaxFailedCount,
+				t.JobFailedTaskCount)
 		}
 		data = append(data, []string{
 			t.TaskStruct.Queue,
@@ -100,8 +125,13 @@ func DoListTasks(cli *restcli.Apollo, queue string, job string, json bool) error
 
 	table.AppendBulk(data)
 	table.Render()
+	if job != "" && len(tasks.Payload) != 0 {
+		first := tasks.Payload[0]
+		fmt.Printf("Job %s is %s, %d failed task instances\n", job,
+			first.JobState, first.JobFailedTaskCount)
+	}
 	fmt.Printf("(+) MF: - maximum failed count, CF: currently failed\n")
-	fmt.Printf("(*) A: - Number of active subtasks, D: - done, F: - failed\n")
+	fmt.Printf("(*) A: - Number of active subtasks, D: - done, F: - failed, C: - cancelled\n")
 
 	return nil
 }
@@ -18,14 +18,10 @@ import (
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/nacl/box"
 	"io/ioutil"
-	"net/http"
 	"os"
-	"strings"
 	"time"
 )
 
-const userDataMarker = "### APOLLO_SERVER_URL IS "
-const metadataUrl = "http://169.254.169.254/latest/user-data"
 const ApolloConnectionKey = "APOLLO_CONNECTION"
 
 type LoginData struct {
@@ -59,24 +55,11 @@ func MakeLoginCmd() *cobra.Command {
 }
 
 func LookupServerFromUserData() string {
-	client := http.Client{}
-	client.Timeout = 2 * time.Second
-	resp, err := client.Get(metadataUrl)
+	info, err := LookupNodeUserData()
 	if err != nil {
 		return ""
 	}
-
-	userData, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return ""
-	}
-
-	for _, st := range strings.Split(string(userData), "\n") {
-		if strings.Index(st, userDataMarker) == 0 {
-			return strings.TrimSpace(st[len(userDataMarker):])
-		}
-	}
-	return ""
+	return info.ServerUrl
 }
 
 type HeaderAddingRtt struct {
@@ -89,24 +72,34 @@ func (t *HeaderAddingRtt) AuthenticateRequest(request runtime.ClientRequest,
 }
 
 type SigV4Res struct {
+	ServerUrl string
 	AuthToken string
 	ServerCert string
 }
 
-func SendSigv4Auth(awsProfile, url string) (SigV4Res, error) {
+// Do the SigV4 login. If the URL is not provided, it's discovered from the
+// EC2 user data along with the server's certificate fingerprint. If the
+// fingerprint is known, the certificate sent by the server must match it.
+// The empty AWS profile means the default credential chain (e.g. the
+// instance profile).
+func SendSigv4Auth(awsProfile, url, certFingerprint string) (SigV4Res, error) {
 	if url == "" {
-		url = LookupServerFromUserData()
+		info, err := LookupNodeUserData()
+		if err == nil {
+			url = info.ServerUrl
+			certFingerprint = info.CertFingerprint
+		}
 	}
 	if url == "" {
 		return SigV4Res{}, &LoginError{errors.NewErr("No URL is provided and it can't discovered from user-data")}
 	}
 
-	if awsProfile == "" {
-		awsProfile = "default"
-	}
-
 	// Load the AWS keys that we're going to use to authenticate
-	config, e := external.LoadDefaultAWSConfig(external.WithSharedConfigProfile(awsProfile))
+	var configs []external.Config
+	if awsProfile != "" {
+		configs = append(configs, external.WithSharedConfigProfile(awsProfile))
+	}
+	config, e := external.LoadDefaultAWSConfig(configs...)
 	if e != nil {
 		return SigV4Res{}, e
 	}
@@ -148,7 +141,19 @@ func SendSigv4Auth(awsProfile, url string) (SigV4Res, error) {
 		return SigV4Res{}, &LoginError{errors.NewErr("Failed to open the secure box")}
 	}
 
+	if certFingerprint != "" {
+		fingerprint, e := utils.CertFingerprint(serverCert)
+		if e != nil {
+			return SigV4Res{}, e
+		}
+		if fingerprint != certFingerprint {
+			return SigV4Res{}, &LoginError{errors.NewErr(
+				"The server's certificate doesn't match the expected fingerprint")}
+		}
+	}
+
 	return SigV4Res{
+		ServerUrl: url,
 		AuthToken: authToken,
 		ServerCert: serverCert,
 	}, nil
@@ -159,7 +164,7 @@ func DoAwsLogin(awsProfile, url, targetFile string) error {
 		logrus.Warn("Found APOLLO_CONNECTION in the environment, it will take precedence.")
 	}
 
-	res, err := SendSigv4Auth(awsProfile, url)
+	res, err := SendSigv4Auth(awsProfile, url, "")
 	if err != nil {
 		return err
 	}
@@ -168,7 +173,7 @@ func DoAwsLogin(awsProfile, url, targetFile string) error {
 	// Print the actual result to stdout
 	fmt.Printf("APIKEY\t%s\n", res.AuthToken)
 
-	savedToken := url + "#" + res.AuthToken + "#" + res.ServerCert
+	savedToken := res.ServerUrl + "#" + res.AuthToken + "#" + res.ServerCert
 	return ioutil.WriteFile(targetFile, []byte(savedToken), 0600)
 }
 
@@ -0,0 +1,82 @@
+package apoclient
+
+import (
+	"apollo/proto/gen/restcli"
+	"apollo/proto/gen/restcli/task"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+// How often the log is polled in the follow mode
+var LogFollowPeriod = 2 * time.Second
+
+func MakeLogsCmd() *cobra.Command {
+	var cmdLogs = &cobra.Command{
+		DisableFlagsInUseLine: true,
+		Use:          "logs [flags] <task-id>",
+		Short:        "Print task logs",
+		Long:         `print the output of a task instance (the first one in the array by default)`,
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conn, err := ObtainConnection(cmd)
+			if err != nil {
+				return err
+			}
+
+			var index *int64
+			if cmd.Flags().Changed("index") {
+				val, err := cmd.Flags().GetInt64("index")
+				if err != nil {
+					return err
+				}
+				index = &val
+			}
+			follow, err := cmd.Flags().GetBool("follow")
+			if err != nil {
+				return err
+			}
+
+			return DoPrintLogs(conn, args[0], index, follow)
+		},
+	}
+	cmdLogs.Flags().SortFlags = false
+
+	cmdLogs.Flags().Int64P("index", "i", 0, "The array index of the task instance")
+	cmdLogs.Flags().BoolP("follow", "f", false,
+		"Keep printing the new output until the instance finishes")
+	return cmdLogs
+}
+
+func DoPrintLogs(cli *restcli.Apollo, taskId string, index *int64, follow bool) error {
+	var offset int64
+	for {
+		params := task.NewGetTaskLogsParams()
+		params.TaskID = taskId
+		params.Index = index
+		params.Offset = &offset
+
+		res, err := cli.Task.GetTaskLogs(params, nil)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(res.Payload.Data)
+		if err != nil {
+			return err
+		}
+		offset = res.Payload.NextOffset
+
+		if res.Payload.Finished {
+			return nil
+		}
+		if len(res.Payload.Data) == 0 {
+			// We have read everything that's available so far
+			if !follow {
+				return nil
+			}
+			time.Sleep(LogFollowPeriod)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package apoclient
+
+import (
+	"apollo/proto/gen/restcli"
+	"apollo/proto/gen/restcli/login"
+	. "apollo/utils"
+	"fmt"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+func MakeTokensCmd() *cobra.Command {
+	var cmdTokens = &cobra.Command{
+		Use:   "tokens",
+		Short: "Manage the authentication tokens",
+	}
+	cmdTokens.AddCommand(makeListTokensCmd())
+	cmdTokens.AddCommand(makeRevokeTokensCmd())
+	return cmdTokens
+}
+
+func makeListTokensCmd() *cobra.Command {
+	var cmdList = &cobra.Command{
+		Use:          "list",
+		Short:        "List the live tokens",
+		Long:         `List the tokens that are not expired, their secret keys are never shown`,
+		Args:         cobra.MinimumNArgs(0),
+		SilenceUsage: true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conn, err := ObtainConnection(cmd)
+			if err != nil {
+				return err
+			}
+
+			return DoListTokens(conn, GetFlagS(cmd, "type"),
+				GetFlagS(cmd, "entity"), GetFlagB(cmd, "json"))
+		},
+	}
+	cmdList.Flags().String("type", "",
+		"Token type (UserToken, NodeToken, TaskToken or JoinToken)")
+	cmdList.Flags().StringP("entity", "e", "",
+		"Token entity (e.g. user/123456789012 or node/i-123)")
+	cmdList.Flags().Bool("json", false, "JSON output")
+	return cmdList
+}
+
+func DoListTokens(cli *restcli.Apollo, tokenType string, entity string, json bool) error {
+	params := login.NewGetTokensListParams()
+	params.Type = tokenType
+	params.Entity = entity
+
+	tokens, err := cli.Login.GetTokensList(params, nil)
+	if err != nil {
+		return err
+	}
+
+	if json {
+		for _, t := range tokens.Payload {
+			bytes, e := t.MarshalBinary()
+			if e != nil {
+				return e
+			}
+			fmt.Print(string(bytes) + "\n")
+		}
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Token ID", "Type", "Entity", "Requested By",
+		"Requested On", "Expires"})
+	table.SetRowLine(true)
+	table.SetAutoWrapText(false)
+
+	for _, t := range tokens.Payload {
+		expires := "never"
+		if !t.NeverExpires {
+			expires = time.Time(t.Expires).String()
+		}
+		table.Append([]string{t.ID, t.Type, t.Entity, t.RequestedBy,
+			time.Time(t.RequestedOn).String(), expires})
+	}
+	table.Render()
+
+	return nil
+}
+
+func makeRevokeTokensCmd() *cobra.Command {
+	var cmdRevoke = &cobra.Command{
+		Use:          "revoke [token-id]",
+		Short:        "Revoke tokens",
+		Long:         `Revoke a token by its ID, or all the tokens of an entity or an account`,
+		Args:         cobra.MaximumNArgs(1),
+		SilenceUsage: true,
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var tokenId string
+			if len(args) != 0 {
+				tokenId = args[0]
+			}
+
+			conn, err := ObtainConnection(cmd)
+			if err != nil {
+				return err
+			}
+
+			return DoRevokeTokens(conn, tokenId, GetFlagS(cmd, "entity"),
+				GetFlagS(cmd, "account"))
+		},
+	}
+	cmdRevoke.Flags().StringP("entity", "e", "",
+		"Revoke all the tokens of the entity (e.g. user/123456789012 or node/i-123)")
+	cmdRevoke.Flags().String("account", "",
+		"Revoke all the tokens of the account and the tokens it has requested")
+	return cmdRevoke
+}
+
+func DoRevokeTokens(cli *restcli.Apollo, tokenId string, entity string,
+	account string) error {
+
+	params := login.NewPostTokensRevokeParams()
+	params.TokenID = tokenId
+	params.Entity = entity
+	params.Account = account
+
+	res, err := cli.Login.PostTokensRevoke(params, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("REVOKED\t%d\n", res.Payload.Revoked)
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package apoclient
+
+import (
+	"apollo/utils"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultMetadataUrl = "http://169.254.169.254/latest"
+
+// The EC2 metadata endpoint, it can be overridden to test against a local stub
+var MetadataUrl = DefaultMetadataUrl
+
+func fetchMetadata(path string) (string, error) {
+	client := http.Client{}
+	client.Timeout = 2 * time.Second
+	resp, err := client.Get(strings.TrimSuffix(MetadataUrl, "/") + "/" + path)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get %s from the metadata: %s", path, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// Get the server connection info from the EC2 user data
+func LookupNodeUserData() (utils.NodeUserData, error) {
+	userData, err := fetchMetadata("user-data")
+	if err != nil {
+		return utils.NodeUserData{}, err
+	}
+	return utils.ParseNodeUserData(userData), nil
+}
+
+// Get the EC2 instance ID of this machine
+func LookupInstanceId() (string, error) {
+	id, err := fetchMetadata("meta-data/instance-id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(id), nil
+}
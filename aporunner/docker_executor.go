@@ -0,0 +1,293 @@
+package aporunner
+
+import (
+	"apollo/proto/gen/models"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The exit code reported for the instances that failed to start
+const FailedToStartExitCode = -1
+// The exit code reported for the instances that were killed due to a timeout,
+// the same one as used by the coreutils 'timeout' utility.
+const TimeoutExitCode = 124
+// The exit code reported for the instances killed on the server's request
+// (cancelled or drained), the same one as used by the shells for SIGKILL.
+const KilledExitCode = 137
+// How long to wait for the remaining output of a stopped container
+var LogDrainTimeout = 10 * time.Second
+
+// The server as seen by the tasks, they get their own connection strings
+// in APOLLO_CONNECTION built from it.
+type ServerEndpoint struct {
+	Host string
+	// The base64-encoded DER certificate of the server
+	Cert string
+}
+
+// Run the task instances as Docker containers
+type DockerExecutor struct {
+	docker *DockerContext
+	logs *LogCollector
+	server ServerEndpoint
+
+	mutex sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+func NewDockerExecutor(docker *DockerContext, logs *LogCollector,
+	server ServerEndpoint) *DockerExecutor {
+	return &DockerExecutor{
+		docker: docker,
+		logs: logs,
+		server: server,
+		running: make(map[string]context.CancelFunc),
+	}
+}
+
+func (e *DockerExecutor) StartInstance(inst LocalInstance, ledger *TaskLedger) {
+	ctx, cancel := context.WithCancel(context.Background())
+	id := inst.Assignment.InstanceID
+
+	e.mutex.Lock()
+	e.running[id] = cancel
+	e.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			e.mutex.Lock()
+			delete(e.running, id)
+			e.mutex.Unlock()
+			cancel()
+		}()
+
+		log := e.logs.Open(id)
+		exitCode, reason, err := e.runInstance(ctx, inst.Assignment, log, func() {
+			ledger.SetState(id, models.TaskStateEnumRunning)
+		})
+		if err != nil {
+			logrus.Errorf("Failed to run the task instance %s: %s", id, err.Error())
+			_, _ = fmt.Fprintf(log, "\n[apollo: %s]\n", err.Error())
+		}
+		// The log must be complete before the instance is reported as done
+		_ = log.Close()
+		logrus.Infof("Task instance %s is done, exit code %d", id, exitCode)
+		ledger.Finish(id, exitCode, reason)
+	}()
+}
+
+func (e *DockerExecutor) KillInstance(instanceId string) {
+	e.mutex.Lock()
+	cancel, ok := e.running[instanceId]
+	e.mutex.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func containerName(instanceId string) string {
+	return "apollo-" + instanceId
+}
+
+func imageReference(assignment models.TaskInstanceAssignment) string {
+	repo := assignment.Task.Repo
+	if repo == "" {
+		repo = assignment.DockerRepository
+	}
+	if repo == "" {
+		return assignment.Task.DockerImageID
+	}
+	return strings.TrimSuffix(repo, "/") + "/" + assignment.Task.DockerImageID
+}
+
+func encodeRegistryAuth(assignment models.TaskInstanceAssignment) (string, error) {
+	if assignment.DockerLogin == "" {
+		return "", nil
+	}
+	authBytes, err := json.Marshal(types.AuthConfig{
+		ServerAddress: assignment.DockerRepository,
+		Username: assignment.DockerLogin,
+		Password: assignment.DockerPassword,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(authBytes), nil
+}
+
+func (e *DockerExecutor) pullImage(ctx context.Context, image string,
+	assignment models.TaskInstanceAssignment) error {
+
+	auth, err := encodeRegistryAuth(assignment)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Pulling the image %s", image)
+	reader, err := e.docker.Client.ImagePull(ctx, image, types.ImagePullOptions{
+		RegistryAuth: auth,
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// The pull is complete only when the progress stream is exhausted
+	_, err = io.Copy(ioutil.Discard, reader)
+	return err
+}
+
+func makeContainerConfig(image string, assignment models.TaskInstanceAssignment,
+	server ServerEndpoint) (*container.Config, *container.HostConfig) {
+
+	task := assignment.Task
+	var env []string
+	for k, v := range task.TaskEnv {
+		env = append(env, k+"="+v)
+	}
+	env = append(env, "APOLLO_TASK_ID="+assignment.TaskID,
+		"APOLLO_ARRAY_INDEX="+strconv.FormatInt(assignment.Index, 10))
+	if assignment.TaskToken != "" && server.Host != "" {
+		// The same format as used by the client tools
+		env = append(env, "APOLLO_CONNECTION="+server.Host+"#"+
+			assignment.TaskToken+"#"+server.Cert)
+	}
+
+	config := &container.Config{
+		Image: image,
+		Cmd: task.Cmdline,
+		Env: env,
+		WorkingDir: task.Pwd,
+	}
+
+	hostConfig := &container.HostConfig{
+		Resources: container.Resources{
+			Memory: task.MaxRAMMb * 1024 * 1024,
+			// Disable swap, the task must fit into its RAM limit
+			MemorySwap: task.MaxRAMMb * 1024 * 1024,
+		},
+	}
+	if !task.CanUseAllCpus {
+		hostConfig.Resources.NanoCPUs = 1e9
+	}
+
+	return config, hostConfig
+}
+
+// Copy the container's stdout and stderr into the log until the container stops
+func (e *DockerExecutor) captureLogs(containerId string, log io.Writer) {
+	out, err := e.docker.Client.ContainerLogs(context.Background(), containerId,
+		types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		logrus.Warnf("Failed to get the logs of %s: %s", containerId, err.Error())
+		return
+	}
+	defer out.Close()
+
+	_, err = stdcopy.StdCopy(log, log, out)
+	if err != nil {
+		logrus.Warnf("Failed to read the logs of %s: %s", containerId, err.Error())
+	}
+}
+
+// Run the instance to completion, returns its exit code and the failure
+// reason (empty if the instance has succeeded).
+func (e *DockerExecutor) runInstance(ctx context.Context,
+	assignment models.TaskInstanceAssignment, log io.Writer, onStart func()) (
+	int64, models.FailureReasonEnum, error) {
+
+	if assignment.Task == nil {
+		return FailedToStartExitCode, models.FailureReasonEnumStartFailure,
+			fmt.Errorf("no task is specified")
+	}
+
+	image := imageReference(assignment)
+	err := e.pullImage(ctx, image, assignment)
+	if err != nil {
+		return failedRun(ctx, err)
+	}
+
+	// Remove the leftovers of the previous runs (if the runner was restarted)
+	name := containerName(assignment.InstanceID)
+	_ = e.docker.Client.ContainerRemove(context.Background(), name,
+		types.ContainerRemoveOptions{Force: true})
+
+	config, hostConfig := makeContainerConfig(image, assignment, e.server)
+	resp, err := e.docker.Client.ContainerCreate(ctx, config, hostConfig, nil, name)
+	if err != nil {
+		return failedRun(ctx, err)
+	}
+	defer func() {
+		_ = e.docker.Client.ContainerRemove(context.Background(), resp.ID,
+			types.ContainerRemoveOptions{Force: true})
+	}()
+
+	err = e.docker.Client.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+	if err != nil {
+		return failedRun(ctx, err)
+	}
+	onStart()
+
+	var logsDone = make(chan bool)
+	go func() {
+		e.captureLogs(resp.ID, log)
+		close(logsDone)
+	}()
+	// The log stream ends when the container stops, wait for it before
+	// the container is removed.
+	defer func() {
+		select {
+		case <-logsDone:
+		case <-time.After(LogDrainTimeout):
+			logrus.Warnf("Timed out waiting for the logs of %s", assignment.InstanceID)
+		}
+	}()
+
+	waitCtx, cancel := context.WithTimeout(ctx,
+		time.Duration(assignment.Task.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	exitCode, err := e.docker.Client.ContainerWait(waitCtx, resp.ID)
+	if err == nil {
+		if exitCode == 0 {
+			return exitCode, "", nil
+		}
+		// Check if the container has been killed by the OOM killer
+		info, err := e.docker.Client.ContainerInspect(context.Background(), resp.ID)
+		if err == nil && info.State != nil && info.State.OOMKilled {
+			return exitCode, models.FailureReasonEnumOom, nil
+		}
+		return exitCode, models.FailureReasonEnumExitCode, nil
+	}
+
+	// The instance has either timed out or has been killed
+	_ = e.docker.Client.ContainerKill(context.Background(), resp.ID, "KILL")
+	if ctx.Err() == nil && waitCtx.Err() == context.DeadlineExceeded {
+		return TimeoutExitCode, models.FailureReasonEnumTimeout,
+			fmt.Errorf("the task instance has timed out")
+	}
+	return failedRun(ctx, err)
+}
+
+// The outcome of the instance that hasn't run to completion. The instance
+// killed on the server's request is not a start failure, even if it was
+// killed before its container has started.
+func failedRun(ctx context.Context, err error) (int64, models.FailureReasonEnum, error) {
+	if ctx.Err() != nil {
+		return KilledExitCode, models.FailureReasonEnumKilled,
+			fmt.Errorf("the task instance has been killed")
+	}
+	return FailedToStartExitCode, models.FailureReasonEnumStartFailure, err
+}
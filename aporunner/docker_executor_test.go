@@ -0,0 +1,66 @@
+package aporunner
+
+import (
+	"apollo/proto/gen/models"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestContainerConfig(t *testing.T) {
+	assignment := models.TaskInstanceAssignment{
+		InstanceID:       "12-3",
+		TaskID:           "12",
+		Index:            3,
+		DockerRepository: "repo.example.com/",
+		Task: &models.TaskStruct{
+			Cmdline:       []string{"echo", "hello"},
+			Pwd:           "/work",
+			DockerImageID: "alpine:latest",
+			MaxRAMMb:      100,
+			TaskEnv:       map[string]string{"A": "B"},
+		},
+	}
+
+	image := imageReference(assignment)
+	assert.Equal(t, "repo.example.com/alpine:latest", image)
+
+	config, hostConfig := makeContainerConfig(image, assignment, ServerEndpoint{})
+	assert.Equal(t, []string{"echo", "hello"}, []string(config.Cmd))
+	assert.Equal(t, "/work", config.WorkingDir)
+	assert.Equal(t, []string{"A=B", "APOLLO_TASK_ID=12", "APOLLO_ARRAY_INDEX=3"}, config.Env)
+	assert.Equal(t, int64(100*1024*1024), hostConfig.Memory)
+	assert.Equal(t, int64(1e9), hostConfig.NanoCPUs)
+
+	// The task's own repository takes precedence
+	assignment.Task.Repo = "other.example.com"
+	assignment.Task.CanUseAllCpus = true
+	image = imageReference(assignment)
+	assert.Equal(t, "other.example.com/alpine:latest", image)
+	_, hostConfig = makeContainerConfig(image, assignment, ServerEndpoint{})
+	assert.Equal(t, int64(0), hostConfig.NanoCPUs)
+
+	// The task gets its own connection to the server
+	assignment.TaskToken = "tasktoken"
+	config, _ = makeContainerConfig(image, assignment,
+		ServerEndpoint{Host: "apollo.local:9443", Cert: "Y2VydA=="})
+	assert.Equal(t, "APOLLO_CONNECTION=apollo.local:9443#tasktoken#Y2VydA==",
+		config.Env[len(config.Env)-1])
+}
+
+func TestFailedRunReason(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	exitCode, reason, err := failedRun(ctx, fmt.Errorf("no such image"))
+	assert.Equal(t, int64(FailedToStartExitCode), exitCode)
+	assert.Equal(t, models.FailureReasonEnumStartFailure, reason)
+	assert.EqualError(t, err, "no such image")
+
+	// The instance killed on the server's request is not a start failure
+	cancel()
+	exitCode, reason, err = failedRun(ctx, context.Canceled)
+	assert.Equal(t, int64(KilledExitCode), exitCode)
+	assert.Equal(t, models.FailureReasonEnumKilled, reason)
+	assert.Error(t, err)
+}
@@ -0,0 +1,207 @@
+package aporunner
+
+import (
+	"apollo/proto/gen/models"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"sync"
+)
+
+const DefaultLogDir = "/var/log/apollo"
+// The size of the log file on the node, when it's exceeded the file
+// is rotated and only one previous file is kept.
+const DefaultMaxLogFileSize = 16 * 1024 * 1024
+// The amount of the output buffered for the upload to the server, the
+// output in excess of this size is dropped.
+const MaxPendingLogSize = 1024 * 1024
+
+// The output of a task instance. It's written into a size-capped rotated
+// file on the node and is buffered for the upload to the server.
+type InstanceLog struct {
+	instanceId string
+	fileName string
+	maxFileSize int64
+
+	mutex sync.Mutex
+	file *os.File
+	fileSize int64
+	pending []byte
+	skipped int64
+	closed bool
+}
+
+func (l *InstanceLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return 0, fmt.Errorf("the log of %s is closed", l.instanceId)
+	}
+
+	if len(l.pending)+len(p) <= MaxPendingLogSize {
+		l.pending = append(l.pending, p...)
+	} else {
+		l.skipped += int64(len(p))
+	}
+
+	if l.file == nil {
+		return len(p), nil
+	}
+	if l.fileSize+int64(len(p)) > l.maxFileSize {
+		err := l.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(p)
+	l.fileSize += int64(n)
+	return len(p), err
+}
+
+// Move the current log file into the ".1" file and start a new one
+func (l *InstanceLog) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(l.fileName, l.fileName+".1")
+	if err != nil {
+		return err
+	}
+	l.file, err = os.OpenFile(l.fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	l.fileSize = 0
+	return err
+}
+
+// Take the output that hasn't been uploaded yet
+func (l *InstanceLog) takePending() []byte {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	res := l.pending
+	if l.skipped != 0 {
+		res = append(res, []byte(fmt.Sprintf(
+			"\n[apollo: %d bytes of output were skipped]\n", l.skipped))...)
+		l.skipped = 0
+	}
+	l.pending = nil
+	return res
+}
+
+// Put back the output that has failed to upload
+func (l *InstanceLog) returnPending(data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(data)+len(l.pending) > MaxPendingLogSize {
+		l.skipped += int64(len(data))
+		return
+	}
+	l.pending = append(data, l.pending...)
+}
+
+func (l *InstanceLog) isClosed() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.closed
+}
+
+func (l *InstanceLog) isDrained() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.closed && len(l.pending) == 0 && l.skipped == 0
+}
+
+// Close the log, the instance will produce no more output
+func (l *InstanceLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// The logs of the instances on this node
+type LogCollector struct {
+	dir string
+	maxFileSize int64
+
+	mutex sync.Mutex
+	logs map[string]*InstanceLog
+}
+
+func NewLogCollector(dir string, maxFileSize int64) *LogCollector {
+	return &LogCollector{
+		dir: dir,
+		maxFileSize: maxFileSize,
+		logs: make(map[string]*InstanceLog),
+	}
+}
+
+// Create the log for the instance, the previous log of the instance
+// (from the previous retry) is appended to. The log is usable even if
+// its file can't be created, the output is then only sent to the server.
+func (c *LogCollector) Open(instanceId string) *InstanceLog {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if existing, ok := c.logs[instanceId]; ok && !existing.isClosed() {
+		return existing
+	}
+
+	log := &InstanceLog{
+		instanceId: instanceId,
+		fileName: path.Join(c.dir, instanceId+".log"),
+		maxFileSize: c.maxFileSize,
+	}
+	if existing, ok := c.logs[instanceId]; ok {
+		// Keep the output that hasn't been uploaded yet
+		log.pending = existing.takePending()
+	}
+
+	err := os.MkdirAll(c.dir, 0750)
+	if err == nil {
+		log.file, err = os.OpenFile(log.fileName,
+			os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	}
+	if err != nil {
+		logrus.Warnf("Can't create the log file for %s: %s", instanceId, err.Error())
+		log.file = nil
+	} else if info, err := log.file.Stat(); err == nil {
+		log.fileSize = info.Size()
+	}
+
+	c.logs[instanceId] = log
+	return log
+}
+
+// Collect the pending output of all the instances. The logs that are closed
+// and fully collected are forgotten.
+func (c *LogCollector) collect() ([]*models.InstanceLogChunk, map[string]*InstanceLog) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var chunks []*models.InstanceLogChunk
+	var sources = make(map[string]*InstanceLog)
+	for id, log := range c.logs {
+		data := log.takePending()
+		if len(data) != 0 {
+			chunks = append(chunks, &models.InstanceLogChunk{
+				InstanceID: id,
+				Data:       data,
+			})
+			sources[id] = log
+		} else if log.isDrained() {
+			delete(c.logs, id)
+		}
+	}
+	return chunks, sources
+}
@@ -0,0 +1,45 @@
+package aporunner
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestInstanceLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apollo-logs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logs := NewLogCollector(dir, 10)
+	log := logs.Open("1-0")
+	_, err = log.Write([]byte("12345678"))
+	assert.NoError(t, err)
+	_, err = log.Write([]byte("abcd"))
+	assert.NoError(t, err)
+
+	rotated, err := ioutil.ReadFile(path.Join(dir, "1-0.log.1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "12345678", string(rotated))
+	current, err := ioutil.ReadFile(path.Join(dir, "1-0.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(current))
+
+	// The whole output is pending for the upload
+	chunks, sources := logs.collect()
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, "12345678abcd", string(chunks[0].Data))
+
+	// The failed upload is retried
+	sources["1-0"].returnPending([]byte(chunks[0].Data))
+	assert.NoError(t, log.Close())
+	chunks, _ = logs.collect()
+	assert.Equal(t, "12345678abcd", string(chunks[0].Data))
+
+	// The closed and drained logs are forgotten
+	chunks, _ = logs.collect()
+	assert.Equal(t, 0, len(chunks))
+	assert.Equal(t, 0, len(logs.logs))
+}
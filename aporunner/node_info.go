@@ -4,6 +4,7 @@ import (
 	"apollo/proto/gen/models"
 	"apollo/proto/gen/restcli/node"
 	"context"
+	"github.com/sirupsen/logrus"
 )
 
 func SubmitNodeInfo(r *RunnerContext) error {
@@ -14,25 +15,29 @@ func SubmitNodeInfo(r *RunnerContext) error {
 		return err
 	}
 
-	// We seriously need something better than this to support
-	// detailed more detailed info on Mac OS X hosts.
+	// Docker info is used as a fallback on the hosts without /proc
+	// (e.g. Mac OS X), the detailed metrics are then left empty.
 	nodeInfo := models.NodeInfo{
-		UptimeSeconds: 0,
-		UptimeSecondsIDLE: 0,
 		RAM: models.NodeInfoRAM{
 			RAMTotalMb: info.MemTotal / 1024 / 1024,
 		},
 		CPU: models.NodeInfoCPU{
 			CPUCount: int64(info.NCPU),
 		},
-		Disks: models.NodeInfoDisks{
-		},
+	}
+	if r.Metrics != nil {
+		err = r.Metrics.Collect(info.DockerRootDir, int64(info.NCPU), &nodeInfo)
+		if err != nil {
+			logrus.Warnf("Failed to collect the node metrics: %s", err.Error())
+		}
 	}
 
 	params := node.NewPostNodeStateParams()
 	params.NodeState = nodeInfo
-	var str = "11"
-	params.NodeID = &str
+	// Without the node ID the server uses the node of the token
+	if r.NodeID != "" {
+		params.NodeID = &r.NodeID
+	}
 
 	_, err = r.Client.Node.PostNodeState(params, nil)
 	return err
@@ -0,0 +1,234 @@
+package aporunner
+
+import (
+	"apollo/proto/gen/models"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const bytesInMb = 1024 * 1024
+
+// The cumulative CPU times from /proc/stat, in jiffies
+type cpuTimes struct {
+	total uint64
+	idle uint64
+}
+
+// Collects the node's metrics from /proc, the cgroup filesystem and statfs.
+// The CPU load is computed between two consecutive collections.
+type NodeMetrics struct {
+	ProcDir string
+	CgroupDir string
+
+	mutex sync.Mutex
+	prevCpu *cpuTimes
+}
+
+func NewNodeMetrics() *NodeMetrics {
+	return &NodeMetrics{
+		ProcDir: "/proc",
+		CgroupDir: "/sys/fs/cgroup",
+	}
+}
+
+// Fill the node info with the current metrics, dockerRoot is the Docker
+// data root that is used to report the disk space.
+func (m *NodeMetrics) Collect(dockerRoot string, cpuCount int64, info *models.NodeInfo) error {
+	err := m.readFile("meminfo", func(r io.Reader) error {
+		memInfo, err := parseMeminfo(r)
+		if err != nil {
+			return err
+		}
+		fillRAMInfo(memInfo, &info.RAM)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if limit, ok := m.cgroupMemoryLimit(); ok && limit/bytesInMb < info.RAM.RAMTotalMb {
+		// The runner is confined to a cgroup (e.g. runs in a container)
+		info.RAM.RAMTotalMb = limit / bytesInMb
+	}
+
+	err = m.readFile("uptime", func(r io.Reader) error {
+		uptime, idle, err := parseUptime(r)
+		if err != nil {
+			return err
+		}
+		info.UptimeSeconds = int64(uptime)
+		// The idle time is summed over all the CPUs
+		if cpuCount > 0 {
+			idle /= float64(cpuCount)
+		}
+		info.UptimeSecondsIDLE = int64(idle)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = m.readFile("stat", func(r io.Reader) error {
+		times, err := parseCpuTimes(r)
+		if err != nil {
+			return err
+		}
+		info.CPU.AggregateCPULoad = m.updateCpuLoad(times)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if dockerRoot != "" {
+		var st syscall.Statfs_t
+		err = syscall.Statfs(dockerRoot, &st)
+		if err != nil {
+			return err
+		}
+		info.Disks = models.NodeInfoDisks{
+			MountPoint:  dockerRoot,
+			SpaceUsedMb: int64((st.Blocks - st.Bfree) * uint64(st.Bsize) / bytesInMb),
+			SpaceFreeMb: int64(st.Bavail * uint64(st.Bsize) / bytesInMb),
+		}
+	}
+
+	return nil
+}
+
+func (m *NodeMetrics) readFile(name string, parser func(r io.Reader) error) error {
+	file, err := os.Open(path.Join(m.ProcDir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return parser(file)
+}
+
+// Compute the CPU load in percents since the previous collection
+func (m *NodeMetrics) updateCpuLoad(times cpuTimes) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var prev cpuTimes
+	if m.prevCpu != nil {
+		prev = *m.prevCpu
+	}
+	m.prevCpu = &times
+
+	total := times.total - prev.total
+	if total == 0 || times.total < prev.total {
+		return 0
+	}
+	return 100 * float64(total-(times.idle-prev.idle)) / float64(total)
+}
+
+// Get the memory limit of the runner's cgroup (cgroups v1 or v2)
+func (m *NodeMetrics) cgroupMemoryLimit() (int64, bool) {
+	for _, name := range []string{"memory/memory.limit_in_bytes", "memory.max"} {
+		data, err := ioutil.ReadFile(path.Join(m.CgroupDir, name))
+		if err != nil {
+			continue
+		}
+		// The unlimited cgroups have either "max" or a huge number here
+		limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil || limit <= 0 {
+			continue
+		}
+		return limit, true
+	}
+	return 0, false
+}
+
+// Parse /proc/meminfo, the values are in kilobytes
+func parseMeminfo(r io.Reader) (map[string]int64, error) {
+	var res = make(map[string]int64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		val, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad meminfo line: %s", scanner.Text())
+		}
+		res[strings.TrimSuffix(fields[0], ":")] = val
+	}
+	return res, scanner.Err()
+}
+
+func fillRAMInfo(memInfo map[string]int64, ram *models.NodeInfoRAM) {
+	cache := memInfo["Buffers"] + memInfo["Cached"] + memInfo["SReclaimable"]
+	used := memInfo["MemTotal"] - memInfo["MemFree"] - cache
+	if used < 0 {
+		used = 0
+	}
+
+	ram.RAMTotalMb = memInfo["MemTotal"] / 1024
+	ram.RAMUsedMb = used / 1024
+	ram.RAMCacheMb = cache / 1024
+	ram.SwapUsedMb = (memInfo["SwapTotal"] - memInfo["SwapFree"]) / 1024
+	ram.SwapFreeMb = memInfo["SwapFree"] / 1024
+}
+
+// Parse /proc/uptime: the uptime and the idle time in seconds
+func parseUptime(r io.Reader) (float64, float64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, 0, fmt.Errorf("bad uptime data: %s", string(data))
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	idle, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uptime, idle, nil
+}
+
+// Parse the aggregate "cpu" line of /proc/stat
+func parseCpuTimes(r io.Reader) (cpuTimes, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+
+		var res cpuTimes
+		for i, f := range fields[1:] {
+			val, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return cpuTimes{}, fmt.Errorf("bad cpu line: %s", scanner.Text())
+			}
+			// The guest time is already included into the user time
+			if i >= 8 {
+				break
+			}
+			res.total += val
+			// Idle and iowait
+			if i == 3 || i == 4 {
+				res.idle += val
+			}
+		}
+		return res, nil
+	}
+	if scanner.Err() != nil {
+		return cpuTimes{}, scanner.Err()
+	}
+	return cpuTimes{}, fmt.Errorf("no cpu line in /proc/stat")
+}
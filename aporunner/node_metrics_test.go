@@ -0,0 +1,63 @@
+package aporunner
+
+import (
+	"apollo/proto/gen/models"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const testMeminfo = `MemTotal:       16384000 kB
+MemFree:         2048000 kB
+MemAvailable:    8192000 kB
+Buffers:          512000 kB
+Cached:          3072000 kB
+SwapCached:            0 kB
+SReclaimable:     512000 kB
+SwapTotal:       2048000 kB
+SwapFree:        1024000 kB
+`
+
+func writeProcFiles(t *testing.T, dir, stat string) {
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "meminfo"), []byte(testMeminfo), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "uptime"),
+		[]byte("1000.50 3600.00\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "stat"), []byte(stat), 0600))
+}
+
+func TestNodeMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apollo-proc")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeProcFiles(t, dir, "cpu  100 0 100 700 100 0 0 0 0 0\ncpu0 1 2 3 4 5\n")
+	metrics := &NodeMetrics{ProcDir: dir, CgroupDir: path.Join(dir, "cgroup")}
+
+	var info models.NodeInfo
+	assert.NoError(t, metrics.Collect(dir, 4, &info))
+	assert.Equal(t, models.NodeInfoRAM{
+		RAMTotalMb: 16000,
+		RAMUsedMb:  10000,
+		RAMCacheMb: 4000,
+		SwapUsedMb: 1000,
+		SwapFreeMb: 1000,
+	}, info.RAM)
+	assert.Equal(t, int64(1000), info.UptimeSeconds)
+	assert.Equal(t, int64(900), info.UptimeSecondsIDLE)
+	assert.Equal(t, 20.0, info.CPU.AggregateCPULoad)
+	assert.Equal(t, dir, info.Disks.MountPoint)
+
+	// The load is computed since the previous collection
+	writeProcFiles(t, dir, "cpu  200 0 100 800 100 0 0 0 0 0\n")
+	assert.NoError(t, metrics.Collect("", 4, &info))
+	assert.Equal(t, 50.0, info.CPU.AggregateCPULoad)
+
+	// The cgroup limit takes precedence
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "cgroup"), 0700))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "cgroup", "memory.max"),
+		[]byte("1073741824\n"), 0600))
+	assert.NoError(t, metrics.Collect("", 4, &info))
+	assert.Equal(t, int64(1024), info.RAM.RAMTotalMb)
+}
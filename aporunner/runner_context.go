@@ -13,23 +13,39 @@ import (
 var NodeUpdatePeriod = 60 * time.Second
 
 type RunnerContext struct {
+	NodeID string
 	LastSuccess time.Time
 	Client *restcli.Apollo
 	Docker *DockerContext
 
+	Ledger *TaskLedger
+	Executor TaskExecutor
+	Logs *LogCollector
+	Metrics *NodeMetrics
+
 	SuicideTimeout time.Duration
+
+	// Signalled when the server asks the runner to exit
+	shutdown chan bool
 }
 
-func NewRunnerContext(client *restcli.Apollo, docker *client.Client,
-	suicideTimeout time.Duration) *RunnerContext {
+func NewRunnerContext(nodeId string, client *restcli.Apollo, server ServerEndpoint,
+	docker *client.Client, logs *LogCollector, suicideTimeout time.Duration) *RunnerContext {
 
+	dockerContext := &DockerContext{
+		Client: docker,
+	}
 	return &RunnerContext{
+		NodeID:         nodeId,
 		LastSuccess:    time.Now(),
 		Client:         client,
-		Docker:         &DockerContext{
-			Client: docker,
-		},
+		Docker:         dockerContext,
+		Ledger:         NewTaskLedger(),
+		Executor:       NewDockerExecutor(dockerContext, logs, server),
+		Logs:           logs,
+		Metrics:        NewNodeMetrics(),
 		SuicideTimeout: suicideTimeout,
+		shutdown:       make(chan bool, 1),
 	}
 }
 
@@ -101,13 +117,13 @@ func (r *RunnerContext) RunNodeInfoPusher(done <- chan bool) {
 
 func (r *RunnerContext) RunTaskPoller(done <- chan bool) {
 	// Poll the server for changes in task assignments
-	for ;; {
-		select {
-		case <- done:
-			return
-		default:
+	runWithTicker(done, TaskPollPeriod, func() error {
+		err := r.SyncTasks()
+		if err != nil {
+			logrus.Errorf("failed to synchronize tasks: %s", err.Error())
 		}
-	}
+		return err
+	})
 }
 
 func (r *RunnerContext) RunUntilDone() error {
@@ -117,7 +133,7 @@ func (r *RunnerContext) RunUntilDone() error {
 
 	var doneSuicider = make(chan bool)
 	var donePusher = make(chan bool)
-	//var donePoller = make(chan bool)
+	var donePoller = make(chan bool)
 	if r.SuicideTimeout != 0 {
 		logrus.Infof("Starting the watchdog, timeout is %d sec.",
 			r.SuicideTimeout/time.Second)
@@ -127,16 +143,22 @@ func (r *RunnerContext) RunUntilDone() error {
 	}
 	logrus.Info("Starting the node state publisher")
 	go r.RunNodeInfoPusher(donePusher)
-
-	// Wait for the OS interrupt
-	<- interrupt
-	logrus.Info("Interrupt received, shutting down")
+	logrus.Info("Starting the task poller")
+	go r.RunTaskPoller(donePoller)
+
+	// Wait for the OS interrupt or for the shutdown request from the server
+	select {
+	case <- interrupt:
+		logrus.Info("Interrupt received, shutting down")
+	case <- r.shutdown:
+		logrus.Info("Shutdown requested by the server")
+	}
 
 	donePusher <- true
 	if r.SuicideTimeout != 0 {
 		doneSuicider <- true
 	}
-	//donePoller <- true
+	donePoller <- true
 
 	return nil
 }
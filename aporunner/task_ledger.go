@@ -0,0 +1,117 @@
+package aporunner
+
+import (
+	"apollo/proto/gen/models"
+	"sync"
+)
+
+// The task instance held by the runner
+type LocalInstance struct {
+	Assignment models.TaskInstanceAssignment
+	State models.TaskStateEnum
+	ExitCode *int64
+	FailureReason models.FailureReasonEnum
+}
+
+// The runner's view of the task instances on this node. It's reported to the
+// server on every synchronization.
+type TaskLedger struct {
+	mutex sync.Mutex
+	instances map[string]*LocalInstance
+}
+
+func NewTaskLedger() *TaskLedger {
+	return &TaskLedger{
+		instances: make(map[string]*LocalInstance),
+	}
+}
+
+// Accept a new instance in the "waiting" state, returns false
+// if the instance is already known.
+func (l *TaskLedger) Accept(assignment models.TaskInstanceAssignment) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.instances[assignment.InstanceID]; ok {
+		return false
+	}
+	l.instances[assignment.InstanceID] = &LocalInstance{
+		Assignment: assignment,
+		State: models.TaskStateEnumWaiting,
+	}
+	return true
+}
+
+func (l *TaskLedger) SetState(instanceId string, state models.TaskStateEnum) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	inst, ok := l.instances[instanceId]
+	if !ok {
+		return
+	}
+	inst.State = state
+}
+
+// Mark the instance as done, the failure reason must be empty
+// if the instance has succeeded.
+func (l *TaskLedger) Finish(instanceId string, exitCode int64,
+	reason models.FailureReasonEnum) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	inst, ok := l.instances[instanceId]
+	if !ok {
+		return
+	}
+	inst.State = models.TaskStateEnumDone
+	inst.ExitCode = &exitCode
+	inst.FailureReason = reason
+}
+
+func (l *TaskLedger) Get(instanceId string) (LocalInstance, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	inst, ok := l.instances[instanceId]
+	if !ok {
+		return LocalInstance{}, false
+	}
+	return *inst, true
+}
+
+// The number of the instances in the ledger
+func (l *TaskLedger) Count() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.instances)
+}
+
+// Remove the instance from the ledger
+func (l *TaskLedger) Forget(instanceId string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.instances, instanceId)
+}
+
+// Get the statuses of all the instances to report them to the server
+func (l *TaskLedger) Statuses() []*models.TaskStatus {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var res = make([]*models.TaskStatus, 0, len(l.instances))
+	for k, v := range l.instances {
+		attempt := v.Assignment.Attempt
+		res = append(res, &models.TaskStatus{
+			TaskID:     v.Assignment.TaskID,
+			InstanceID: k,
+			Attempt:    &attempt,
+			TaskState:  v.State,
+			ExitCode:   v.ExitCode,
+
+			FailureReason: v.FailureReason,
+		})
+	}
+	return res
+}
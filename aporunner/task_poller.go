@@ -0,0 +1,108 @@
+package aporunner
+
+import (
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restcli/node"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+var TaskPollPeriod = 10 * time.Second
+
+// The executor actually runs the task instances. It must report the
+// state changes of the instances into the ledger.
+type TaskExecutor interface {
+	// Start the instance, it's already in the ledger in the "waiting" state.
+	// Must not block until the instance is complete.
+	StartInstance(inst LocalInstance, ledger *TaskLedger)
+	// Kill the instance if it's running
+	KillInstance(instanceId string)
+}
+
+// Report the instances on this node to the server and apply the changes
+// requested by it.
+func (r *RunnerContext) SyncTasks() error {
+	statuses := r.Ledger.Statuses()
+
+	// The logs of the finished instances are closed before they are marked
+	// as done, so the uploaded logs are complete for all the reported instances.
+	err := r.UploadLogs()
+	if err != nil {
+		logrus.Errorf("failed to upload the task logs: %s", err.Error())
+	}
+
+	params := node.NewPostNodeTasksParams()
+	params.NodeID = r.NodeID
+	params.TaskStates = statuses
+
+	res, err := r.Client.Node.PostNodeTasks(params, nil)
+	if err != nil {
+		return err
+	}
+	r.LastSuccess = time.Now()
+
+	// The server now knows about the finished instances, we can forget them
+	for _, st := range statuses {
+		if st.TaskState == models.TaskStateEnumDone {
+			r.Ledger.Forget(st.InstanceID)
+		}
+	}
+
+	for _, id := range res.Payload.KillInstances {
+		logrus.Infof("Killing the task instance %s", id)
+		if r.Executor != nil {
+			r.Executor.KillInstance(id)
+		}
+		r.Ledger.Forget(id)
+	}
+
+	for _, assignment := range res.Payload.StartInstances {
+		if assignment == nil || !r.Ledger.Accept(*assignment) {
+			continue
+		}
+		logrus.Infof("Starting the task instance %s", assignment.InstanceID)
+		if r.Executor == nil {
+			logrus.Warnf("No executor is configured, the instance %s will wait",
+				assignment.InstanceID)
+			continue
+		}
+		inst, _ := r.Ledger.Get(assignment.InstanceID)
+		r.Executor.StartInstance(inst, r.Ledger)
+	}
+
+	// The node has been drained, exit once all the instances are reported
+	if res.Payload.Shutdown && r.Ledger.Count() == 0 {
+		logrus.Info("The node has been drained, shutting down")
+		select {
+		case r.shutdown <- true:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Send the new output of the task instances to the server
+func (r *RunnerContext) UploadLogs() error {
+	if r.Logs == nil {
+		return nil
+	}
+
+	chunks, sources := r.Logs.collect()
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	params := node.NewPostNodeLogsParams()
+	params.NodeID = r.NodeID
+	params.Logs = chunks
+	_, err := r.Client.Node.PostNodeLogs(params, nil)
+	if err != nil {
+		// Try again during the next synchronization
+		for _, c := range chunks {
+			sources[c.InstanceID].returnPending([]byte(c.Data))
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/utils"
+	"fmt"
+	"github.com/go-openapi/runtime"
+	"github.com/go-openapi/runtime/middleware"
+	"net/http"
+)
+
+type Role string
+
+const (
+	// Can do everything, including the queue and node management
+	RoleAdmin Role = "admin"
+	// Can submit and cancel tasks and view everything
+	RoleSubmitter Role = "submitter"
+	// Can only view the tasks, queues and nodes
+	RoleViewer Role = "viewer"
+	// The runners, they can only report their state and get their tasks
+	RoleNode Role = "node"
+	// The running tasks, they can only submit and view the tasks of their
+	// own job (see taskScope)
+	RoleTask Role = "task"
+)
+
+// The role of the accounts that have no explicit role
+const DefaultAccountRole = RoleSubmitter
+
+// The API operations subject to the authorization
+type Operation string
+
+const (
+	OpPing             Operation = "ping"
+	OpGetNodeToken     Operation = "get-node-token"
+	OpCreateJoinToken  Operation = "create-join-token"
+	OpListTokens       Operation = "list-tokens"
+	OpRevokeTokens     Operation = "revoke-tokens"
+	OpSubmitTask       Operation = "submit-task"
+	OpListTasks        Operation = "list-tasks"
+	OpGetTaskLogs      Operation = "get-task-logs"
+	OpCancelTasks      Operation = "cancel-tasks"
+	OpListQueues       Operation = "list-queues"
+	OpPutQueue         Operation = "put-queue"
+	OpDeleteQueue      Operation = "delete-queue"
+	OpPutUnmanagedNode Operation = "put-unmanaged-node"
+	OpListNodes        Operation = "list-nodes"
+	OpDrainNode        Operation = "drain-node"
+	OpPostNodeState    Operation = "post-node-state"
+	OpSyncNodeTasks    Operation = "sync-node-tasks"
+	OpPostNodeLogs     Operation = "post-node-logs"
+)
+
+// The roles allowed to invoke the operations, admins can invoke everything
+var operationRoles = map[Operation][]Role{
+	OpPing:             {RoleSubmitter, RoleViewer, RoleNode, RoleTask},
+	OpGetNodeToken:     {},
+	OpCreateJoinToken:  {},
+	OpListTokens:       {},
+	OpRevokeTokens:     {},
+	OpSubmitTask:       {RoleSubmitter, RoleTask},
+	OpListTasks:        {RoleSubmitter, RoleViewer, RoleTask},
+	OpGetTaskLogs:      {RoleSubmitter, RoleViewer, RoleTask},
+	OpCancelTasks:      {RoleSubmitter},
+	OpListQueues:       {RoleSubmitter, RoleViewer},
+	OpPutQueue:         {},
+	OpDeleteQueue:      {},
+	OpPutUnmanagedNode: {},
+	OpListNodes:        {RoleSubmitter, RoleViewer},
+	OpDrainNode:        {},
+	OpPostNodeState:    {RoleNode},
+	OpSyncNodeTasks:    {RoleNode},
+	OpPostNodeLogs:     {RoleNode},
+}
+
+func ParseRole(role string) (Role, error) {
+	switch Role(role) {
+	case RoleAdmin, RoleSubmitter, RoleViewer:
+		return Role(role), nil
+	}
+	// The node and task roles are implied by the token types, they can't be
+	// given to a user
+	return "", fmt.Errorf("unknown account role: %s", role)
+}
+
+// Checks the principal's rights to invoke the API operations. The role of
+// a user is set per account, the other token types have fixed roles.
+type Authorizer struct {
+	accountRoles map[string]Role
+	defaultRole  Role
+}
+
+func NewAuthorizer(accountRoles map[string]Role, defaultRole Role) *Authorizer {
+	return &Authorizer{
+		accountRoles: accountRoles,
+		defaultRole:  defaultRole,
+	}
+}
+
+func (a *Authorizer) GetRole(principal data.AuthToken) (Role, bool) {
+	switch principal.Type {
+	case data.UserToken:
+		role, ok := a.accountRoles[principal.EntityKey]
+		if !ok {
+			return a.defaultRole, true
+		}
+		return role, true
+	case data.NodeToken:
+		return RoleNode, true
+	case data.TaskToken:
+		return RoleTask, true
+	}
+	return "", false
+}
+
+func (a *Authorizer) IsAllowed(principal data.AuthToken, op Operation) bool {
+	role, ok := a.GetRole(principal)
+	if !ok {
+		return false
+	}
+	if role == RoleAdmin {
+		return true
+	}
+	for _, r := range operationRoles[op] {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the principal can invoke the operation, returns the 403
+// response if it can't or nil otherwise.
+func (a *Authorizer) Authorize(req *http.Request, principal interface{},
+	op Operation) middleware.Responder {
+
+	token, _ := principal.(data.AuthToken)
+	if a.IsAllowed(token, op) {
+		return nil
+	}
+
+	utils.CL(req.Context()).Warnf("Access denied: %s can't invoke %s",
+		token.Type, op)
+	return &forbiddenResponder{payload: &models.Error{
+		Code:      http.StatusForbidden,
+		Message:   fmt.Sprintf("operation %s is not allowed", op),
+		RequestID: utils.GetReqIdFromContext(req.Context()),
+	}}
+}
+
+// The 403 response, it's the same for all the operations
+type forbiddenResponder struct {
+	payload *models.Error
+}
+
+func (f *forbiddenResponder) WriteResponse(rw http.ResponseWriter, producer runtime.Producer) {
+	rw.WriteHeader(http.StatusForbidden)
+	if err := producer.Produce(rw, f.payload); err != nil {
+		panic(err) // let the recovery middleware deal with this
+	}
+}
@@ -0,0 +1,73 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	auth := NewAuthorizer(map[string]Role{
+		"111": RoleAdmin,
+		"222": RoleViewer,
+	}, RoleSubmitter)
+
+	admin := data.AuthToken{Type: data.UserToken, EntityKey: "111"}
+	viewer := data.AuthToken{Type: data.UserToken, EntityKey: "222"}
+	submitter := data.AuthToken{Type: data.UserToken, EntityKey: "333"}
+	node := data.AuthToken{Type: data.NodeToken, EntityKey: "n1"}
+	task := data.AuthToken{Type: data.TaskToken, EntityKey: "t1"}
+	join := data.AuthToken{Type: data.JoinToken, EntityKey: "q1"}
+
+	assert.True(t, auth.IsAllowed(admin, OpDeleteQueue))
+	assert.True(t, auth.IsAllowed(admin, OpPostNodeLogs))
+
+	assert.True(t, auth.IsAllowed(viewer, OpListTasks))
+	assert.False(t, auth.IsAllowed(viewer, OpSubmitTask))
+	assert.False(t, auth.IsAllowed(viewer, OpCancelTasks))
+
+	assert.True(t, auth.IsAllowed(submitter, OpSubmitTask))
+	assert.True(t, auth.IsAllowed(submitter, OpCancelTasks))
+	assert.False(t, auth.IsAllowed(submitter, OpDeleteQueue))
+	assert.False(t, auth.IsAllowed(submitter, OpCreateJoinToken))
+	assert.False(t, auth.IsAllowed(submitter, OpSyncNodeTasks))
+
+	assert.True(t, auth.IsAllowed(node, OpSyncNodeTasks))
+	assert.True(t, auth.IsAllowed(node, OpPing))
+	assert.False(t, auth.IsAllowed(node, OpSubmitTask))
+	assert.False(t, auth.IsAllowed(node, OpListQueues))
+
+	assert.True(t, auth.IsAllowed(task, OpSubmitTask))
+	assert.True(t, auth.IsAllowed(task, OpGetTaskLogs))
+	assert.False(t, auth.IsAllowed(task, OpCancelTasks))
+	assert.False(t, auth.IsAllowed(task, OpListQueues))
+	assert.False(t, auth.IsAllowed(task, OpPostNodeState))
+
+	assert.False(t, auth.IsAllowed(join, OpPing))
+	assert.False(t, auth.IsAllowed(data.AuthToken{}, OpPing))
+
+	_, err := ParseRole("node")
+	assert.Error(t, err)
+	_, err = ParseRole("task")
+	assert.Error(t, err)
+	role, err := ParseRole("viewer")
+	assert.NoError(t, err)
+	assert.Equal(t, RoleViewer, role)
+}
+
+func TestAuthorizeDenied(t *testing.T) {
+	auth := NewAuthorizer(nil, RoleViewer)
+	req := httptest.NewRequest("DELETE", "/queue", nil)
+	req = req.WithContext(utils.SaveReqIdToContext(req.Context(), "req1"))
+	user := data.AuthToken{Type: data.UserToken, EntityKey: "123456"}
+
+	assert.Nil(t, auth.Authorize(req, user, OpListQueues))
+
+	denied, ok := auth.Authorize(req, user, OpDeleteQueue).(*forbiddenResponder)
+	assert.True(t, ok)
+	assert.Equal(t, int64(http.StatusForbidden), denied.payload.Code)
+	assert.Equal(t, "req1", denied.payload.RequestID)
+}
@@ -0,0 +1,450 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"sync"
+	"time"
+)
+
+var AutoscalerInterval = 30 * time.Second
+
+const DefaultMaxNodesPerQueue = 10
+const DefaultIdleCooldown = 10 * time.Minute
+const DefaultBootTimeout = 15 * time.Minute
+
+// Launches the managed nodes for the queues that have more waiting task
+// instances than their nodes can fit, and terminates the idle managed nodes.
+// The nodes are launched using the queue's launch template and instance types.
+type Autoscaler struct {
+	cloud CloudConnector
+	queueStore *data.QueueStore
+	nodeStore *data.NodeStore
+	taskStore *data.TaskStore
+
+	MaxNodesPerQueue int
+	IdleCooldown time.Duration
+	BootTimeout time.Duration
+	// The user data of the launched nodes
+	UserData string
+
+	// The resources of the instance types obtained from the cloud
+	specMutex sync.Mutex
+	instanceSpecs map[string]InstanceTypeSpec
+
+	// The time since the active managed nodes have no task instances,
+	// it's only used by the autoscaler thread.
+	idleSince map[string]time.Time
+}
+
+func NewAutoscaler(v *viper.Viper, cloud CloudConnector, userData string,
+	queueStore *data.QueueStore, nodeStore *data.NodeStore,
+	taskStore *data.TaskStore) *Autoscaler {
+
+	scaler := &Autoscaler{
+		cloud: cloud,
+		queueStore: queueStore,
+		nodeStore: nodeStore,
+		taskStore: taskStore,
+		MaxNodesPerQueue: DefaultMaxNodesPerQueue,
+		IdleCooldown: DefaultIdleCooldown,
+		BootTimeout: DefaultBootTimeout,
+		UserData: userData,
+		idleSince: make(map[string]time.Time),
+	}
+	if v.IsSet("autoscaler.max-nodes-per-queue") {
+		scaler.MaxNodesPerQueue = v.GetInt("autoscaler.max-nodes-per-queue")
+	}
+	if v.IsSet("autoscaler.idle-cooldown") {
+		scaler.IdleCooldown = v.GetDuration("autoscaler.idle-cooldown")
+	}
+	if v.IsSet("autoscaler.boot-timeout") {
+		scaler.BootTimeout = v.GetDuration("autoscaler.boot-timeout")
+	}
+	return scaler
+}
+
+func (a *Autoscaler) RunAutoscaler() chan bool {
+	var done = make(chan bool, 1)
+	go func() {
+		logrus.Infof("Starting the autoscaler thread")
+		ticker := time.NewTicker(AutoscalerInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := a.Autoscale(time.Now())
+				if err != nil {
+					logrus.Errorf("Encountered error while autoscaling: %s", err.Error())
+				}
+			case <-done:
+				logrus.Info("Stopping the autoscaler thread")
+				return
+			}
+		}
+	}()
+
+	return done
+}
+
+// The nodes that are launched but haven't started their runners yet
+func isNodePending(n *data.StoredNode) bool {
+	return n.State == models.NodeStateEnumCreating ||
+		n.State == models.NodeStateEnumInitializing
+}
+
+// The node info of a node of the given instance type
+func makeSpecNodeInfo(spec InstanceTypeSpec) models.NodeInfo {
+	return models.NodeInfo{
+		RAM: models.NodeInfoRAM{RAMTotalMb: spec.RAMMb},
+		CPU: models.NodeInfoCPU{CPUCount: spec.CPUs},
+	}
+}
+
+// Get the resources of the instance types, the types unknown to the cloud
+// are absent from the result. The resources of the instance types don't
+// change, so they are cached.
+func (a *Autoscaler) ResolveInstanceTypes(types []string) (
+	map[string]InstanceTypeSpec, error) {
+
+	a.specMutex.Lock()
+	defer a.specMutex.Unlock()
+
+	if a.instanceSpecs == nil {
+		a.instanceSpecs = make(map[string]InstanceTypeSpec)
+	}
+	var missing []string
+	for _, t := range types {
+		if _, ok := a.instanceSpecs[t]; !ok {
+			missing = append(missing, t)
+		}
+	}
+	if len(missing) != 0 {
+		specs, err := a.cloud.DescribeInstanceTypes(missing)
+		if err != nil {
+			return nil, err
+		}
+		for t, spec := range specs {
+			a.instanceSpecs[t] = spec
+		}
+	}
+
+	var res = make(map[string]InstanceTypeSpec)
+	for _, t := range types {
+		if spec, ok := a.instanceSpecs[t]; ok {
+			res[t] = spec
+		}
+	}
+	return res, nil
+}
+
+// The instance types used by the queues and the managed nodes
+func usedInstanceTypes(queues []*data.StoredQueue, nodes []*data.StoredNode) []string {
+	var res []string
+	for _, q := range queues {
+		res = append(res, q.InstanceTypes...)
+	}
+	for _, n := range nodes {
+		if n.Managed {
+			res = append(res, n.InstanceType)
+		}
+	}
+	return res
+}
+
+// Run one pass of the autoscaler
+func (a *Autoscaler) Autoscale(now time.Time) error {
+	queues := a.queueStore.ListQueues(nil)
+
+	// Release the unneeded nodes first, so that the stuck nodes are replaced
+	// on the same pass.
+	nodes := a.listNodes()
+	busy := a.listBusyNodes()
+	for _, q := range queues {
+		err := a.scaleDown(managedQueueNodes(nodes, q.Key), busy, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	nodes = a.listNodes()
+	specs, err := a.ResolveInstanceTypes(usedInstanceTypes(queues, nodes))
+	if err != nil {
+		return err
+	}
+	unplaced := a.computeDemand(nodes, specs, now)
+	for _, q := range queues {
+		err := a.scaleUp(q, managedQueueNodes(nodes, q.Key), unplaced[q.Key], specs, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List the nodes that are not dead, they must be listed before
+// the instances are locked.
+func (a *Autoscaler) listNodes() []*data.StoredNode {
+	return a.nodeStore.ListNodes(nil, func(n *data.StoredNode) bool {
+		return n.State != models.NodeStateEnumDead
+	})
+}
+
+func managedQueueNodes(nodes []*data.StoredNode, queue string) []*data.StoredNode {
+	var res []*data.StoredNode
+	for _, n := range nodes {
+		if n.Managed && n.Queue == queue {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// Get the set of nodes that have task instances
+func (a *Autoscaler) listBusyNodes() map[string]bool {
+	a.taskStore.LockInstances()
+	defer a.taskStore.UnlockInstances()
+
+	var busy = make(map[string]bool)
+	for _, inst := range a.taskStore.ListTaskInstances(isUsingNode) {
+		busy[inst.AssignedNode] = true
+	}
+	return busy
+}
+
+// Find the ready task instances that can't be placed onto the existing
+// nodes (including the nodes that are still booting), grouped by the queue.
+// Each instance is represented by its task.
+func (a *Autoscaler) computeDemand(nodes []*data.StoredNode,
+	specs map[string]InstanceTypeSpec, now time.Time) map[string][]*data.StoredTask {
+
+	var pool []*data.StoredNode
+	for _, n := range nodes {
+		if n.State == models.NodeStateEnumActive {
+			pool = append(pool, n)
+		} else if isNodePending(n) {
+			// Assume the full size of the instance type for the booting nodes
+			nodeCopy := *n
+			if spec, ok := specs[n.InstanceType]; ok {
+				nodeCopy.Info = makeSpecNodeInfo(spec)
+			}
+			pool = append(pool, &nodeCopy)
+		}
+	}
+
+	a.taskStore.LockInstances()
+	defer a.taskStore.UnlockInstances()
+
+	capacity := computeCapacity(a.taskStore, pool)
+
+	nowTime := data.FromTime(now)
+	waiting := a.taskStore.ListTaskInstances(func(inst *data.TaskInstance) bool {
+		return inst.State == models.TaskStateEnumWaiting && inst.NotBefore <= nowTime
+	})
+	sortInstances(waiting)
+
+	deps := newDependencyResolver(a.taskStore)
+	var unplaced = make(map[string][]*data.StoredTask)
+	for _, inst := range waiting {
+		task, ok := a.taskStore.GetTask(inst.InstanceKey.ParentKey)
+		if !ok {
+			continue
+		}
+		ready, _ := deps.check(inst, task)
+		if !ready {
+			continue
+		}
+
+		nc := findNodeForTask(task, capacity[task.Queue])
+		if nc == nil {
+			unplaced[task.Queue] = append(unplaced[task.Queue], task)
+			continue
+		}
+		nc.freeRAMMb -= task.ExpectedRAMMb
+		nc.freeSlots--
+	}
+
+	return unplaced
+}
+
+// Pick the first of the queue's instance types that can run the task
+func pickInstanceType(q *data.StoredQueue, specs map[string]InstanceTypeSpec,
+	task *data.StoredTask) (string, bool) {
+
+	for _, t := range q.InstanceTypes {
+		spec, ok := specs[t]
+		if !ok {
+			continue
+		}
+		if spec.RAMMb >= task.MaxRAMMb && spec.RAMMb >= task.ExpectedRAMMb {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// Launch the nodes for the unplaced task instances of the queue. The
+// instances are packed onto the new nodes the same way the scheduler
+// packs them, the number of the queue's nodes is capped.
+func (a *Autoscaler) scaleUp(q *data.StoredQueue, queueNodes []*data.StoredNode,
+	unplaced []*data.StoredTask, specs map[string]InstanceTypeSpec, now time.Time) error {
+
+	if len(unplaced) == 0 {
+		return nil
+	}
+	room := a.MaxNodesPerQueue - len(queueNodes)
+
+	var planned []*nodeCapacity
+	var launchCounts = make(map[string]int)
+	var launchOrder []string
+	for _, task := range unplaced {
+		nc := findNodeForTask(task, planned)
+		if nc == nil {
+			if len(planned) >= room {
+				continue
+			}
+			instanceType, ok := pickInstanceType(q, specs, task)
+			if !ok {
+				logrus.Warnf("No instance type of queue %s fits task %s", q.Key, task.Key)
+				continue
+			}
+			spec := specs[instanceType]
+			nc = &nodeCapacity{
+				node: &data.StoredNode{Info: makeSpecNodeInfo(spec)},
+				freeRAMMb: spec.RAMMb,
+				freeSlots: spec.CPUs,
+			}
+			planned = append(planned, nc)
+			if launchCounts[instanceType] == 0 {
+				launchOrder = append(launchOrder, instanceType)
+			}
+			launchCounts[instanceType]++
+		}
+		nc.freeRAMMb -= task.ExpectedRAMMb
+		nc.freeSlots--
+	}
+
+	for _, instanceType := range launchOrder {
+		launched, err := a.cloud.LaunchInstances(q.LaunchTemplateID, instanceType,
+			a.UserData, launchCounts[instanceType])
+		if err != nil {
+			// Try again on the next pass, the capacity might become available
+			logrus.Errorf("Failed to launch %d instances of %s for queue %s: %s",
+				launchCounts[instanceType], instanceType, q.Key, err.Error())
+			continue
+		}
+
+		for i, inst := range launched {
+			logrus.Infof("Registering the managed node %s (%s) for queue %s",
+				inst.CloudID, inst.InstanceType, q.Key)
+			err = a.nodeStore.StoreNode(&data.StoredNode{
+				Key: inst.CloudID,
+				Queue: q.Key,
+				CloudID: inst.CloudID,
+				InstanceType: inst.InstanceType,
+				Managed: true,
+				State: models.NodeStateEnumCreating,
+				CreatedOn: data.FromTime(now),
+				LastTransitionTime: data.FromTime(now),
+			})
+			if err != nil {
+				a.terminateUnregistered(launched[i:])
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Terminate the launched instances that couldn't be registered as nodes,
+// the reaper and the scale-down don't know about them.
+func (a *Autoscaler) terminateUnregistered(instances []LaunchedInstance) {
+	var cloudIds []string
+	for _, inst := range instances {
+		cloudIds = append(cloudIds, inst.CloudID)
+	}
+	logrus.Errorf("Failed to register the nodes %v, terminating them", cloudIds)
+
+	err := a.cloud.TerminateInstances(cloudIds)
+	if err != nil {
+		logrus.Errorf("Failed to terminate the unregistered instances %v, they "+
+			"must be terminated manually: %s", cloudIds, err.Error())
+	}
+}
+
+// Terminate the managed nodes that are no longer needed. The idle nodes
+// are first moved into the shutting-down state, so that the scheduler
+// doesn't place anything onto them, and are terminated on the next pass.
+func (a *Autoscaler) scaleDown(queueNodes []*data.StoredNode, busy map[string]bool,
+	now time.Time) error {
+
+	for _, n := range queueNodes {
+		switch {
+		case isNodePending(n):
+			if now.Sub(n.CreatedOn.ToTime()) >= a.BootTimeout {
+				logrus.Warnf("Managed node %s has failed to boot", n.Key)
+				err := a.terminateNode(n, now)
+				if err != nil {
+					return err
+				}
+			}
+		case n.State == models.NodeStateEnumShuttingDown:
+			if !busy[n.Key] {
+				err := a.terminateNode(n, now)
+				if err != nil {
+					return err
+				}
+			}
+		case n.State == models.NodeStateEnumActive:
+			if busy[n.Key] {
+				delete(a.idleSince, n.Key)
+				continue
+			}
+			since, ok := a.idleSince[n.Key]
+			if !ok {
+				a.idleSince[n.Key] = now
+				continue
+			}
+			if now.Sub(since) < a.IdleCooldown {
+				continue
+			}
+			logrus.Infof("Managed node %s has been idle since %s, shutting it down",
+				n.Key, since.String())
+			_, err := a.nodeStore.UpdateNode(n.Key, func(n *data.StoredNode) bool {
+				if n.State != models.NodeStateEnumActive {
+					return false
+				}
+				n.State = models.NodeStateEnumShuttingDown
+				n.LastTransitionTime = data.FromTime(now)
+				return true
+			})
+			if err != nil {
+				return err
+			}
+			delete(a.idleSince, n.Key)
+		}
+	}
+	return nil
+}
+
+// Terminate the node's instance and mark the node as dead, the node
+// reaper then revokes its tokens.
+func (a *Autoscaler) terminateNode(n *data.StoredNode, now time.Time) error {
+	err := a.cloud.TerminateInstances([]string{n.CloudID})
+	if err != nil {
+		// Try again on the next pass
+		logrus.Errorf("Failed to terminate node %s: %s", n.Key, err.Error())
+		return nil
+	}
+
+	logrus.Infof("Terminated the managed node %s", n.Key)
+	_, err = a.nodeStore.UpdateNode(n.Key, func(n *data.StoredNode) bool {
+		n.State = models.NodeStateEnumDead
+		n.LastTransitionTime = data.FromTime(now)
+		return true
+	})
+	return err
+}
@@ -0,0 +1,194 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/utils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func makeTestAutoscaler(store data.KVStore, ts *data.TaskStore, ns *data.NodeStore,
+	cloud CloudConnector) *Autoscaler {
+
+	qs := data.NewQueueStore(store)
+	qs.StoreQueue(&data.StoredQueue{
+		Key: "q1",
+		Queue: models.Queue{
+			Name:             "q1",
+			LaunchTemplateID: "lt-1234",
+			InstanceTypes:    []string{"c5.large", "m5.xlarge"},
+		},
+	})
+
+	return &Autoscaler{
+		cloud:            cloud,
+		queueStore:       qs,
+		nodeStore:        ns,
+		taskStore:        ts,
+		MaxNodesPerQueue: 3,
+		IdleCooldown:     10 * time.Minute,
+		BootTimeout:      15 * time.Minute,
+		UserData:         "#!/bin/sh\n",
+		idleSince:        make(map[string]time.Time),
+	}
+}
+
+func TestAutoscalerLaunch(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	cloud := NewFakeCloud()
+	scaler := makeTestAutoscaler(store, ts, ns, cloud)
+	now := time.Now()
+
+	// No demand, no nodes
+	assert.NoError(t, scaler.Autoscale(now))
+	assert.Equal(t, 0, len(cloud.Instances))
+
+	// 3 instances fit onto one c5.large (2 CPUs, 4Gb), one instance needs
+	// the larger m5.xlarge.
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 3, 1024, 1024)))
+	assert.NoError(t, ts.StoreTask(makeTestTask("2", "q1", 0, 1, 1024, 8192)))
+	sched := newTestScheduler(store, ts, ns)
+	assert.NoError(t, sched.Schedule())
+
+	assert.NoError(t, scaler.Autoscale(now))
+	nodes := ns.ListNodes(nil, nil)
+	assert.Equal(t, 3, len(nodes))
+	var types = make(map[string]int)
+	for _, n := range nodes {
+		assert.True(t, n.Managed)
+		assert.Equal(t, models.NodeStateEnumCreating, n.State)
+		assert.Equal(t, n.Key, n.CloudID)
+		assert.Equal(t, "q1", n.Queue)
+		types[n.InstanceType]++
+	}
+	assert.Equal(t, map[string]int{"c5.large": 2, "m5.xlarge": 1}, types)
+	assert.Equal(t, 3, len(cloud.Instances))
+	for _, n := range nodes {
+		assert.Equal(t, "#!/bin/sh\n", cloud.UserData[n.CloudID])
+	}
+
+	// The booting nodes are counted as the capacity
+	assert.NoError(t, scaler.Autoscale(now))
+	assert.Equal(t, 3, len(cloud.Instances))
+
+	// The number of nodes is capped
+	assert.NoError(t, ts.StoreTask(makeTestTask("3", "q1", 0, 10, 1024, 1024)))
+	assert.NoError(t, sched.Schedule())
+	assert.NoError(t, scaler.Autoscale(now))
+	assert.Equal(t, 3, len(cloud.Instances))
+}
+
+func TestAutoscalerRegistrationFailure(t *testing.T) {
+	_, faulty, store := makeFaultyStores()
+	ts := data.NewTaskStore(store)
+	ns := data.NewNodeStore(store)
+	cloud := NewFakeCloud()
+	scaler := makeTestAutoscaler(store, ts, ns, cloud)
+
+	// Two c5.large nodes are needed, the second one can't be registered
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 3, 1024, 1024)))
+	assert.NoError(t, newTestScheduler(store, ts, ns).Schedule())
+	faulty.AddRule(data.FaultRule{Ops: []data.StoreOp{data.OpStoreValue},
+		Table: data.NodeTable, Skip: 1, Times: 1})
+	assert.Error(t, scaler.Autoscale(time.Now()))
+
+	// The unregistered instance doesn't keep running
+	nodes := ns.ListNodes(nil, nil)
+	assert.Equal(t, 1, len(nodes))
+	assert.Equal(t, 1, len(cloud.Instances))
+	_, ok := cloud.Instances[nodes[0].CloudID]
+	assert.True(t, ok)
+}
+
+func TestAutoscalerBootTimeout(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	cloud := NewFakeCloud()
+	scaler := makeTestAutoscaler(store, ts, ns, cloud)
+	now := time.Now()
+
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 1, 1024, 1024)))
+	assert.NoError(t, newTestScheduler(store, ts, ns).Schedule())
+	assert.NoError(t, scaler.Autoscale(now))
+	assert.Equal(t, 1, len(cloud.Instances))
+
+	// The node never starts its runner, it's replaced
+	later := now.Add(scaler.BootTimeout)
+	assert.NoError(t, scaler.Autoscale(later))
+	var dead, creating int
+	for _, n := range ns.ListNodes(nil, nil) {
+		switch n.State {
+		case models.NodeStateEnumDead:
+			dead++
+		case models.NodeStateEnumCreating:
+			creating++
+		}
+	}
+	assert.Equal(t, 1, dead)
+	assert.Equal(t, 1, creating)
+	assert.Equal(t, 1, len(cloud.Instances))
+}
+
+func TestAutoscalerIdleNodes(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	cloud := NewFakeCloud()
+	scaler := makeTestAutoscaler(store, ts, ns, cloud)
+	now := time.Now()
+
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 1, 1024, 1024)))
+	sched := newTestScheduler(store, ts, ns)
+	assert.NoError(t, sched.Schedule())
+	assert.NoError(t, scaler.Autoscale(now))
+	nodes := ns.ListNodes(nil, nil)
+	assert.Equal(t, 1, len(nodes))
+	nodeId := nodes[0].Key
+
+	// The runner starts and gets the instance
+	_, err := ns.UpdateNode(nodeId, func(n *data.StoredNode) bool {
+		n.State = models.NodeStateEnumActive
+		n.Info = makeSpecNodeInfo(cloud.InstanceTypes[n.InstanceType])
+		return true
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, sched.Schedule())
+	assert.Equal(t, map[string]int{nodeId: 1}, countByNode(ts))
+
+	// The busy node is kept
+	assert.NoError(t, scaler.Autoscale(now.Add(time.Hour)))
+	assert.Equal(t, models.NodeStateEnumActive, ns.ListNodes([]string{nodeId}, nil)[0].State)
+
+	// The instance is done, the node is idle
+	inst, _ := ts.GetTaskInstance("1-0")
+	instCopy := *inst
+	instCopy.State = models.TaskStateEnumDone
+	assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{&instCopy}))
+
+	start := now.Add(2 * time.Hour)
+	assert.NoError(t, scaler.Autoscale(start))
+	assert.NoError(t, scaler.Autoscale(start.Add(scaler.IdleCooldown/2)))
+	assert.Equal(t, models.NodeStateEnumActive, ns.ListNodes([]string{nodeId}, nil)[0].State)
+
+	// After the cooldown the node is shut down and then terminated
+	assert.NoError(t, scaler.Autoscale(start.Add(scaler.IdleCooldown)))
+	assert.Equal(t, models.NodeStateEnumShuttingDown,
+		ns.ListNodes([]string{nodeId}, nil)[0].State)
+	assert.Equal(t, 1, len(cloud.Instances))
+
+	assert.NoError(t, scaler.Autoscale(start.Add(scaler.IdleCooldown+time.Minute)))
+	assert.Equal(t, models.NodeStateEnumDead, ns.ListNodes([]string{nodeId}, nil)[0].State)
+	assert.Equal(t, 0, len(cloud.Instances))
+}
+
+func TestManagedNodeUserData(t *testing.T) {
+	// "hello" is not a real certificate, but it's enough for the fingerprint
+	userData, err := MakeManagedNodeUserData("apollo.local:9443", "aGVsbG8=")
+	assert.NoError(t, err)
+	info := utils.ParseNodeUserData(userData)
+	assert.Equal(t, "apollo.local:9443", info.ServerUrl)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		info.CertFingerprint)
+
+	_, err = MakeManagedNodeUserData("apollo.local:9443", "???")
+	assert.Error(t, err)
+}
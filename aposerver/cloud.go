@@ -0,0 +1,141 @@
+package aposerver
+
+import (
+	"apollo/utils"
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/sirupsen/logrus"
+)
+
+// The resources of a cloud instance type
+type InstanceTypeSpec struct {
+	RAMMb int64
+	CPUs int64
+}
+
+// The cloud instance launched by the autoscaler
+type LaunchedInstance struct {
+	CloudID string
+	InstanceType string
+}
+
+// The cloud operations used by the autoscaler
+type CloudConnector interface {
+	// Launch up to count instances of the given type using the launch
+	// template, the user data replaces the template's user data.
+	LaunchInstances(launchTemplateId string, instanceType string, userData string,
+		count int) ([]LaunchedInstance, error)
+	TerminateInstances(cloudIds []string) error
+	// Get the resources of the instance types, the types that the cloud
+	// doesn't have are absent from the result.
+	DescribeInstanceTypes(instanceTypes []string) (map[string]InstanceTypeSpec, error)
+}
+
+type Ec2Connector struct {
+	svc *ec2.EC2
+}
+
+func NewEc2Connector(config aws.Config) *Ec2Connector {
+	return &Ec2Connector{svc: ec2.New(config)}
+}
+
+func (c *Ec2Connector) LaunchInstances(launchTemplateId string, instanceType string,
+	userData string, count int) ([]LaunchedInstance, error) {
+
+	// The minimum count of 1 allows EC2 to launch fewer instances than
+	// requested if there's not enough capacity.
+	resp, err := c.svc.RunInstancesRequest(&ec2.RunInstancesInput{
+		LaunchTemplate: &ec2.LaunchTemplateSpecification{
+			LaunchTemplateId: aws.String(launchTemplateId),
+		},
+		InstanceType: ec2.InstanceType(instanceType),
+		UserData: aws.String(base64.StdEncoding.EncodeToString([]byte(userData))),
+		MinCount: aws.Int64(1),
+		MaxCount: aws.Int64(int64(count)),
+	}).Send()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []LaunchedInstance
+	for _, inst := range resp.Instances {
+		if inst.InstanceId == nil {
+			continue
+		}
+		res = append(res, LaunchedInstance{
+			CloudID: *inst.InstanceId,
+			InstanceType: instanceType,
+		})
+	}
+	logrus.Infof("Launched %d instances of %s from %s", len(res), instanceType,
+		launchTemplateId)
+	return res, nil
+}
+
+func (c *Ec2Connector) TerminateInstances(cloudIds []string) error {
+	if len(cloudIds) == 0 {
+		return nil
+	}
+	_, err := c.svc.TerminateInstancesRequest(&ec2.TerminateInstancesInput{
+		InstanceIds: cloudIds,
+	}).Send()
+	if err != nil {
+		return fmt.Errorf("failed to terminate instances %v: %s", cloudIds, err.Error())
+	}
+	return nil
+}
+
+func (c *Ec2Connector) DescribeInstanceTypes(instanceTypes []string) (
+	map[string]InstanceTypeSpec, error) {
+
+	var res = make(map[string]InstanceTypeSpec)
+	if len(instanceTypes) == 0 {
+		return res, nil
+	}
+
+	// The unknown types are filtered out, listing them explicitly
+	// would fail the whole request
+	input := &ec2.DescribeInstanceTypesInput{
+		Filters: []ec2.Filter{{
+			Name: aws.String("instance-type"),
+			Values: instanceTypes,
+		}},
+	}
+	for {
+		resp, err := c.svc.DescribeInstanceTypesRequest(input).Send()
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe instance types %v: %s",
+				instanceTypes, err.Error())
+		}
+		for _, info := range resp.InstanceTypes {
+			if info.MemoryInfo == nil || info.MemoryInfo.SizeInMiB == nil ||
+				info.VCpuInfo == nil || info.VCpuInfo.DefaultVCpus == nil {
+				continue
+			}
+			res[string(info.InstanceType)] = InstanceTypeSpec{
+				RAMMb: *info.MemoryInfo.SizeInMiB,
+				CPUs: *info.VCpuInfo.DefaultVCpus,
+			}
+		}
+		if resp.NextToken == nil || *resp.NextToken == "" {
+			return res, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// Make the user data of the managed nodes, it tells the runners where
+// the server is and how to verify its certificate.
+func MakeManagedNodeUserData(serverUrl string, serverCert string) (string, error) {
+	fingerprint, err := utils.CertFingerprint(serverCert)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute the certificate fingerprint: %s",
+			err.Error())
+	}
+	return utils.MakeNodeUserData(utils.NodeUserData{
+		ServerUrl: serverUrl,
+		CertFingerprint: fingerprint,
+	}), nil
+}
@@ -0,0 +1,138 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"fmt"
+)
+
+// Check the dependencies of the newly submitted task: all the referenced tasks
+// must exist, the subtask dependencies must cover the task's index range, and
+// the dependency graph must stay acyclic.
+func validateDependencies(store *data.TaskStore, taskKey string, task *models.TaskStruct) error {
+	for _, dep := range task.TaskDependencies {
+		if _, ok := store.GetTask(dep); !ok {
+			return fmt.Errorf("unknown task dependency: %s", dep)
+		}
+	}
+
+	for _, dep := range task.SubtaskDependencies {
+		depTask, ok := store.GetTask(dep)
+		if !ok {
+			return fmt.Errorf("unknown subtask dependency: %s", dep)
+		}
+		if depTask.StartArrayIndex > task.StartArrayIndex ||
+			depTask.EndArrayIndex < task.EndArrayIndex {
+			return fmt.Errorf("subtask dependency %s doesn't cover the index range", dep)
+		}
+	}
+
+	// Walk the graph of dependencies and check that it doesn't lead
+	// back to the task being submitted.
+	var visited = make(map[string]bool)
+	var walk func(deps []string) error
+	walk = func(deps []string) error {
+		for _, dep := range deps {
+			if dep == taskKey {
+				return fmt.Errorf("task dependency cycle through %s", taskKey)
+			}
+			if visited[dep] {
+				continue
+			}
+			visited[dep] = true
+
+			depTask, ok := store.GetTask(dep)
+			if !ok {
+				continue
+			}
+			err := walk(allDependencies(&depTask.TaskStruct))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(allDependencies(task))
+}
+
+func allDependencies(task *models.TaskStruct) []string {
+	var res = make([]string, 0, len(task.TaskDependencies)+len(task.SubtaskDependencies))
+	res = append(res, task.TaskDependencies...)
+	return append(res, task.SubtaskDependencies...)
+}
+
+// The completion state of a task array
+type taskCompletion struct {
+	done int64
+	failed bool
+}
+
+// Checks if the dependencies of the task instances are satisfied, it
+// captures the state of the instances at the moment of its creation.
+type dependencyResolver struct {
+	store *data.TaskStore
+	completion map[string]*taskCompletion
+}
+
+func newDependencyResolver(store *data.TaskStore) *dependencyResolver {
+	var completion = make(map[string]*taskCompletion)
+	for _, inst := range store.ListTaskInstances(nil) {
+		c, ok := completion[inst.InstanceKey.ParentKey]
+		if !ok {
+			c = &taskCompletion{}
+			completion[inst.InstanceKey.ParentKey] = c
+		}
+		if inst.State == models.TaskStateEnumDone {
+			c.done++
+		}
+		if inst.State == models.TaskStateEnumFailed ||
+			inst.State == models.TaskStateEnumCancelled {
+			c.failed = true
+		}
+	}
+
+	return &dependencyResolver{
+		store: store,
+		completion: completion,
+	}
+}
+
+// Check the instance's dependencies. Returns (ready, failed) where
+// "failed" means that one of the dependencies has failed and the instance
+// can never be run.
+func (r *dependencyResolver) check(inst *data.TaskInstance, task *data.StoredTask) (bool, bool) {
+	var ready = true
+
+	for _, dep := range task.TaskDependencies {
+		depTask, ok := r.store.GetTask(dep)
+		c, hasInstances := r.completion[dep]
+		if !ok || !hasInstances {
+			ready = false
+			continue
+		}
+		if c.failed {
+			return false, true
+		}
+		if c.done < depTask.EndArrayIndex-depTask.StartArrayIndex {
+			ready = false
+		}
+	}
+
+	for _, dep := range task.SubtaskDependencies {
+		depInst, ok := r.store.GetTaskInstance(data.TaskInstanceKey{
+			ParentKey: dep, Index: inst.InstanceKey.Index}.String())
+		if !ok {
+			ready = false
+			continue
+		}
+		if depInst.State == models.TaskStateEnumFailed ||
+			depInst.State == models.TaskStateEnumCancelled {
+			return false, true
+		}
+		if depInst.State != models.TaskStateEnumDone {
+			ready = false
+		}
+	}
+
+	return ready, false
+}
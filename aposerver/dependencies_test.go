@@ -0,0 +1,82 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDependencyValidation(t *testing.T) {
+	_, ts, _ := makeTestStores()
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 10, 100, 100)))
+
+	task := makeTestTask("", "q1", 0, 10, 100, 100).TaskStruct
+	task.TaskDependencies = []string{"1"}
+	task.SubtaskDependencies = []string{"1"}
+	assert.NoError(t, validateDependencies(ts, "2", &task))
+
+	task.TaskDependencies = []string{"1", "5"}
+	assert.Error(t, validateDependencies(ts, "2", &task))
+	task.TaskDependencies = nil
+
+	// Subtask dependencies must cover the whole index range
+	task.EndArrayIndex = 11
+	assert.Error(t, validateDependencies(ts, "2", &task))
+	task.EndArrayIndex = 10
+
+	// Create a task that (incorrectly) references a not yet existing task
+	cyclic := makeTestTask("3", "q1", 0, 10, 100, 100)
+	cyclic.TaskDependencies = []string{"4"}
+	assert.NoError(t, ts.StoreTask(cyclic))
+
+	task.SubtaskDependencies = nil
+	task.TaskDependencies = []string{"3"}
+	assert.Error(t, validateDependencies(ts, "4", &task))
+}
+
+func TestDependencyScheduling(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 100000, 100)))
+
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 2, 100, 100)))
+	afterAll := makeTestTask("2", "q1", 0, 2, 100, 100)
+	afterAll.TaskDependencies = []string{"1"}
+	assert.NoError(t, ts.StoreTask(afterAll))
+	afterSubtask := makeTestTask("3", "q1", 0, 2, 100, 100)
+	afterSubtask.SubtaskDependencies = []string{"1"}
+	assert.NoError(t, ts.StoreTask(afterSubtask))
+
+	sched := newTestScheduler(store, ts, ns)
+	assert.NoError(t, sched.Schedule())
+	counts := countByNode(ts)
+	assert.Equal(t, 2, counts["n1"])
+
+	// Finish the first instance of the first task
+	inst, _ := ts.GetTaskInstance("1-0")
+	instCopy := *inst
+	instCopy.State = models.TaskStateEnumDone
+	assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{&instCopy}))
+
+	// Only the matching subtask can now run
+	assert.NoError(t, sched.Schedule())
+	inst, _ = ts.GetTaskInstance("3-0")
+	assert.Equal(t, models.TaskStateEnumScheduled, inst.State)
+	inst, _ = ts.GetTaskInstance("3-1")
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+	inst, _ = ts.GetTaskInstance("2-0")
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+
+	// Fail the second instance, the dependent instances are failed too
+	inst, _ = ts.GetTaskInstance("1-1")
+	instCopy = *inst
+	instCopy.State = models.TaskStateEnumFailed
+	assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{&instCopy}))
+
+	assert.NoError(t, sched.Schedule())
+	for _, key := range []string{"2-0", "2-1", "3-1"} {
+		inst, _ = ts.GetTaskInstance(key)
+		assert.Equal(t, models.TaskStateEnumFailed, inst.State)
+		assert.Equal(t, models.FailureReasonEnumDependencyFailed, inst.FailureReason)
+	}
+}
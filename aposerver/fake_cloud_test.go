@@ -0,0 +1,95 @@
+package aposerver
+
+import (
+	"fmt"
+	"sync"
+)
+
+// The in-memory cloud for tests
+type FakeCloud struct {
+	mutex sync.Mutex
+	counter int
+
+	// The running instances by their IDs
+	Instances map[string]LaunchedInstance
+	// The user data of the instances
+	UserData map[string]string
+	// The maximum number of instances launched by one call, 0 is unlimited
+	MaxLaunchCount int
+	// Fail all the launches with this error
+	LaunchError error
+	// The instance types that the cloud has
+	InstanceTypes map[string]InstanceTypeSpec
+	// The number of DescribeInstanceTypes calls
+	DescribeCount int
+}
+
+func NewFakeCloud() *FakeCloud {
+	return &FakeCloud{
+		Instances: make(map[string]LaunchedInstance),
+		UserData: make(map[string]string),
+		InstanceTypes: map[string]InstanceTypeSpec{
+			"t3.medium": {RAMMb: 4 * 1024, CPUs: 2},
+			"c5.large":  {RAMMb: 4 * 1024, CPUs: 2},
+			"c5.xlarge": {RAMMb: 8 * 1024, CPUs: 4},
+			"m5.large":  {RAMMb: 8 * 1024, CPUs: 2},
+			"m5.xlarge": {RAMMb: 16 * 1024, CPUs: 4},
+		},
+	}
+}
+
+func (f *FakeCloud) LaunchInstances(launchTemplateId string, instanceType string,
+	userData string, count int) ([]LaunchedInstance, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.LaunchError != nil {
+		return nil, f.LaunchError
+	}
+	if f.MaxLaunchCount != 0 && count > f.MaxLaunchCount {
+		count = f.MaxLaunchCount
+	}
+
+	var res []LaunchedInstance
+	for i := 0; i < count; i++ {
+		f.counter++
+		inst := LaunchedInstance{
+			CloudID: fmt.Sprintf("i-%08d", f.counter),
+			InstanceType: instanceType,
+		}
+		f.Instances[inst.CloudID] = inst
+		f.UserData[inst.CloudID] = userData
+		res = append(res, inst)
+	}
+	return res, nil
+}
+
+func (f *FakeCloud) TerminateInstances(cloudIds []string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, id := range cloudIds {
+		if _, ok := f.Instances[id]; !ok {
+			return fmt.Errorf("instance %s is not found", id)
+		}
+		delete(f.Instances, id)
+	}
+	return nil
+}
+
+func (f *FakeCloud) DescribeInstanceTypes(instanceTypes []string) (
+	map[string]InstanceTypeSpec, error) {
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.DescribeCount++
+	var res = make(map[string]InstanceTypeSpec)
+	for _, t := range instanceTypes {
+		if spec, ok := f.InstanceTypes[t]; ok {
+			res[t] = spec
+		}
+	}
+	return res, nil
+}
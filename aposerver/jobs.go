@@ -0,0 +1,126 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// Make the job for the first task that joins it, the failure limit of the
+// job is set by this task
+func newJobInfo(job *models.Job, now time.Time) *data.JobInfo {
+	return &data.JobInfo{
+		Key:            job.JobName,
+		JobName:        job.JobName,
+		MaxFailedCount: int(job.MaxFailedCount),
+		State:          models.JobStateEnumActive,
+		CreatedOn:      data.FromTime(now),
+	}
+}
+
+// Create the jobs that are lost when the task submission has failed to store
+// them, the jobs must be locked by the caller
+func (s *Scheduler) createMissingJobs(now time.Time) error {
+	tasks := s.taskStore.ListTasks(nil, func(task *data.StoredTask) bool {
+		return task.Job != nil
+	})
+	for _, t := range tasks {
+		if _, ok := s.jobStore.GetJob(t.Job.JobName); ok {
+			continue
+		}
+		logrus.Warnf("Creating the missing job %s of the task %s", t.Job.JobName, t.Key)
+		err := s.jobStore.StoreJob(newJobInfo(t.Job, now))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Is the instance a real failure, counted towards the job's failure limit.
+// The instances failed due to their dependencies are not counted, otherwise
+// a single failure would cascade into all the dependent tasks.
+func isCountedFailure(inst *data.TaskInstance) bool {
+	return inst.State == models.TaskStateEnumFailed &&
+		inst.FailureReason != models.FailureReasonEnumDependencyFailed
+}
+
+// Is the instance still going to run or is running
+func isInstanceLive(inst *data.TaskInstance) bool {
+	return inst.State == models.TaskStateEnumWaiting ||
+		inst.State == models.TaskStateEnumScheduled ||
+		inst.State == models.TaskStateEnumRunning
+}
+
+// Count the failed instances of each job, and fail the jobs that have
+// exceeded their limit of failed instances. The live instances of the
+// failed jobs are cancelled, the runners will kill the running ones during
+// their next synchronization.
+func (s *Scheduler) enforceJobLimits(now time.Time) error {
+	s.jobStore.LockJobs()
+	defer s.jobStore.UnlockJobs()
+
+	err := s.createMissingJobs(now)
+	if err != nil {
+		return err
+	}
+
+	jobs := s.jobStore.ListJobs()
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	var failedCounts = make(map[string]int)
+	var liveByJob = make(map[string][]*data.TaskInstance)
+	for _, inst := range s.taskStore.ListTaskInstances(nil) {
+		task, ok := s.taskStore.GetTask(inst.InstanceKey.ParentKey)
+		if !ok || task.Job == nil {
+			continue
+		}
+		if isCountedFailure(inst) {
+			failedCounts[task.Job.JobName]++
+		}
+		if isInstanceLive(inst) {
+			liveByJob[task.Job.JobName] = append(liveByJob[task.Job.JobName], inst)
+		}
+	}
+
+	var cancelled []*data.TaskInstance
+	for _, job := range jobs {
+		count := failedCounts[job.Key]
+		exceeded := job.MaxFailedCount >= 0 && count > job.MaxFailedCount
+
+		if count != job.FailedCount || (exceeded && job.State != models.JobStateEnumFailed) {
+			jobCopy := *job
+			jobCopy.FailedCount = count
+			if exceeded && job.State != models.JobStateEnumFailed {
+				logrus.Warnf("Job %s has %d failed instances, failing it", job.Key, count)
+				jobCopy.State = models.JobStateEnumFailed
+				jobCopy.FailedOn = data.FromTime(now)
+			}
+			err := s.jobStore.StoreJob(&jobCopy)
+			if err != nil {
+				return err
+			}
+			job = &jobCopy
+		}
+
+		if job.State != models.JobStateEnumFailed {
+			continue
+		}
+		for _, inst := range liveByJob[job.Key] {
+			instCopy := *inst
+			instCopy.State = models.TaskStateEnumCancelled
+			instCopy.FailureReason = models.FailureReasonEnumJobFailed
+			instCopy.FinishedOn = data.FromTime(now)
+			cancelled = append(cancelled, &instCopy)
+		}
+	}
+
+	if len(cancelled) == 0 {
+		return nil
+	}
+	logrus.Infof("Cancelling %d task instances of the failed jobs", len(cancelled))
+	return s.taskStore.StoreTaskInstances(cancelled)
+}
@@ -0,0 +1,94 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/task"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestJobFailureLimit(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	js := data.NewJobStore(store)
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 100000, 2)))
+	assert.NoError(t, js.StoreJob(&data.JobInfo{
+		Key:            "job1",
+		JobName:        "job1",
+		MaxFailedCount: 1,
+		State:          models.JobStateEnumActive,
+	}))
+
+	task := makeTestTask("1", "q1", 0, 4, 100, 100)
+	task.Job = &models.Job{JobName: "job1", MaxFailedCount: 1}
+	assert.NoError(t, ts.StoreTask(task))
+
+	sched := NewScheduler(ts, ns, js)
+	assert.NoError(t, sched.Schedule())
+
+	fail := func(key string) {
+		inst, _ := ts.GetTaskInstance(key)
+		instCopy := *inst
+		instCopy.State = models.TaskStateEnumFailed
+		instCopy.FailureReason = models.FailureReasonEnumExitCode
+		assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{&instCopy}))
+	}
+
+	// One failure is within the limit
+	fail("1-0")
+	assert.NoError(t, sched.Schedule())
+	job, _ := js.GetJob("job1")
+	assert.Equal(t, models.JobStateEnumActive, job.State)
+	assert.Equal(t, 1, job.FailedCount)
+
+	// The second one fails the job and cancels the rest of its instances
+	fail("1-1")
+	assert.NoError(t, sched.enforceJobLimits(time.Now()))
+	job, _ = js.GetJob("job1")
+	assert.Equal(t, models.JobStateEnumFailed, job.State)
+	assert.Equal(t, 2, job.FailedCount)
+
+	for _, key := range []string{"1-2", "1-3"} {
+		inst, _ := ts.GetTaskInstance(key)
+		assert.Equal(t, models.TaskStateEnumCancelled, inst.State)
+		assert.Equal(t, models.FailureReasonEnumJobFailed, inst.FailureReason)
+	}
+}
+
+func TestJobSubmissionWithFaults(t *testing.T) {
+	mem, faulty, store := makeFaultyStores()
+	ts := data.NewTaskStore(store)
+	qs := data.NewQueueStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}}))
+	taskStruct := makeTestTask("", "q1", 0, 2, 1024, 1024).TaskStruct
+	taskStruct.Job = &models.Job{JobName: "job1", MaxFailedCount: 3}
+	user := data.AuthToken{Type: data.UserToken, EntityKey: "user"}
+
+	loadJobs := func() *data.JobStore {
+		js := data.NewJobStore(mem)
+		assert.NoError(t, js.Hydrate())
+		return js
+	}
+
+	// The task can't be stored, the job must not be created
+	faulty.AddRule(data.FaultRule{Table: data.TaskTable, Times: 1})
+	_, ok := submitTask(store, ts, qs, user, taskStruct).(*task.PutTaskDefault)
+	assert.True(t, ok)
+	assert.Equal(t, 0, len(loadJobs().ListJobs()))
+
+	// The job can't be stored, but the task is submitted anyway
+	faulty.AddRule(data.FaultRule{Table: data.JobTable, Times: 1})
+	_, ok = submitTask(store, ts, qs, user, taskStruct).(*task.PutTaskOK)
+	assert.True(t, ok)
+	assert.Equal(t, 0, len(loadJobs().ListJobs()))
+
+	// The scheduler creates the missing job
+	js := data.NewJobStore(store)
+	sched := NewScheduler(ts, data.NewNodeStore(store), js)
+	assert.NoError(t, sched.Schedule())
+	job, ok := loadJobs().GetJob("job1")
+	assert.True(t, ok)
+	assert.Equal(t, 3, job.MaxFailedCount)
+	assert.Equal(t, models.JobStateEnumActive, job.State)
+}
@@ -0,0 +1,135 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/node"
+	"apollo/proto/gen/restapi/operations/task"
+	"apollo/utils"
+	"context"
+	"fmt"
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Accept the task logs uploaded by a runner
+type NodeLogsProcessor struct {
+	ctx context.Context
+	store *data.TaskStore
+	nodeStore *data.NodeStore
+	logStore *TaskLogStore
+	principal data.AuthToken
+	params node.PostNodeLogsParams
+}
+
+func (l *NodeLogsProcessor) respondWithError(code int64, err error) middleware.Responder {
+	logrus.Warnf("Failed to accept node logs: %+v", err.Error())
+	return node.NewPostNodeLogsDefault(int(code)).
+		WithPayload(&models.Error{
+			Code: code, Message: err.Error(),
+			RequestID: utils.GetReqIdFromContext(l.ctx)})
+}
+
+func (l *NodeLogsProcessor) Enact() middleware.Responder {
+	nodeId := l.params.NodeID
+	nodes := l.nodeStore.ListNodes([]string{nodeId}, nil)
+	if len(nodes) == 0 {
+		return l.respondWithError(http.StatusNotFound,
+			fmt.Errorf("node %s is not found", nodeId))
+	}
+	if !nodeMatchesPrincipal(nodes[0], l.principal) {
+		return l.respondWithError(http.StatusForbidden,
+			fmt.Errorf("the token doesn't belong to node %s", nodeId))
+	}
+
+	for _, chunk := range l.params.Logs {
+		if chunk == nil {
+			continue
+		}
+		inst, ok := l.store.GetTaskInstance(chunk.InstanceID)
+		if !ok {
+			utils.CL(l.ctx).Warnf("Dropping the log of an unknown instance %s",
+				chunk.InstanceID)
+			continue
+		}
+		// The instance might have been requeued by now (e.g. if the node
+		// was lost), its previous node can still upload the rest of the log.
+		if inst.AssignedNode != nodeId && inst.PreviousNode != nodeId {
+			utils.CL(l.ctx).Warnf("Dropping the log of instance %s, it's not on node %s",
+				chunk.InstanceID, nodeId)
+			continue
+		}
+		err := l.logStore.Append(chunk.InstanceID, []byte(chunk.Data))
+		if err != nil {
+			return l.respondWithError(http.StatusInternalServerError, err)
+		}
+	}
+
+	return node.NewPostNodeLogsOK()
+}
+
+// Read the log of a task instance
+type TaskLogsProcessor struct {
+	ctx context.Context
+	store *data.TaskStore
+	logStore *TaskLogStore
+	principal data.AuthToken
+	params task.GetTaskLogsParams
+}
+
+func (l *TaskLogsProcessor) respondWithError(code int64, err error) middleware.Responder {
+	logrus.Warnf("Failed to read task logs: %+v", err.Error())
+	return task.NewGetTaskLogsDefault(int(code)).
+		WithPayload(&models.Error{
+			Code: code, Message: err.Error(),
+			RequestID: utils.GetReqIdFromContext(l.ctx)})
+}
+
+func isInstanceFinished(inst *data.TaskInstance) bool {
+	return inst.State == models.TaskStateEnumDone ||
+		inst.State == models.TaskStateEnumFailed ||
+		inst.State == models.TaskStateEnumCancelled
+}
+
+func (l *TaskLogsProcessor) Enact() middleware.Responder {
+	scope, err := getTaskScope(l.store, l.principal)
+	if err != nil {
+		return l.respondWithError(http.StatusForbidden, err)
+	}
+	t, ok := l.store.GetTask(l.params.TaskID)
+	if !ok || !scope.canView(t) {
+		return l.respondWithError(http.StatusNotFound,
+			fmt.Errorf("task %s is not found", l.params.TaskID))
+	}
+
+	index := t.StartArrayIndex
+	if l.params.Index != nil {
+		index = *l.params.Index
+	}
+	if index < t.StartArrayIndex || index >= t.EndArrayIndex {
+		return l.respondWithError(http.StatusNotFound,
+			fmt.Errorf("index %d is out of the task's range", index))
+	}
+	var offset int64
+	if l.params.Offset != nil {
+		offset = *l.params.Offset
+	}
+
+	key := data.TaskInstanceKey{ParentKey: t.Key, Index: int(index)}.String()
+	logData, nextOffset, err := l.logStore.Read(key, offset)
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err)
+	}
+
+	// The log is complete once the instance has finished and everything
+	// has been read.
+	inst, ok := l.store.GetTaskInstance(key)
+	finished := ok && isInstanceFinished(inst) && len(logData) < MaxLogReadSize
+
+	return task.NewGetTaskLogsOK().WithPayload(&task.GetTaskLogsOKBody{
+		Data:       logData,
+		NextOffset: nextOffset,
+		Finished:   finished,
+	})
+}
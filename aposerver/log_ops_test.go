@@ -0,0 +1,79 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/node"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func postLogs(ts *data.TaskStore, ns *data.NodeStore, logs *TaskLogStore,
+	nodeId string, chunks []*models.InstanceLogChunk) interface{} {
+
+	req := httptest.NewRequest("POST", "/node/logs", nil)
+	lp := NodeLogsProcessor{
+		ctx:       req.Context(),
+		store:     ts,
+		nodeStore: ns,
+		logStore:  logs,
+		principal: data.AuthToken{Type: data.NodeToken, EntityKey: nodeId},
+		params: node.PostNodeLogsParams{HTTPRequest: req, NodeID: nodeId,
+			Logs: chunks},
+	}
+	return lp.Enact()
+}
+
+func TestNodeLogsOwnership(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apollo-logs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logs := &TaskLogStore{dir: dir, maxSize: 1000}
+
+	_, ts, ns := makeTestStores()
+	for _, n := range []string{"n1", "n2", "n3"} {
+		assert.NoError(t, ns.StoreNode(makeTestNode(n, "q1", 4096, 8)))
+	}
+	key := data.TaskInstanceKey{ParentKey: "1", Index: 0}
+	assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{{Key: key.String(),
+		InstanceKey: key, State: models.TaskStateEnumRunning, AssignedNode: "n1"}}))
+
+	post := func(nodeId string, text string) {
+		_, ok := postLogs(ts, ns, logs, nodeId, []*models.InstanceLogChunk{
+			{InstanceID: "1-0", Data: []byte(text)}}).(*node.PostNodeLogsOK)
+		assert.True(t, ok)
+	}
+	readLog := func() string {
+		res, _, err := logs.Read("1-0", 0)
+		assert.NoError(t, err)
+		return string(res)
+	}
+
+	// Only the node of the instance can upload its log
+	post("n1", "one ")
+	post("n2", "bad ")
+	assert.Equal(t, "one ", readLog())
+
+	// The instance is moved to n2, n1 can still finish its upload
+	inst, _ := ts.GetTaskInstance("1-0")
+	moved := *inst
+	requeueInstance(&moved, time.Now())
+	moved.AssignedNode = "n2"
+	assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{&moved}))
+	post("n1", "two ")
+	post("n2", "three ")
+
+	// But not after the second reassignment
+	inst, _ = ts.GetTaskInstance("1-0")
+	moved = *inst
+	requeueInstance(&moved, time.Now())
+	moved.AssignedNode = "n3"
+	assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{&moved}))
+	post("n1", "bad ")
+	post("n2", "four")
+	assert.Equal(t, "one two three four", readLog())
+}
@@ -0,0 +1,100 @@
+package aposerver
+
+import (
+	"github.com/spf13/viper"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+const DefaultLogDir = "/var/lib/apollo/logs"
+const DefaultMaxLogSizeMb = 64
+// The maximum amount of the log returned by one read
+const MaxLogReadSize = 256 * 1024
+
+var logTruncatedMarker = []byte("\n[apollo: the log is too large, the rest is dropped]\n")
+
+// The task instance logs uploaded by the runners. Each instance has its own
+// append-only file, the output in excess of the size limit is dropped (the
+// runners keep the rotated logs locally).
+type TaskLogStore struct {
+	dir string
+	maxSize int64
+
+	mutex sync.Mutex
+}
+
+func NewTaskLogStore(v *viper.Viper) *TaskLogStore {
+	store := &TaskLogStore{
+		dir: DefaultLogDir,
+		maxSize: DefaultMaxLogSizeMb * 1024 * 1024,
+	}
+	if v.IsSet("logs.dir") {
+		store.dir = v.GetString("logs.dir")
+	}
+	if v.IsSet("logs.max-size-mb") {
+		store.maxSize = v.GetInt64("logs.max-size-mb") * 1024 * 1024
+	}
+	return store
+}
+
+func (s *TaskLogStore) fileName(instanceKey string) string {
+	return path.Join(s.dir, instanceKey+".log")
+}
+
+// Append the output to the instance's log
+func (s *TaskLogStore) Append(instanceKey string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := os.MkdirAll(s.dir, 0750)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.fileName(instanceKey),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if size >= s.maxSize {
+		return nil
+	}
+
+	if size+int64(len(data)) > s.maxSize {
+		data = append(data[:s.maxSize-size:s.maxSize-size], logTruncatedMarker...)
+	}
+	_, err = file.Write(data)
+	return err
+}
+
+// Read the instance's log starting from the offset, returns the data
+// and the offset for the next read.
+func (s *TaskLogStore) Read(instanceKey string, offset int64) ([]byte, int64, error) {
+	file, err := os.Open(s.fileName(instanceKey))
+	if os.IsNotExist(err) {
+		return nil, offset, nil
+	}
+	if err != nil {
+		return nil, offset, err
+	}
+	defer file.Close()
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, offset, err
+	}
+	var buf = make([]byte, MaxLogReadSize)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, offset, err
+	}
+	return buf[:n], offset + int64(n), nil
+}
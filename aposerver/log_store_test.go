@@ -0,0 +1,39 @@
+package aposerver
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTaskLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apollo-logs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &TaskLogStore{dir: dir, maxSize: 10}
+
+	// Nothing is there yet
+	data, next, err := store.Read("1-0", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(data))
+	assert.Equal(t, int64(0), next)
+
+	assert.NoError(t, store.Append("1-0", []byte("hello ")))
+	assert.NoError(t, store.Append("1-0", []byte("world")))
+	data, next, err = store.Read("1-0", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello worl"+string(logTruncatedMarker), string(data))
+
+	// The output over the limit is dropped
+	assert.NoError(t, store.Append("1-0", []byte("more")))
+	data, next2, err := store.Read("1-0", next)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(data))
+	assert.Equal(t, next, next2)
+
+	data, _, err = store.Read("1-0", 6)
+	assert.NoError(t, err)
+	assert.Equal(t, "worl", string(data[:4]))
+}
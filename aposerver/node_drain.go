@@ -0,0 +1,151 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/node"
+	"apollo/utils"
+	"context"
+	"fmt"
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Start draining a node: the scheduler only uses the active nodes, so no new
+// instances are placed on it. The reaper shuts the node down once its
+// instances are finished.
+type DrainNodeProcessor struct {
+	ctx context.Context
+	store *data.NodeStore
+	principal data.AuthToken
+	params node.PostNodeDrainParams
+}
+
+func (l *DrainNodeProcessor) respondWithError(code int64, err error) middleware.Responder {
+	logrus.Warnf("Failed to drain the node: %+v", err.Error())
+	return node.NewPostNodeDrainDefault(int(code)).
+		WithPayload(&models.Error{
+			Code: code, Message: err.Error(),
+			RequestID: utils.GetReqIdFromContext(l.ctx)})
+}
+
+func (l *DrainNodeProcessor) Enact() middleware.Responder {
+	if l.principal.Type != data.UserToken {
+		return l.respondWithError(http.StatusForbidden,
+			fmt.Errorf("only users can drain nodes"))
+	}
+
+	now := time.Now()
+	var deadline data.AbsoluteTime
+	if l.params.DeadlineSeconds != nil {
+		deadline = data.FromTime(now.Add(
+			time.Duration(*l.params.DeadlineSeconds) * time.Second))
+	}
+
+	var stateErr error
+	updated, err := l.store.UpdateNode(l.params.NodeID, func(n *data.StoredNode) bool {
+		if n.State == models.NodeStateEnumDead ||
+			n.State == models.NodeStateEnumShuttingDown {
+			stateErr = fmt.Errorf("node %s is already %s", n.Key, n.State)
+			return false
+		}
+		if n.State != models.NodeStateEnumDraining {
+			n.State = models.NodeStateEnumDraining
+			n.LastTransitionTime = data.FromTime(now)
+		}
+		n.DrainDeadline = deadline
+		return true
+	})
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err)
+	}
+	if updated == nil {
+		return l.respondWithError(http.StatusNotFound,
+			fmt.Errorf("node %s is not found", l.params.NodeID))
+	}
+	if stateErr != nil {
+		return l.respondWithError(http.StatusConflict, stateErr)
+	}
+
+	utils.CL(l.ctx).Infof("%s has started draining node %s",
+		l.principal.RenderEntity(), l.params.NodeID)
+	return node.NewPostNodeDrainOK()
+}
+
+// Requeue the instances of the draining nodes that have missed their
+// deadline and shut down the nodes that have no more instances.
+func (m *NodeReaper) progressDrains(now time.Time) error {
+	draining := m.nodeStore.ListNodes(nil, func(n *data.StoredNode) bool {
+		return n.State == models.NodeStateEnumDraining
+	})
+	if len(draining) == 0 {
+		return nil
+	}
+
+	var expired = make(map[string]bool)
+	var drainingKeys = make(map[string]bool)
+	for _, n := range draining {
+		drainingKeys[n.Key] = true
+		if n.DrainDeadline != 0 && n.DrainDeadline <= data.FromTime(now) {
+			expired[n.Key] = true
+		}
+	}
+
+	busy, err := m.requeueDrained(drainingKeys, expired, now)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range draining {
+		if busy[n.Key] {
+			continue
+		}
+		_, err := m.nodeStore.UpdateNode(n.Key, func(n *data.StoredNode) bool {
+			if n.State != models.NodeStateEnumDraining {
+				return false
+			}
+			logrus.Infof("Node %s is drained, shutting it down", n.Key)
+			n.State = models.NodeStateEnumShuttingDown
+			n.LastTransitionTime = data.FromTime(now)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Requeue the instances on the nodes with the expired drain deadline,
+// returns the draining nodes that still have active instances.
+func (m *NodeReaper) requeueDrained(draining map[string]bool, expired map[string]bool,
+	now time.Time) (map[string]bool, error) {
+
+	m.taskStore.LockInstances()
+	defer m.taskStore.UnlockInstances()
+
+	active := m.taskStore.ListTaskInstances(func(inst *data.TaskInstance) bool {
+		return draining[inst.AssignedNode] && isInstanceActive(inst)
+	})
+
+	var busy = make(map[string]bool)
+	var requeued []*data.TaskInstance
+	for _, inst := range active {
+		if !expired[inst.AssignedNode] {
+			busy[inst.AssignedNode] = true
+			continue
+		}
+		// It's not the task's fault, so the retry budget is not charged.
+		// The runner will kill the instance during its next synchronization.
+		instCopy := *inst
+		requeueInstance(&instCopy, now)
+		requeued = append(requeued, &instCopy)
+	}
+
+	if len(requeued) != 0 {
+		logrus.Infof("Requeueing %d task instances from the draining nodes", len(requeued))
+	}
+	return busy, m.taskStore.StoreTaskInstances(requeued)
+}
@@ -0,0 +1,87 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/node"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func drainNode(ns *data.NodeStore, nodeId string, deadline *int64) interface{} {
+	req := httptest.NewRequest("POST", "/node/drain", nil)
+	dp := DrainNodeProcessor{
+		ctx:       req.Context(),
+		store:     ns,
+		principal: data.AuthToken{Type: data.UserToken, EntityKey: "user"},
+		params: node.PostNodeDrainParams{
+			HTTPRequest:     req,
+			NodeID:          nodeId,
+			DeadlineSeconds: deadline,
+		},
+	}
+	return dp.Enact()
+}
+
+func TestNodeDrain(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	store.InitSchema(map[string]int64{data.TokenStoreTable: 5})
+	qs := data.NewQueueStore(store)
+	tokens := data.NewTokenStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}}))
+
+	now := time.Now()
+	for _, key := range []string{"n1", "n2"} {
+		n := makeTestNode(key, "q1", 4096, 1)
+		n.LastHeartbeat = data.FromTime(now)
+		assert.NoError(t, ns.StoreNode(n))
+	}
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 3, 1024, 1024)))
+	sched := newTestScheduler(store, ts, ns)
+	assert.NoError(t, sched.Schedule())
+	assert.Equal(t, map[string]int{"n1": 1, "n2": 1}, countByNode(ts))
+	onNode := ts.ListTaskInstances(func(inst *data.TaskInstance) bool {
+		return inst.AssignedNode == "n1"
+	})[0].Key
+
+	_, ok := drainNode(ns, "n3", nil).(*node.PostNodeDrainDefault)
+	assert.True(t, ok)
+	deadline := int64(60)
+	_, ok = drainNode(ns, "n1", &deadline).(*node.PostNodeDrainOK)
+	assert.True(t, ok)
+
+	reaper := &NodeReaper{nodeStore: ns, taskStore: ts, tokenStore: data.NewTokenStore(store),
+		retryPolicy: &RetryPolicy{}, HeartbeatTimeout: time.Hour}
+
+	// The running instance is allowed to finish
+	assert.NoError(t, reaper.ReapNodes(now))
+	nodes := ns.ListNodes([]string{"n1"}, nil)
+	assert.Equal(t, models.NodeStateEnumDraining, nodes[0].State)
+	assert.False(t, syncNode(t, ts, qs, ns, tokens, "n1", nil).Shutdown)
+
+	// Nothing new is placed on the draining node
+	inst, _ := ts.GetTaskInstance("1-2")
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+
+	// After the deadline the instance is requeued and the node is shut down
+	assert.NoError(t, reaper.ReapNodes(now.Add(2*time.Minute)))
+	assert.NoError(t, reaper.ReapNodes(now.Add(2*time.Minute)))
+	nodes = ns.ListNodes([]string{"n1"}, nil)
+	assert.Equal(t, models.NodeStateEnumShuttingDown, nodes[0].State)
+	assert.Equal(t, 0, countByNode(ts)["n1"])
+	inst, _ = ts.GetTaskInstance(onNode)
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+	assert.Equal(t, 0, inst.RetryNum)
+
+	res := syncNode(t, ts, qs, ns, tokens, "n1", []*models.TaskStatus{
+		{InstanceID: onNode, TaskState: models.TaskStateEnumRunning},
+	})
+	assert.True(t, res.Shutdown)
+	assert.Equal(t, []string{onNode}, res.KillInstances)
+
+	// The node can't be drained again
+	_, ok = drainNode(ns, "n1", nil).(*node.PostNodeDrainDefault)
+	assert.True(t, ok)
+}
@@ -22,7 +22,7 @@ type PutUnmanagedNodeProcessor struct {
 }
 
 func (l *PutUnmanagedNodeProcessor) respondWithError(err error) middleware.Responder {
-	logrus.Warnf("Failed to list Nodes: %+v", err.Error())
+	logrus.Warnf("Failed to create a node: %+v", err.Error())
 	return node.NewPutUnmanagedNodeDefault(http.StatusInternalServerError).
 		WithPayload(&models.Error{
 			Code: http.StatusInternalServerError, Message: err.Error(),
@@ -30,35 +30,43 @@ func (l *PutUnmanagedNodeProcessor) respondWithError(err error) middleware.Respo
 }
 
 func (l *PutUnmanagedNodeProcessor) Enact() middleware.Responder {
-	l.queueStore.FullLock()
-	defer l.queueStore.FullUnlock()
-	l.store.FullLock()
-	defer l.store.FullUnlock()
-
-	nodes := l.store.ListNodes([]string{l.params.Node.NodeID}, nil)
-	if len(nodes) != 0 && nodes[0].Queue != l.params.Node.Queue {
-		return l.respondWithError(fmt.Errorf(
-			"there's an existing node with conflicting queue"))
+	newNode, err := registerUnmanagedNode(l.queueStore, l.store, l.params.Node.Queue)
+	if err != nil {
+		return l.respondWithError(err)
+	}
+	utils.CL(l.ctx).Infof("Node %s is created by %s", newNode.Key,
+		l.principal.RenderEntity())
+
+	return node.NewPutUnmanagedNodeOK().WithPayload(&node.PutUnmanagedNodeOKBody{
+		NodeID: newNode.Key,
+	})
+}
+
+// Create a new unmanaged node in the queue, it becomes active once its
+// runner sends the first heartbeat.
+func registerUnmanagedNode(queueStore *data.QueueStore, nodeStore *data.NodeStore,
+	queue string) (*data.StoredNode, error) {
+
+	if len(queueStore.ListQueues([]string{queue})) == 0 {
+		return nil, fmt.Errorf("queue %s is not found", queue)
 	}
 
 	now := data.FromTime(time.Now())
-	newNode := data.StoredNode {
-		Key:       l.params.Node.NodeID,
+	newNode := &data.StoredNode{
+		Key:       "node-" + *utils.GenerateRandIdSized(8),
 		Managed:   false,
 		State:     models.NodeStateEnumInitializing,
 		CreatedOn: now,
 		LastTransitionTime: now,
-		Queue: l.params.Node.Queue,
+		Queue: queue,
 	}
 
-	err := l.store.StoreNode(&newNode)
+	// The node store does its own locking
+	err := nodeStore.StoreNode(newNode)
 	if err != nil {
-		return l.respondWithError(err)
+		return nil, err
 	}
-
-	//TODO: link into the queue indexes
-
-	return &node.PutUnmanagedNodeOK{}
+	return newNode, nil
 }
 
 
@@ -99,8 +107,66 @@ func (l *ListNodesProcessor) Enact() middleware.Responder {
 }
 
 
+// Accept the heartbeat of a node's runner with the node's current metrics
 type PostNodeStateProcessor struct {
 	ctx context.Context
 	store *data.NodeStore
+	principal data.AuthToken
 	params node.PostNodeStateParams
 }
+
+func (l *PostNodeStateProcessor) respondWithError(code int64, err error) middleware.Responder {
+	logrus.Warnf("Failed to update the node state: %+v", err.Error())
+	return node.NewPostNodeStateDefault(int(code)).
+		WithPayload(&models.Error{
+			Code: code, Message: err.Error(),
+			RequestID: utils.GetReqIdFromContext(l.ctx)})
+}
+
+func (l *PostNodeStateProcessor) Enact() middleware.Responder {
+	nodeId := l.principal.EntityKey
+	if l.params.NodeID != nil {
+		nodeId = *l.params.NodeID
+	}
+
+	nodes := l.store.ListNodes([]string{nodeId}, nil)
+	if len(nodes) == 0 {
+		return l.respondWithError(http.StatusNotFound,
+			fmt.Errorf("node %s is not found", nodeId))
+	}
+	if !nodeMatchesPrincipal(nodes[0], l.principal) {
+		return l.respondWithError(http.StatusForbidden,
+			fmt.Errorf("the token doesn't belong to node %s", nodeId))
+	}
+
+	now := data.FromTime(time.Now())
+	updated, err := l.store.UpdateNode(nodeId, func(n *data.StoredNode) bool {
+		if n.State == models.NodeStateEnumDead {
+			// The node's instances have been rescheduled already
+			return false
+		}
+		n.Info = l.params.NodeState
+		n.LastHeartbeat = now
+		if n.State == models.NodeStateEnumInitializing ||
+			n.State == models.NodeStateEnumCreating {
+			utils.CL(l.ctx).Infof("Node %s is now active", n.Key)
+			n.State = models.NodeStateEnumActive
+			n.LastTransitionTime = now
+		}
+		return true
+	})
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err)
+	}
+	if updated == nil {
+		return l.respondWithError(http.StatusNotFound,
+			fmt.Errorf("node %s is not found", nodeId))
+	}
+	if updated.State == models.NodeStateEnumDead {
+		// The runner must not continue, its suicide timer will shut it down
+		return l.respondWithError(http.StatusConflict,
+			fmt.Errorf("node %s is declared dead", nodeId))
+	}
+
+	return node.NewPostNodeStateOK()
+}
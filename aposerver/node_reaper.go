@@ -0,0 +1,148 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"time"
+)
+
+// The runners send their heartbeats every minute
+const DefaultHeartbeatTimeout = 5 * time.Minute
+
+// Declares the nodes dead when their runners stop sending heartbeats,
+// and reclaims the resources of the dead nodes: their task instances
+// are put back into the queue and their tokens are revoked.
+type NodeReaper struct {
+	nodeStore *data.NodeStore
+	taskStore *data.TaskStore
+	tokenStore *data.TokenStore
+	retryPolicy *RetryPolicy
+
+	HeartbeatTimeout time.Duration
+	// The nodes are given a grace period after the server (re)start
+	startedOn time.Time
+}
+
+func NewNodeReaper(v *viper.Viper, nodeStore *data.NodeStore, taskStore *data.TaskStore,
+	tokenStore *data.TokenStore, retryPolicy *RetryPolicy) *NodeReaper {
+
+	reaper := &NodeReaper{
+		nodeStore: nodeStore,
+		taskStore: taskStore,
+		tokenStore: tokenStore,
+		retryPolicy: retryPolicy,
+		HeartbeatTimeout: DefaultHeartbeatTimeout,
+		startedOn: time.Now(),
+	}
+	if v.IsSet("nodes.heartbeat-timeout") {
+		reaper.HeartbeatTimeout = v.GetDuration("nodes.heartbeat-timeout")
+	}
+	return reaper
+}
+
+// The nodes that are expected to send heartbeats. The runners of the
+// shut down nodes exit, so these nodes eventually become dead as well.
+func isNodeRunning(n *data.StoredNode) bool {
+	return n.State == models.NodeStateEnumActive ||
+		n.State == models.NodeStateEnumDraining ||
+		n.State == models.NodeStateEnumShuttingDown
+}
+
+// Mark the silent nodes as dead and reclaim the resources of the dead
+// nodes, and move the draining nodes forward. It's idempotent, so the work
+// interrupted by a server restart is simply redone.
+func (m *NodeReaper) ReapNodes(now time.Time) error {
+	err := m.markDeadNodes(now)
+	if err != nil {
+		return err
+	}
+	err = m.progressDrains(now)
+	if err != nil {
+		return err
+	}
+
+	dead := m.nodeStore.ListNodes(nil, func(n *data.StoredNode) bool {
+		return n.State == models.NodeStateEnumDead
+	})
+	if len(dead) == 0 {
+		return nil
+	}
+
+	err = m.reclaimInstances(dead, now)
+	if err != nil {
+		return err
+	}
+	return m.revokeTokens(dead)
+}
+
+// Mark the running nodes that haven't sent a heartbeat for too long as dead
+func (m *NodeReaper) markDeadNodes(now time.Time) error {
+	if now.Before(m.startedOn.Add(m.HeartbeatTimeout)) {
+		return nil
+	}
+
+	deadline := data.FromTime(now.Add(-m.HeartbeatTimeout))
+	stale := m.nodeStore.ListNodes(nil, func(n *data.StoredNode) bool {
+		return isNodeRunning(n) && n.LastHeartbeat < deadline
+	})
+
+	for _, n := range stale {
+		_, err := m.nodeStore.UpdateNode(n.Key, func(n *data.StoredNode) bool {
+			// Re-check, the heartbeat might have arrived in the meantime
+			if !isNodeRunning(n) || n.LastHeartbeat >= deadline {
+				return false
+			}
+			logrus.Warnf("Node %s has stopped sending heartbeats, it's dead", n.Key)
+			n.State = models.NodeStateEnumDead
+			n.LastTransitionTime = data.FromTime(now)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put the instances assigned to the dead nodes back into the queue, node
+// losses are not charged to the task's retry budget.
+func (m *NodeReaper) reclaimInstances(dead []*data.StoredNode, now time.Time) error {
+	var deadKeys = make(map[string]bool)
+	for _, n := range dead {
+		deadKeys[n.Key] = true
+	}
+
+	m.taskStore.LockInstances()
+	defer m.taskStore.UnlockInstances()
+
+	lost := m.taskStore.ListTaskInstances(func(inst *data.TaskInstance) bool {
+		return deadKeys[inst.AssignedNode] && isInstanceActive(inst)
+	})
+	if len(lost) == 0 {
+		return nil
+	}
+
+	var updated = make([]*data.TaskInstance, 0, len(lost))
+	for _, inst := range lost {
+		updated = append(updated, m.retryPolicy.OnNodeLost(inst, now))
+	}
+	logrus.Infof("Reclaiming %d task instances from the dead nodes", len(updated))
+	return m.taskStore.StoreTaskInstances(updated)
+}
+
+// Revoke the tokens of the dead nodes, so they can't come back
+func (m *NodeReaper) revokeTokens(dead []*data.StoredNode) error {
+	var deadKeys = make(map[string]bool)
+	for _, n := range dead {
+		deadKeys[n.Key] = true
+		if n.CloudID != "" {
+			deadKeys[n.CloudID] = true
+		}
+	}
+
+	return m.tokenStore.RevokeTokens(func(token data.AuthToken) bool {
+		return token.Type == data.NodeToken && deadKeys[token.EntityKey]
+	})
+}
@@ -0,0 +1,113 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/node"
+	"apollo/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func sendHeartbeat(ns *data.NodeStore, nodeId string, info models.NodeInfo) interface{} {
+	req := httptest.NewRequest("POST", "/node-state", nil)
+	req = req.WithContext(utils.SaveReqIdToContext(req.Context(), "test-req"))
+
+	sp := PostNodeStateProcessor{
+		ctx:       req.Context(),
+		store:     ns,
+		principal: data.AuthToken{Type: data.NodeToken, EntityKey: nodeId},
+		params: node.PostNodeStateParams{
+			HTTPRequest: req,
+			NodeID:      &nodeId,
+			NodeState:   info,
+		},
+	}
+	return sp.Enact()
+}
+
+func TestNodeLifecycle(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	store.InitSchema(map[string]int64{data.TokenStoreTable: 5})
+	n1 := makeTestNode("n1", "q1", 0, 0)
+	n1.State = models.NodeStateEnumInitializing
+	assert.NoError(t, ns.StoreNode(n1))
+
+	// The first heartbeat activates the node
+	info := models.NodeInfo{RAM: models.NodeInfoRAM{RAMTotalMb: 4096}}
+	_, ok := sendHeartbeat(ns, "n1", info).(*node.PostNodeStateOK)
+	assert.True(t, ok)
+	nodes := ns.ListNodes([]string{"n1"}, nil)
+	assert.Equal(t, models.NodeStateEnumActive, nodes[0].State)
+	assert.Equal(t, int64(4096), nodes[0].Info.RAM.RAMTotalMb)
+	assert.NotEqual(t, data.AbsoluteTime(0), nodes[0].LastHeartbeat)
+
+	// A different node can't report for n1
+	assert.NoError(t, ns.StoreNode(makeTestNode("n2", "q1", 0, 0)))
+	sp := PostNodeStateProcessor{
+		ctx:       httptest.NewRequest("POST", "/node-state", nil).Context(),
+		store:     ns,
+		principal: data.AuthToken{Type: data.NodeToken, EntityKey: "n2"},
+		params:    node.PostNodeStateParams{NodeID: &n1.Key},
+	}
+	_, ok = sp.Enact().(*node.PostNodeStateDefault)
+	assert.True(t, ok)
+
+	// The grace period after the start
+	tokens := data.NewTokenStore(store)
+	reaper := &NodeReaper{nodeStore: ns, taskStore: ts, tokenStore: tokens,
+		retryPolicy: &RetryPolicy{MaxNodeLossRetries: 1},
+		HeartbeatTimeout: time.Minute, startedOn: time.Now()}
+	assert.NoError(t, reaper.ReapNodes(time.Now().Add(30*time.Second)))
+	nodes = ns.ListNodes([]string{"n2"}, nil)
+	assert.Equal(t, models.NodeStateEnumActive, nodes[0].State)
+
+	// n2 has never sent a heartbeat, n1 is still alive
+	assert.NoError(t, reaper.ReapNodes(time.Now().Add(61*time.Second)))
+	nodes = ns.ListNodes([]string{"n1"}, nil)
+	assert.Equal(t, models.NodeStateEnumActive, nodes[0].State)
+	nodes = ns.ListNodes([]string{"n2"}, nil)
+	assert.Equal(t, models.NodeStateEnumDead, nodes[0].State)
+
+	// The dead nodes are not revived
+	_, ok = sendHeartbeat(ns, "n2", info).(*node.PostNodeStateDefault)
+	assert.True(t, ok)
+	nodes = ns.ListNodes([]string{"n2"}, nil)
+	assert.Equal(t, models.NodeStateEnumDead, nodes[0].State)
+}
+
+func TestNodeReaperReclaims(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	store.InitSchema(map[string]int64{data.TokenStoreTable: 5})
+	tokens := data.NewTokenStore(store)
+
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 4096, 1)))
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 2, 1024, 1024)))
+	assert.NoError(t, newTestScheduler(store, ts, ns).Schedule())
+	assert.Equal(t, 1, countByNode(ts)["n1"])
+
+	assert.NoError(t, tokens.StoreToken(data.AuthToken{Key: "t1",
+		Type: data.NodeToken, EntityKey: "n1", Expires: data.NeverExpires}))
+	assert.NoError(t, tokens.StoreToken(data.AuthToken{Key: "t2",
+		Type: data.NodeToken, EntityKey: "n2", Expires: data.NeverExpires}))
+
+	policy := &RetryPolicy{MaxNodeLossRetries: 1}
+	reaper := &NodeReaper{nodeStore: ns, taskStore: ts, tokenStore: tokens,
+		retryPolicy: policy, HeartbeatTimeout: time.Minute}
+	assert.NoError(t, reaper.ReapNodes(time.Now()))
+
+	// The instance is back in the queue, the retry budget is intact
+	inst, _ := ts.GetTaskInstance("1-0")
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+	assert.Equal(t, "", inst.AssignedNode)
+	assert.Equal(t, 0, inst.RetryNum)
+	assert.Equal(t, 1, inst.NodeLossRetries)
+
+	// Only the dead node's token is revoked
+	_, ok := tokens.GetTokenByKey("t1")
+	assert.False(t, ok)
+	_, ok = tokens.GetTokenByKey("t2")
+	assert.True(t, ok)
+}
@@ -16,21 +16,37 @@ import (
 type PutQueueProcessor struct {
 	ctx context.Context
 	store *data.QueueStore
+	// The autoscaler that launches the queue's nodes, nil if it's disabled
+	autoscaler *Autoscaler
 	principal string
 	params queue.PutQueueParams
 }
 
-func (l *PutQueueProcessor) respondWithError(err error) middleware.Responder {
+func (l *PutQueueProcessor) respondWithError(code int64, err error) middleware.Responder {
 	logrus.Warnf("Failed to modify/create a queue: %+v", err.Error())
-	return queue.NewPutQueueDefault(http.StatusInternalServerError).
+	return queue.NewPutQueueDefault(int(code)).
 		WithPayload(&models.Error{
-			Code: http.StatusInternalServerError, Message: err.Error(),
+			Code: code, Message: err.Error(),
 			RequestID: utils.GetReqIdFromContext(l.ctx)})
 }
 
 func (l *PutQueueProcessor) Enact() middleware.Responder {
 	logrus.Infof("Creating a queue %s", l.params.Queue.Name)
 
+	// The autoscaler needs to know the resources of the instance types
+	if l.autoscaler != nil {
+		specs, err := l.autoscaler.ResolveInstanceTypes(l.params.Queue.InstanceTypes)
+		if err != nil {
+			return l.respondWithError(http.StatusInternalServerError, err)
+		}
+		for _, t := range l.params.Queue.InstanceTypes {
+			if _, ok := specs[t]; !ok {
+				return l.respondWithError(http.StatusBadRequest,
+					fmt.Errorf("unknown instance type: %s", t))
+			}
+		}
+	}
+
 	st := data.StoredQueue {
 		Key: l.params.Queue.Name,
 		Queue: *l.params.Queue,
@@ -41,7 +57,7 @@ func (l *PutQueueProcessor) Enact() middleware.Responder {
 	// TODO: moar validation?
 	err := l.store.StoreQueue(&st) // Will do locking
 	if err != nil {
-		return l.respondWithError(err)
+		return l.respondWithError(http.StatusInternalServerError, err)
 	}
 
 	return queue.NewPutQueueOK().WithPayload(&queue.PutQueueOKBody{
@@ -0,0 +1,51 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/queue"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPutQueueInstanceTypes(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	qs := data.NewQueueStore(store)
+	cloud := NewFakeCloud()
+
+	putQueue := func(autoscaler *Autoscaler, instanceTypes []string) interface{} {
+		req := httptest.NewRequest("PUT", "/queue", nil)
+		pq := PutQueueProcessor{
+			ctx:        req.Context(),
+			store:      qs,
+			autoscaler: autoscaler,
+			params: queue.PutQueueParams{HTTPRequest: req, Queue: &models.Queue{
+				Name: "q1", LaunchTemplateID: "lt-1234", InstanceTypes: instanceTypes}},
+		}
+		return pq.Enact()
+	}
+
+	// Without the autoscaler the instance types are not used
+	_, ok := putQueue(nil, []string{"x9.huge"}).(*queue.PutQueueOK)
+	assert.True(t, ok)
+	assert.Equal(t, 0, cloud.DescribeCount)
+
+	// The instance types unknown to the cloud are rejected upfront,
+	// the autoscaler can't use them
+	scaler := makeTestAutoscaler(store, ts, ns, cloud)
+	res, ok := putQueue(scaler, []string{"c5.large", "x9.huge"}).(*queue.PutQueueDefault)
+	assert.True(t, ok)
+	assert.Equal(t, int64(400), res.Payload.Code)
+	assert.Equal(t, []string{"x9.huge"}, qs.ListQueues(nil)[0].InstanceTypes)
+
+	_, ok = putQueue(scaler, []string{"c5.large", "m5.xlarge"}).(*queue.PutQueueOK)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"c5.large", "m5.xlarge"}, qs.ListQueues(nil)[0].InstanceTypes)
+
+	// The known instance types are cached
+	describeCount := cloud.DescribeCount
+	_, ok = putQueue(scaler, []string{"m5.xlarge"}).(*queue.PutQueueOK)
+	assert.True(t, ok)
+	assert.Equal(t, describeCount, cloud.DescribeCount)
+}
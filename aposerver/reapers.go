@@ -5,10 +5,10 @@ import (
 	"time"
 )
 
-var ReaperInterval = 1000 * time.Second
+var ReaperInterval = 30 * time.Second
 
 func RunReapers(ctx *ServerContext) chan bool {
-	var done chan bool
+	var done = make(chan bool, 1)
 	go func() {
 		logrus.Infof("Starting the background reaper thread")
 		ticker := time.NewTicker(ReaperInterval)
@@ -17,11 +17,11 @@ func RunReapers(ctx *ServerContext) chan bool {
 		for {
 			select {
 			case <-ticker.C:
-				logrus.Info("Running reapers")
+				logrus.Debug("Running reapers")
 				doRunReapers(ctx)
 			case <-done:
 				logrus.Info("Stopping the reaper thread")
-				break
+				return
 			}
 		}
 	}()
@@ -34,6 +34,16 @@ func doRunReapers(context *ServerContext) {
 	if err != nil {
 		logrus.Errorf("Encountered error while reaping tokens: %s", err.Error())
 	} else {
-		logrus.Infof("Reaped old tokens")
+		logrus.Debug("Reaped old tokens")
+	}
+
+	err = ReapTaskTokens(context.TokenStore, context.TaskStore)
+	if err != nil {
+		logrus.Errorf("Encountered error while reaping task tokens: %s", err.Error())
+	}
+
+	err = context.NodeReaper.ReapNodes(time.Now())
+	if err != nil {
+		logrus.Errorf("Encountered error while reaping nodes: %s", err.Error())
 	}
 }
@@ -0,0 +1,111 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"github.com/spf13/viper"
+	"time"
+)
+
+const DefaultRetryBackoff = 10 * time.Second
+const DefaultMaxRetryBackoff = 10 * time.Minute
+const DefaultMaxNodeLossRetries = 5
+
+// Decides what happens with the failed task instances: they are either
+// put back into the queue or failed permanently.
+type RetryPolicy struct {
+	// The delay before the first retry, it's doubled for each next retry
+	Backoff time.Duration
+	MaxBackoff time.Duration
+	// Node losses are not the task's fault, so they are not charged to the
+	// task's retry budget. But we still don't want to retry them forever.
+	MaxNodeLossRetries int
+}
+
+func NewRetryPolicy(v *viper.Viper) *RetryPolicy {
+	policy := &RetryPolicy{
+		Backoff: DefaultRetryBackoff,
+		MaxBackoff: DefaultMaxRetryBackoff,
+		MaxNodeLossRetries: DefaultMaxNodeLossRetries,
+	}
+	if v.IsSet("scheduler.retry-backoff") {
+		policy.Backoff = v.GetDuration("scheduler.retry-backoff")
+	}
+	if v.IsSet("scheduler.max-retry-backoff") {
+		policy.MaxBackoff = v.GetDuration("scheduler.max-retry-backoff")
+	}
+	if v.IsSet("scheduler.max-node-loss-retries") {
+		policy.MaxNodeLossRetries = v.GetInt("scheduler.max-node-loss-retries")
+	}
+	return policy
+}
+
+// Compute the delay before the retry number retryNum (starting from 1)
+func (p *RetryPolicy) backoffFor(retryNum int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < retryNum && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// Put the instance back into the queue
+func requeueInstance(inst *data.TaskInstance, notBefore time.Time) {
+	inst.State = models.TaskStateEnumWaiting
+	inst.Attempt++
+	if inst.AssignedNode != "" {
+		inst.PreviousNode = inst.AssignedNode
+	}
+	inst.AssignedNode = ""
+	inst.NotBefore = data.FromTime(notBefore)
+}
+
+// Process the completion of the instance. Returns the updated copy of it.
+func (p *RetryPolicy) OnInstanceFinished(inst *data.TaskInstance, task *data.StoredTask,
+	exitCode int, reason models.FailureReasonEnum, now time.Time) *data.TaskInstance {
+
+	instCopy := *inst
+	instCopy.ExitCode = &exitCode
+	instCopy.FinishedOn = data.FromTime(now)
+
+	if exitCode == 0 && reason == "" {
+		instCopy.State = models.TaskStateEnumDone
+		instCopy.FailureReason = ""
+		return &instCopy
+	}
+
+	if reason == "" {
+		reason = models.FailureReasonEnumExitCode
+	}
+	instCopy.FailureReason = reason
+
+	if int64(inst.RetryNum) >= task.Retries {
+		instCopy.State = models.TaskStateEnumFailed
+		return &instCopy
+	}
+
+	instCopy.RetryNum++
+	requeueInstance(&instCopy, now.Add(p.backoffFor(instCopy.RetryNum)))
+	return &instCopy
+}
+
+// Process the loss of the node that was running the instance. Returns the
+// updated copy of it.
+func (p *RetryPolicy) OnNodeLost(inst *data.TaskInstance, now time.Time) *data.TaskInstance {
+	instCopy := *inst
+	instCopy.FailureReason = models.FailureReasonEnumNodeLost
+
+	if inst.NodeLossRetries >= p.MaxNodeLossRetries {
+		instCopy.State = models.TaskStateEnumFailed
+		instCopy.FinishedOn = data.FromTime(now)
+		return &instCopy
+	}
+
+	// No backoff here, it's not the task's fault
+	instCopy.NodeLossRetries++
+	requeueInstance(&instCopy, now)
+	return &instCopy
+}
@@ -0,0 +1,65 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := &RetryPolicy{
+		Backoff:            10 * time.Second,
+		MaxBackoff:         30 * time.Second,
+		MaxNodeLossRetries: 1,
+	}
+	task := makeTestTask("1", "q1", 0, 1, 100, 100)
+	task.Retries = 2
+	now := time.Unix(1000, 0)
+
+	inst := &data.TaskInstance{
+		Key:          "1-0",
+		State:        models.TaskStateEnumRunning,
+		AssignedNode: "n1",
+	}
+
+	// The first failure, the instance is requeued with a backoff
+	inst = policy.OnInstanceFinished(inst, task, 1, "", now)
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+	assert.Equal(t, "", inst.AssignedNode)
+	assert.Equal(t, 1, inst.RetryNum)
+	assert.Equal(t, 1, *inst.ExitCode)
+	assert.Equal(t, models.FailureReasonEnumExitCode, inst.FailureReason)
+	assert.Equal(t, data.FromTime(now.Add(10*time.Second)), inst.NotBefore)
+
+	// Node losses don't consume the retry budget
+	inst = policy.OnNodeLost(inst, now)
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+	assert.Equal(t, 1, inst.RetryNum)
+	assert.Equal(t, 1, inst.NodeLossRetries)
+
+	// But they are limited as well
+	failed := policy.OnNodeLost(inst, now)
+	assert.Equal(t, models.TaskStateEnumFailed, failed.State)
+	assert.Equal(t, models.FailureReasonEnumNodeLost, failed.FailureReason)
+
+	// The second failure, the backoff is doubled
+	inst = policy.OnInstanceFinished(inst, task, 137, models.FailureReasonEnumOom, now)
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+	assert.Equal(t, 2, inst.RetryNum)
+	assert.Equal(t, models.FailureReasonEnumOom, inst.FailureReason)
+	assert.Equal(t, data.FromTime(now.Add(20*time.Second)), inst.NotBefore)
+
+	// The retry budget is exhausted
+	inst = policy.OnInstanceFinished(inst, task, 1, models.FailureReasonEnumTimeout, now)
+	assert.Equal(t, models.TaskStateEnumFailed, inst.State)
+	assert.Equal(t, 2, inst.RetryNum)
+
+	// The backoff is capped
+	assert.Equal(t, 30*time.Second, policy.backoffFor(10))
+
+	// Success
+	inst = policy.OnInstanceFinished(&data.TaskInstance{Key: "1-0"}, task, 0, "", now)
+	assert.Equal(t, models.TaskStateEnumDone, inst.State)
+}
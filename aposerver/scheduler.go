@@ -0,0 +1,259 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var SchedulerInterval = 5 * time.Second
+
+// The scheduler expands the submitted task arrays into task instances
+// and assigns them to the active nodes of the task's queue.
+type Scheduler struct {
+	taskStore *data.TaskStore
+	nodeStore *data.NodeStore
+	jobStore *data.JobStore
+}
+
+func NewScheduler(taskStore *data.TaskStore, nodeStore *data.NodeStore,
+	jobStore *data.JobStore) *Scheduler {
+	return &Scheduler{
+		taskStore: taskStore,
+		nodeStore: nodeStore,
+		jobStore: jobStore,
+	}
+}
+
+// The resources of a node available for the placement
+type nodeCapacity struct {
+	node *data.StoredNode
+	freeRAMMb int64
+	freeSlots int64
+}
+
+func (s *Scheduler) RunScheduler() chan bool {
+	var done = make(chan bool, 1)
+	go func() {
+		logrus.Infof("Starting the scheduler thread")
+		ticker := time.NewTicker(SchedulerInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := s.Schedule()
+				if err != nil {
+					logrus.Errorf("Encountered error while scheduling: %s", err.Error())
+				}
+			case <-done:
+				logrus.Info("Stopping the scheduler thread")
+				return
+			}
+		}
+	}()
+
+	return done
+}
+
+// Run one pass of the scheduler
+func (s *Scheduler) Schedule() error {
+	// Nodes must be listed before the instances are locked
+	nodes := s.nodeStore.ListNodes(nil, func(node *data.StoredNode) bool {
+		return node.State == models.NodeStateEnumActive
+	})
+
+	s.taskStore.LockInstances()
+	defer s.taskStore.UnlockInstances()
+
+	err := s.expandTasks()
+	if err != nil {
+		return err
+	}
+	err = s.enforceJobLimits(time.Now())
+	if err != nil {
+		return err
+	}
+	return s.placeInstances(nodes)
+}
+
+// Create the task instances for the newly submitted task arrays
+func (s *Scheduler) expandTasks() error {
+	tasks := s.taskStore.ListTasks(nil, nil)
+
+	for _, t := range tasks {
+		err := expandTask(s.taskStore, t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Create the instances of the task array that don't exist yet, the
+// task instances must be locked by the caller.
+func expandTask(store *data.TaskStore, t *data.StoredTask) error {
+	missing := store.MissingInstances(t)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	var instances []*data.TaskInstance
+	for _, i := range missing {
+		key := data.TaskInstanceKey{ParentKey: t.Key, Index: i}
+		instances = append(instances, &data.TaskInstance{
+			Key:         key.String(),
+			InstanceKey: key,
+			State:       models.TaskStateEnumWaiting,
+		})
+	}
+
+	logrus.Infof("Expanding task %s into %d instances", t.Key, len(instances))
+	return store.StoreTaskInstances(instances)
+}
+
+// Is the instance placed onto its node to run
+func isInstanceActive(inst *data.TaskInstance) bool {
+	return inst.AssignedNode != "" && (inst.State == models.TaskStateEnumScheduled ||
+		inst.State == models.TaskStateEnumRunning)
+}
+
+// Is the cancelled instance possibly still running on its node, the node
+// is released once the runner stops reporting the instance
+func isCancelledOnNode(inst *data.TaskInstance) bool {
+	return inst.AssignedNode != "" && inst.State == models.TaskStateEnumCancelled
+}
+
+// Is the instance consuming the resources of its node
+func isUsingNode(inst *data.TaskInstance) bool {
+	return isInstanceActive(inst) || isCancelledOnNode(inst)
+}
+
+// Compute the free capacity of the nodes, grouped by the queue. The task
+// instances must be locked by the caller.
+func computeCapacity(store *data.TaskStore, nodes []*data.StoredNode) map[string][]*nodeCapacity {
+	var capByNode = make(map[string]*nodeCapacity)
+	var res = make(map[string][]*nodeCapacity)
+	for _, n := range nodes {
+		slots := n.Info.CPU.CPUCount
+		if slots <= 0 {
+			slots = 1
+		}
+		nc := &nodeCapacity{
+			node:      n,
+			freeRAMMb: n.Info.RAM.RAMTotalMb,
+			freeSlots: slots,
+		}
+		capByNode[n.Key] = nc
+		res[n.Queue] = append(res[n.Queue], nc)
+	}
+
+	// Subtract the resources used by the already placed instances
+	active := store.ListTaskInstances(isUsingNode)
+	for _, inst := range active {
+		nc, ok := capByNode[inst.AssignedNode]
+		if !ok {
+			continue
+		}
+		task, ok := store.GetTask(inst.InstanceKey.ParentKey)
+		if !ok {
+			continue
+		}
+		nc.freeRAMMb -= task.ExpectedRAMMb
+		nc.freeSlots--
+	}
+
+	return res
+}
+
+// Find the best node for the task: the node that has the least amount of
+// free RAM that can still fit the task. This packs the nodes tightly, so that
+// the idle nodes can be released.
+func findNodeForTask(task *data.StoredTask, nodes []*nodeCapacity) *nodeCapacity {
+	var best *nodeCapacity
+	for _, nc := range nodes {
+		if nc.node.Info.RAM.RAMTotalMb < task.MaxRAMMb {
+			continue
+		}
+		if nc.freeSlots <= 0 || nc.freeRAMMb < task.ExpectedRAMMb {
+			continue
+		}
+		if best == nil || nc.freeRAMMb < best.freeRAMMb {
+			best = nc
+		}
+	}
+	return best
+}
+
+// Order the instances by their submission order (tasks have numeric keys)
+// and by their index within the task array.
+func sortInstances(instances []*data.TaskInstance) {
+	sort.Slice(instances, func(i, j int) bool {
+		ki, _ := strconv.ParseInt(instances[i].InstanceKey.ParentKey, 10, 64)
+		kj, _ := strconv.ParseInt(instances[j].InstanceKey.ParentKey, 10, 64)
+		if ki != kj {
+			return ki < kj
+		}
+		return instances[i].InstanceKey.Index < instances[j].InstanceKey.Index
+	})
+}
+
+// Assign the waiting instances with satisfied dependencies to the nodes
+func (s *Scheduler) placeInstances(nodes []*data.StoredNode) error {
+	capacity := computeCapacity(s.taskStore, nodes)
+
+	now := data.FromTime(time.Now())
+	waiting := s.taskStore.ListTaskInstances(func(inst *data.TaskInstance) bool {
+		// Skip the instances that are waiting for their retry backoff
+		return inst.State == models.TaskStateEnumWaiting && inst.NotBefore <= now
+	})
+	sortInstances(waiting)
+
+	deps := newDependencyResolver(s.taskStore)
+	var updated []*data.TaskInstance
+	for _, inst := range waiting {
+		task, ok := s.taskStore.GetTask(inst.InstanceKey.ParentKey)
+		if !ok {
+			logrus.Warnf("Task instance %s has no parent task", inst.Key)
+			continue
+		}
+
+		ready, depFailed := deps.check(inst, task)
+		if depFailed {
+			// The instance can never run, fail it
+			instCopy := *inst
+			instCopy.State = models.TaskStateEnumFailed
+			instCopy.FailureReason = models.FailureReasonEnumDependencyFailed
+			instCopy.FinishedOn = now
+			updated = append(updated, &instCopy)
+			continue
+		}
+		if !ready {
+			continue
+		}
+
+		nc := findNodeForTask(task, capacity[task.Queue])
+		if nc == nil {
+			continue
+		}
+		nc.freeRAMMb -= task.ExpectedRAMMb
+		nc.freeSlots--
+
+		instCopy := *inst
+		instCopy.State = models.TaskStateEnumScheduled
+		instCopy.AssignedNode = nc.node.Key
+		instCopy.ScheduledOn = now
+		updated = append(updated, &instCopy)
+	}
+
+	if len(updated) == 0 {
+		return nil
+	}
+
+	logrus.Infof("Updated %d task instances", len(updated))
+	return s.taskStore.StoreTaskInstances(updated)
+}
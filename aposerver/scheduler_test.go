@@ -0,0 +1,135 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func makeTestStores() (*data.FakeMemStore, *data.TaskStore, *data.NodeStore) {
+	store := data.NewFakeMemStore()
+	store.InitSchema(map[string]int64{
+		data.TaskTable:         5,
+		data.TaskInstanceTable: 5,
+		data.NodeTable:         5,
+		data.QueueTable:        5,
+		data.JobTable:          5,
+		data.TokenStoreTable:   5,
+	})
+	return store, data.NewTaskStore(store), data.NewNodeStore(store)
+}
+
+func newTestScheduler(store data.KVStore, ts *data.TaskStore,
+	ns *data.NodeStore) *Scheduler {
+	return NewScheduler(ts, ns, data.NewJobStore(store))
+}
+
+func makeTestNode(key, queue string, ramMb, cpus int64) *data.StoredNode {
+	return &data.StoredNode{
+		Key:   key,
+		Queue: queue,
+		State: models.NodeStateEnumActive,
+		Info: models.NodeInfo{
+			RAM: models.NodeInfoRAM{RAMTotalMb: ramMb},
+			CPU: models.NodeInfoCPU{CPUCount: cpus},
+		},
+	}
+}
+
+func makeTestTask(key, queue string, start, end, expectedRAM, maxRAM int64) *data.StoredTask {
+	return &data.StoredTask{
+		Key: key,
+		TaskStruct: models.TaskStruct{
+			Queue:           queue,
+			StartArrayIndex: start,
+			EndArrayIndex:   end,
+			ExpectedRAMMb:   expectedRAM,
+			MaxRAMMb:        maxRAM,
+		},
+	}
+}
+
+func countByNode(ts *data.TaskStore) map[string]int {
+	var res = make(map[string]int)
+	for _, inst := range ts.ListTaskInstances(nil) {
+		if inst.State == models.TaskStateEnumScheduled {
+			res[inst.AssignedNode]++
+		}
+	}
+	return res
+}
+
+func TestSchedulerPlacement(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 4096, 8)))
+	assert.NoError(t, ns.StoreNode(makeTestNode("n2", "q1", 2048, 1)))
+	assert.NoError(t, ns.StoreNode(makeTestNode("n3", "q2", 100000, 100)))
+
+	// 10 instances with 1Gb each
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 10, 1024, 1024)))
+
+	sched := newTestScheduler(store, ts, ns)
+	assert.NoError(t, sched.Schedule())
+
+	// All instances are expanded
+	assert.Equal(t, 10, len(ts.ListTaskInstances(nil)))
+	inst, ok := ts.GetTaskInstance("1-3")
+	assert.True(t, ok)
+	assert.Equal(t, 3, inst.InstanceKey.Index)
+
+	// n1 fits 4 instances by RAM, n2 has only one CPU. The node from the
+	// other queue must not be used.
+	counts := countByNode(ts)
+	assert.Equal(t, 4, counts["n1"])
+	assert.Equal(t, 1, counts["n2"])
+	assert.Equal(t, 0, counts["n3"])
+
+	// Re-running the scheduler doesn't change anything
+	assert.NoError(t, sched.Schedule())
+	assert.Equal(t, 10, len(ts.ListTaskInstances(nil)))
+	assert.Equal(t, counts, countByNode(ts))
+}
+
+func TestPartialExpansion(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	task := makeTestTask("1", "q1", 2, 6, 1024, 1024)
+	assert.NoError(t, ts.StoreTask(task))
+
+	// The expansion has been interrupted after the first instance
+	key := data.TaskInstanceKey{ParentKey: "1", Index: 2}
+	assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{{Key: key.String(),
+		InstanceKey: key, State: models.TaskStateEnumCancelled}}))
+	assert.Equal(t, []int{3, 4, 5}, ts.MissingInstances(task))
+
+	// Only the missing instances are created
+	assert.NoError(t, newTestScheduler(store, ts, ns).Schedule())
+	assert.Equal(t, 0, len(ts.MissingInstances(task)))
+	assert.Equal(t, 4, len(ts.ListTaskInstances(nil)))
+	inst, _ := ts.GetTaskInstance("1-2")
+	assert.Equal(t, models.TaskStateEnumCancelled, inst.State)
+	inst, _ = ts.GetTaskInstance("1-5")
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+}
+
+func TestSchedulerRespectsMaxRAM(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 1024, 8)))
+	inactive := makeTestNode("n2", "q1", 8192, 8)
+	inactive.State = models.NodeStateEnumInitializing
+	assert.NoError(t, ns.StoreNode(inactive))
+
+	// Expected RAM fits, but the maximum RAM doesn't
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 1, 512, 2048)))
+
+	sched := newTestScheduler(store, ts, ns)
+	assert.NoError(t, sched.Schedule())
+	assert.Equal(t, 0, len(countByNode(ts)))
+
+	// The instances survive the hydration
+	ts2 := data.NewTaskStore(store)
+	assert.NoError(t, ts2.Hydrate())
+	inst, ok := ts2.GetTaskInstance("1-0")
+	assert.True(t, ok)
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+}
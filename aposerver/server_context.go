@@ -1,6 +1,8 @@
 package aposerver
 
 import (
+	"fmt"
+	"io"
 	"apollo/proto/sigv4sec"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"apollo/data"
@@ -9,6 +11,7 @@ import (
 	"github.com/juju/errors.git"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"time"
 )
 
 type ServerError struct {
@@ -27,6 +30,13 @@ type ServerContext struct {
 	TaskStore *data.TaskStore
 	QueueStore *data.QueueStore
 	NodeStore *data.NodeStore
+	JobStore *data.JobStore
+	Scheduler *Scheduler
+	RetryPolicy *RetryPolicy
+	LogStore *TaskLogStore
+	NodeReaper *NodeReaper
+	Autoscaler *Autoscaler
+	Authorizer *Authorizer
 	WhitelistedAccounts map[string]string
 }
 
@@ -52,9 +62,40 @@ func (ctx* ServerContext) InitRegistry(v *viper.Viper) error {
 			dynamodb.New(ctx.AwsConfig), v.GetString("database.prefix"))
 	case "mem":
 		ctx.KvStore = data.NewFakeMemStore()
+	case "sql":
+		sqlStore, err := data.OpenSqlStore(v.GetString("database.dsn"),
+			v.GetString("database.prefix"))
+		if err != nil {
+			return err
+		}
+		ctx.KvStore = sqlStore
+	case "bolt":
+		path := v.GetString("database.path")
+		if path == "" {
+			return fmt.Errorf("database.path must be set for the bolt store")
+		}
+		boltStore, err := data.NewBoltStore(path)
+		if err != nil {
+			return err
+		}
+		ctx.KvStore = boltStore
 	default:
 		return data.NewStoreError("Unknown store type " + storeType, nil)
 	}
+	// Simulate a remote database during the local development
+	if latency := v.GetDuration("database.simulated-latency"); latency > 0 {
+		logrus.Warnf("Simulating the database latency of %s", latency.String())
+		faulty := data.NewFaultyStore(ctx.KvStore, time.Now().UnixNano())
+		faulty.AddRule(data.FaultRule{Fault: data.FaultDelay, Latency: latency,
+			LatencyJitter: v.GetDuration("database.simulated-latency-jitter")})
+		ctx.KvStore = faulty
+	}
+	// Confirm the outcome of the ambiguous writes by reading them back
+	confirmTimeout := data.DefaultWriteConfirmTimeout
+	if v.IsSet("database.write-confirm-timeout") {
+		confirmTimeout = v.GetDuration("database.write-confirm-timeout")
+	}
+	ctx.KvStore = data.NewRecoveringStore(ctx.KvStore, confirmTimeout)
 
 	// Create schema
 	logrus.Info("Initializing the schema")
@@ -65,6 +106,7 @@ func (ctx* ServerContext) InitRegistry(v *viper.Viper) error {
 		data.TaskInstanceTable: 10,
 		data.QueueTable: 5,
 		data.NodeTable: 5,
+		data.JobTable: 5,
 	})
 	if err != nil {
 		return err
@@ -89,30 +131,86 @@ func (ctx* ServerContext) InitRegistry(v *viper.Viper) error {
 	ctx.QueueStore = data.NewQueueStore(ctx.KvStore)
 	// Node store
 	ctx.NodeStore = data.NewNodeStore(ctx.KvStore)
+	// Job store
+	ctx.JobStore = data.NewJobStore(ctx.KvStore)
+	// Retry policy for the failed task instances
+	ctx.RetryPolicy = NewRetryPolicy(v)
+	// Task logs uploaded by the runners
+	ctx.LogStore = NewTaskLogStore(v)
+	// Dead node detection
+	ctx.NodeReaper = NewNodeReaper(v, ctx.NodeStore, ctx.TaskStore,
+		ctx.TokenStore, ctx.RetryPolicy)
+	// Scheduler
+	ctx.Scheduler = NewScheduler(ctx.TaskStore, ctx.NodeStore, ctx.JobStore)
+	// Autoscaler for the managed nodes
+	if v.GetBool("autoscaler.enabled") {
+		serverUrl := v.GetString("autoscaler.server-url")
+		if serverUrl == "" {
+			return fmt.Errorf("autoscaler.server-url must be set to enable the autoscaler")
+		}
+		userData, err := MakeManagedNodeUserData(serverUrl, ctx.TlsManager.OurCert)
+		if err != nil {
+			return err
+		}
+		ctx.Autoscaler = NewAutoscaler(v, NewEc2Connector(ctx.AwsConfig), userData,
+			ctx.QueueStore, ctx.NodeStore, ctx.TaskStore)
+	}
 
 	// Whitelisted accounts
 	ctx.WhitelistedAccounts = make(map[string]string)
 	for _, acct := range v.GetStringSlice("server.whitelisted-accounts") {
-		if acct == "self" {
-			acct, err = sigv4sec.GetMyAccountId(ctx.AwsConfig)
-			if err != nil {
-				return err
-			}
+		acct, err = ctx.resolveAccount(acct)
+		if err != nil {
+			return err
 		}
 		ctx.WhitelistedAccounts[acct] = acct
 	}
 
+	// Account roles
+	defaultRole := DefaultAccountRole
+	if v.IsSet("server.default-role") {
+		defaultRole, err = ParseRole(v.GetString("server.default-role"))
+		if err != nil {
+			return err
+		}
+	}
+	accountRoles := make(map[string]Role)
+	for acct, roleName := range v.GetStringMapString("server.account-roles") {
+		role, err := ParseRole(roleName)
+		if err != nil {
+			return err
+		}
+		acct, err = ctx.resolveAccount(acct)
+		if err != nil {
+			return err
+		}
+		accountRoles[acct] = role
+	}
+	ctx.Authorizer = NewAuthorizer(accountRoles, defaultRole)
+
 	logrus.Info("Hydrating the in-memory stores")
 	ctx.TokenStore.Hydrate()
 	ctx.TaskStore.Hydrate()
 	ctx.QueueStore.Hydrate()
 	ctx.NodeStore.Hydrate()
+	ctx.JobStore.Hydrate()
 
 	return nil
 }
 
+// Resolve the special 'self' account into the server's own account ID
+func (ctx *ServerContext) resolveAccount(acct string) (string, error) {
+	if acct != "self" {
+		return acct, nil
+	}
+	return sigv4sec.GetMyAccountId(ctx.AwsConfig)
+}
+
 func (ctx *ServerContext) Close() {
 	if ctx.TlsManager != nil {
 		ctx.TlsManager.Close()
 	}
+	if closer, ok := ctx.KvStore.(io.Closer); ok {
+		_ = closer.Close()
+	}
 }
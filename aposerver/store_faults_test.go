@@ -0,0 +1,159 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/login"
+	"apollo/proto/gen/restapi/operations/queue"
+	"apollo/proto/gen/restapi/operations/task"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The stores on top of the faulty database, with the write recovery like
+// in the real server
+func makeFaultyStores() (*data.FakeMemStore, *data.FaultyStore, data.KVStore) {
+	mem, _, _ := makeTestStores()
+	faulty := data.NewFaultyStore(mem, 1)
+	recovering := data.NewRecoveringStore(faulty, time.Second)
+	recovering.RetryInterval = time.Millisecond
+	return mem, faulty, recovering
+}
+
+func submitTask(store data.KVStore, ts *data.TaskStore, qs *data.QueueStore,
+	principal data.AuthToken, taskStruct models.TaskStruct) interface{} {
+
+	req := httptest.NewRequest("PUT", "/task", nil)
+	tp := TaskSubmitProcessor{
+		ctx:        req.Context(),
+		store:      ts,
+		queueStore: qs,
+		jobStore:   data.NewJobStore(store),
+		kvStore:    store,
+		principal:  principal,
+		params:     task.PutTaskParams{HTTPRequest: req, Task: &taskStruct},
+	}
+	return tp.Enact()
+}
+
+func TestSubmitTaskWithFaults(t *testing.T) {
+	mem, faulty, store := makeFaultyStores()
+	ts := data.NewTaskStore(store)
+	qs := data.NewQueueStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}}))
+	taskStruct := makeTestTask("", "q1", 0, 2, 1024, 1024).TaskStruct
+	user := data.AuthToken{Type: data.UserToken, EntityKey: "user"}
+
+	// The task ID can't be allocated
+	faulty.AddRule(data.FaultRule{Ops: []data.StoreOp{data.OpGetCounter}, Times: 1})
+	_, ok := submitTask(store, ts, qs, user, taskStruct).(*task.PutTaskDefault)
+	assert.True(t, ok)
+
+	// The task can't be stored, it must not be visible
+	faulty.AddRule(data.FaultRule{Table: data.TaskTable, Times: 1})
+	_, ok = submitTask(store, ts, qs, user, taskStruct).(*task.PutTaskDefault)
+	assert.True(t, ok)
+	assert.Equal(t, 0, len(ts.ListTasks(nil, nil)))
+
+	// The task is stored, but the database times out
+	faulty.AddRule(data.FaultRule{Table: data.TaskTable, Times: 1,
+		Fault: data.FaultAppliedButFailed, Ambiguous: true})
+	res, ok := submitTask(store, ts, qs, user, taskStruct).(*task.PutTaskOK)
+	assert.True(t, ok)
+	assert.Equal(t, 3, faulty.InjectedFaults())
+
+	// The database agrees with the memory
+	hydrated := data.NewTaskStore(mem)
+	assert.NoError(t, hydrated.Hydrate())
+	tasks := hydrated.ListTasks(nil, nil)
+	assert.Equal(t, 1, len(tasks))
+	assert.Equal(t, res.Payload.TaskID, tasks[0].Key)
+	assert.Equal(t, 1, len(ts.ListTasks(nil, nil)))
+}
+
+func deleteQueue(qs *data.QueueStore, ts *data.TaskStore, name string) interface{} {
+	req := httptest.NewRequest("DELETE", "/queue", nil)
+	dq := DeleteQueueProcessor{
+		ctx:       req.Context(),
+		store:     qs,
+		taskStore: ts,
+		params:    queue.DeleteQueueParams{HTTPRequest: req, Queue: name},
+	}
+	return dq.Enact()
+}
+
+func TestDeleteQueueWithFaults(t *testing.T) {
+	mem, faulty, store := makeFaultyStores()
+	ts := data.NewTaskStore(store)
+	qs := data.NewQueueStore(store)
+	for _, q := range []string{"q1", "q2"} {
+		assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: q, Queue: models.Queue{Name: q}}))
+	}
+
+	// The queue stays if the deletion fails
+	faulty.AddRule(data.FaultRule{Ops: []data.StoreOp{data.OpDeleteValue}, Times: 1})
+	_, ok := deleteQueue(qs, ts, "q1").(*queue.DeleteQueueDefault)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(qs.ListQueues([]string{"q1"})))
+
+	// The deletion went through despite the error
+	faulty.AddRule(data.FaultRule{Ops: []data.StoreOp{data.OpDeleteValue}, Times: 1,
+		Fault: data.FaultAppliedButFailed, Ambiguous: true})
+	_, ok = deleteQueue(qs, ts, "q1").(*queue.DeleteQueueOK)
+	assert.True(t, ok)
+
+	// A timeout that lost the deletion, the queue is still there
+	faulty.AddRule(data.FaultRule{Ops: []data.StoreOp{data.OpDeleteValue}, Times: 1,
+		Ambiguous: true})
+	_, ok = deleteQueue(qs, ts, "q2").(*queue.DeleteQueueDefault)
+	assert.True(t, ok)
+
+	hydrated := data.NewQueueStore(mem)
+	assert.NoError(t, hydrated.Hydrate())
+	assert.Equal(t, 0, len(hydrated.ListQueues([]string{"q1"})))
+	assert.Equal(t, 1, len(hydrated.ListQueues([]string{"q2"})))
+	assert.Equal(t, 0, len(qs.ListQueues([]string{"q1"})))
+	assert.Equal(t, 1, len(qs.ListQueues([]string{"q2"})))
+}
+
+func TestStoreTokensWithFaults(t *testing.T) {
+	mem, faulty, store := makeFaultyStores()
+	tokens := data.NewTokenStore(store)
+	qs := data.NewQueueStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}}))
+	user := data.AuthToken{Type: data.UserToken, EntityKey: "123456"}
+
+	// The salt can't be loaded or stored, no tokens can be issued
+	faulty.AddRule(data.FaultRule{Ops: []data.StoreOp{data.OpLoadTable},
+		Table: data.TokenStoreTable, Times: 1})
+	_, ok := createJoinToken(tokens, qs, user, "q1").(*login.PostJoinTokenDefault)
+	assert.True(t, ok)
+	faulty.AddRule(data.FaultRule{Table: data.TokenStoreTable, Times: 1,
+		Fault: data.FaultPartialWrite})
+	_, ok = createJoinToken(tokens, qs, user, "q1").(*login.PostJoinTokenDefault)
+	assert.True(t, ok)
+
+	// The token write fails, the token must not work
+	assert.NoError(t, tokens.StoreToken(data.AuthToken{Key: "warm-up", Type: data.UserToken}))
+	faulty.AddRule(data.FaultRule{Table: data.TokenStoreTable, Times: 1})
+	_, ok = createJoinToken(tokens, qs, user, "q1").(*login.PostJoinTokenDefault)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(tokens.ListTokens(nil)))
+
+	// The write timed out but has been applied, the token works
+	faulty.AddRule(data.FaultRule{Table: data.TokenStoreTable, Times: 1,
+		Fault: data.FaultAppliedButFailed, Ambiguous: true})
+	res, ok := createJoinToken(tokens, qs, user, "q1").(*login.PostJoinTokenOK)
+	assert.True(t, ok)
+	_, ok = tokens.GetTokenByKey(res.Payload.JoinToken)
+	assert.True(t, ok)
+
+	// The restarted server sees the same tokens
+	hydrated := data.NewTokenStore(mem)
+	assert.NoError(t, hydrated.Hydrate())
+	_, ok = hydrated.GetTokenByKey(res.Payload.JoinToken)
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(hydrated.ListTokens(nil)))
+}
@@ -71,6 +71,7 @@ func WireUpHandlers(ctx *ServerContext, api *operations.ApolloAPI) {
 				ctx: params.HTTPRequest.Context(),
 				aws: ctx.AwsConfig,
 				store: ctx.TokenStore,
+				nodeStore: ctx.NodeStore,
 				serverCert: ctx.TlsManager.OurCert,
 				whitelistedAccounts: ctx.WhitelistedAccounts,
 				params: params,
@@ -80,6 +81,10 @@ func WireUpHandlers(ctx *ServerContext, api *operations.ApolloAPI) {
 
 	api.LoginGetNodeTokenHandler = login.GetNodeTokenHandlerFunc(
 		func(params login.GetNodeTokenParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpGetNodeToken); denied != nil {
+				return denied
+			}
 			lp := GetNodeTokenProcessor{
 				ctx: params.HTTPRequest.Context(),
 				store: ctx.TokenStore,
@@ -90,19 +95,86 @@ func WireUpHandlers(ctx *ServerContext, api *operations.ApolloAPI) {
 			return lp.Enact()
 		})
 
+	api.LoginPostJoinTokenHandler = login.PostJoinTokenHandlerFunc(
+		func(params login.PostJoinTokenParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpCreateJoinToken); denied != nil {
+				return denied
+			}
+			jp := CreateJoinTokenProcessor{
+				ctx: params.HTTPRequest.Context(),
+				store: ctx.TokenStore,
+				queueStore: ctx.QueueStore,
+				principal: principal.(data.AuthToken),
+				params: params,
+			}
+			return jp.Enact()
+		})
+
+	api.LoginPostJoinHandler = login.PostJoinHandlerFunc(
+		func(params login.PostJoinParams) middleware.Responder {
+			jp := JoinNodeProcessor{
+				ctx: params.HTTPRequest.Context(),
+				store: ctx.TokenStore,
+				nodeStore: ctx.NodeStore,
+				queueStore: ctx.QueueStore,
+				serverCert: ctx.TlsManager.OurCert,
+				params: params,
+			}
+			return jp.Enact()
+		})
+
+	api.LoginGetTokensListHandler = login.GetTokensListHandlerFunc(
+		func(params login.GetTokensListParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpListTokens); denied != nil {
+				return denied
+			}
+			lp := ListTokensProcessor{
+				ctx: params.HTTPRequest.Context(),
+				store: ctx.TokenStore,
+				params: params,
+			}
+			return lp.Enact()
+		})
+
+	api.LoginPostTokensRevokeHandler = login.PostTokensRevokeHandlerFunc(
+		func(params login.PostTokensRevokeParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpRevokeTokens); denied != nil {
+				return denied
+			}
+			rp := RevokeTokensProcessor{
+				ctx: params.HTTPRequest.Context(),
+				store: ctx.TokenStore,
+				principal: principal.(data.AuthToken),
+				params: params,
+			}
+			return rp.Enact()
+		})
+
 	// Pingy-pongy!
 	api.LoginGetPingHandler = login.GetPingHandlerFunc(
 		func(params login.GetPingParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpPing); denied != nil {
+				return denied
+			}
 			return login.NewGetPingOK()
 		})
 
 	// Tasks
 	api.TaskPutTaskHandler = task.PutTaskHandlerFunc(
 		func(params task.PutTaskParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpSubmitTask); denied != nil {
+				return denied
+			}
 			tp := TaskSubmitProcessor{
 				ctx: params.HTTPRequest.Context(),
 				store: ctx.TaskStore,
 				queueStore: ctx.QueueStore,
+				jobStore: ctx.JobStore,
 				kvStore: ctx.KvStore,
 				principal: principal.(data.AuthToken),
 				params: params,
@@ -112,17 +184,58 @@ func WireUpHandlers(ctx *ServerContext, api *operations.ApolloAPI) {
 
 	api.TaskGetTaskListHandler = task.GetTaskListHandlerFunc(
 		func(params task.GetTaskListParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpListTasks); denied != nil {
+				return denied
+			}
 			lp := ListTasksProcessor{
 				ctx: params.HTTPRequest.Context(),
 				store: ctx.TaskStore,
+				jobStore: ctx.JobStore,
+				principal: principal.(data.AuthToken),
 				params: params,
 			}
 			return lp.Enact()
 	})
 
+	api.TaskGetTaskLogsHandler = task.GetTaskLogsHandlerFunc(
+		func(params task.GetTaskLogsParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpGetTaskLogs); denied != nil {
+				return denied
+			}
+			lp := TaskLogsProcessor{
+				ctx: params.HTTPRequest.Context(),
+				store: ctx.TaskStore,
+				logStore: ctx.LogStore,
+				principal: principal.(data.AuthToken),
+				params: params,
+			}
+			return lp.Enact()
+		})
+
+	api.TaskPostTaskCancelHandler = task.PostTaskCancelHandlerFunc(
+		func(params task.PostTaskCancelParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpCancelTasks); denied != nil {
+				return denied
+			}
+			cp := CancelTasksProcessor{
+				ctx: params.HTTPRequest.Context(),
+				store: ctx.TaskStore,
+				principal: principal.(data.AuthToken),
+				params: params,
+			}
+			return cp.Enact()
+		})
+
 	// Queues
 	api.QueueGetQueueListHandler = queue.GetQueueListHandlerFunc(
 		func(params queue.GetQueueListParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpListQueues); denied != nil {
+				return denied
+			}
 			lq := ListQueueProcessor{
 				ctx: params.HTTPRequest.Context(),
 				store: ctx.QueueStore,
@@ -133,9 +246,14 @@ func WireUpHandlers(ctx *ServerContext, api *operations.ApolloAPI) {
 
 	api.QueuePutQueueHandler = queue.PutQueueHandlerFunc(
 		func(params queue.PutQueueParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpPutQueue); denied != nil {
+				return denied
+			}
 			pq := PutQueueProcessor{
 				ctx: params.HTTPRequest.Context(),
 				store: ctx.QueueStore,
+				autoscaler: ctx.Autoscaler,
 				params: params,
 			}
 			return pq.Enact()
@@ -143,6 +261,10 @@ func WireUpHandlers(ctx *ServerContext, api *operations.ApolloAPI) {
 
 	api.QueueDeleteQueueHandler = queue.DeleteQueueHandlerFunc(
 		func(params queue.DeleteQueueParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpDeleteQueue); denied != nil {
+				return denied
+			}
 			dq := DeleteQueueProcessor{
 				ctx: params.HTTPRequest.Context(),
 				store: ctx.QueueStore,
@@ -155,6 +277,10 @@ func WireUpHandlers(ctx *ServerContext, api *operations.ApolloAPI) {
 	// Nodes
 	api.NodePutUnmanagedNodeHandler = node.PutUnmanagedNodeHandlerFunc(
 		func(params node.PutUnmanagedNodeParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpPutUnmanagedNode); denied != nil {
+				return denied
+			}
 			dq := PutUnmanagedNodeProcessor{
 				ctx: params.HTTPRequest.Context(),
 				store: ctx.NodeStore,
@@ -167,6 +293,10 @@ func WireUpHandlers(ctx *ServerContext, api *operations.ApolloAPI) {
 
 	api.NodeGetNodeListHandler = node.GetNodeListHandlerFunc(
 		func(params node.GetNodeListParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpListNodes); denied != nil {
+				return denied
+			}
 			ln := ListNodesProcessor{
 				ctx: params.HTTPRequest.Context(),
 				store: ctx.NodeStore,
@@ -174,6 +304,72 @@ func WireUpHandlers(ctx *ServerContext, api *operations.ApolloAPI) {
 			}
 			return ln.Enact()
 		})
+
+	api.NodePostNodeStateHandler = node.PostNodeStateHandlerFunc(
+		func(params node.PostNodeStateParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpPostNodeState); denied != nil {
+				return denied
+			}
+			sp := PostNodeStateProcessor{
+				ctx: params.HTTPRequest.Context(),
+				store: ctx.NodeStore,
+				principal: principal.(data.AuthToken),
+				params: params,
+			}
+			return sp.Enact()
+		})
+
+	api.NodePostNodeDrainHandler = node.PostNodeDrainHandlerFunc(
+		func(params node.PostNodeDrainParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpDrainNode); denied != nil {
+				return denied
+			}
+			dp := DrainNodeProcessor{
+				ctx: params.HTTPRequest.Context(),
+				store: ctx.NodeStore,
+				principal: principal.(data.AuthToken),
+				params: params,
+			}
+			return dp.Enact()
+		})
+
+	api.NodePostNodeTasksHandler = node.PostNodeTasksHandlerFunc(
+		func(params node.PostNodeTasksParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpSyncNodeTasks); denied != nil {
+				return denied
+			}
+			sp := NodeTasksSyncProcessor{
+				ctx: params.HTTPRequest.Context(),
+				store: ctx.TaskStore,
+				queueStore: ctx.QueueStore,
+				nodeStore: ctx.NodeStore,
+				tokenStore: ctx.TokenStore,
+				retryPolicy: ctx.RetryPolicy,
+				principal: principal.(data.AuthToken),
+				params: params,
+			}
+			return sp.Enact()
+		})
+
+	api.NodePostNodeLogsHandler = node.PostNodeLogsHandlerFunc(
+		func(params node.PostNodeLogsParams, principal interface{}) middleware.Responder {
+			if denied := ctx.Authorizer.Authorize(params.HTTPRequest, principal,
+				OpPostNodeLogs); denied != nil {
+				return denied
+			}
+			lp := NodeLogsProcessor{
+				ctx: params.HTTPRequest.Context(),
+				store: ctx.TaskStore,
+				nodeStore: ctx.NodeStore,
+				logStore: ctx.LogStore,
+				principal: principal.(data.AuthToken),
+				params: params,
+			}
+			return lp.Enact()
+		})
 }
 
 // Create a contextual logger with the request ID field set
@@ -217,12 +413,17 @@ func RunServer(ctx *ServerContext) error {
 	}
 
 	api.APIKeyAuthAuth = func(token string) (interface{}, error) {
-		// Authenticate the request
+		// Authenticate the request, the store looks up the salted hash
+		// of the token since the tokens themselves are not stored
 		authToken, ok := ctx.TokenStore.GetTokenByKey(token)
 		expireTime := authToken.Expires
 		if !ok || (expireTime != data.NeverExpires && expireTime.ToTime().Before(time.Now())) {
 			return nil, errors.Unauthenticated("https")
 		}
+		// The join tokens can only be traded for the node tokens
+		if authToken.Type == data.JoinToken {
+			return nil, errors.Unauthenticated("https")
+		}
 		return authToken, nil
 	}
 
@@ -242,12 +443,26 @@ func RunServer(ctx *ServerContext) error {
 		return err
 	}
 
-	// Start the background reapers
+	// Start the background reapers (expired tokens and dead nodes)
 	stopChannel := RunReapers(ctx)
 	defer func() {
 		stopChannel <- true
 	}()
 
+	// Start the task scheduler
+	stopScheduler := ctx.Scheduler.RunScheduler()
+	defer func() {
+		stopScheduler <- true
+	}()
+
+	// Start the autoscaler for the managed nodes
+	if ctx.Autoscaler != nil {
+		stopAutoscaler := ctx.Autoscaler.RunAutoscaler()
+		defer func() {
+			stopAutoscaler <- true
+		}()
+	}
+
 	// serve API
 	if err = server.Serve(); err != nil {
 		return err
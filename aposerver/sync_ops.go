@@ -0,0 +1,214 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/node"
+	"apollo/utils"
+	"context"
+	"fmt"
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// Reconcile the runner's view of its task instances with the server's view.
+// The runner sends the full list of instances it holds, and the server
+// responds with the instances that must be started and the instances that
+// must be killed. The exchange is idempotent, so a restarted runner simply
+// resyncs from scratch.
+type NodeTasksSyncProcessor struct {
+	ctx context.Context
+	store *data.TaskStore
+	queueStore *data.QueueStore
+	nodeStore *data.NodeStore
+	tokenStore *data.TokenStore
+	retryPolicy *RetryPolicy
+	principal data.AuthToken
+	params node.PostNodeTasksParams
+}
+
+func (l *NodeTasksSyncProcessor) respondWithError(code int64, err error) middleware.Responder {
+	logrus.Warnf("Failed to synchronize node tasks: %+v", err.Error())
+	return node.NewPostNodeTasksDefault(int(code)).
+		WithPayload(&models.Error{
+			Code: code, Message: err.Error(),
+			RequestID: utils.GetReqIdFromContext(l.ctx)})
+}
+
+// Check that the node token belongs to this node. Nodes that logged in with
+// their instance profile get tokens linked to their cloud ID. The tasks
+// can't act on behalf of the nodes.
+func nodeMatchesPrincipal(n *data.StoredNode, principal data.AuthToken) bool {
+	if principal.Type == data.TaskToken {
+		return false
+	}
+	if principal.Type != data.NodeToken {
+		return true
+	}
+	return principal.EntityKey == n.Key ||
+		(n.CloudID != "" && principal.EntityKey == n.CloudID)
+}
+
+func isInstanceOnNode(inst *data.TaskInstance, nodeId string) bool {
+	return inst.AssignedNode == nodeId && isInstanceActive(inst)
+}
+
+// Does the runner's report belong to the current attempt of the instance.
+// The runners that don't report the attempts are trusted.
+func isSameAttempt(inst *data.TaskInstance, st *models.TaskStatus) bool {
+	return st.Attempt == nil || *st.Attempt == int64(inst.Attempt)
+}
+
+func (l *NodeTasksSyncProcessor) Enact() middleware.Responder {
+	nodeId := l.params.NodeID
+	nodes := l.nodeStore.ListNodes([]string{nodeId}, nil)
+	if len(nodes) == 0 {
+		return l.respondWithError(http.StatusNotFound,
+			fmt.Errorf("node %s is not found", nodeId))
+	}
+	if !nodeMatchesPrincipal(nodes[0], l.principal) {
+		return l.respondWithError(http.StatusForbidden,
+			fmt.Errorf("the token doesn't belong to node %s", nodeId))
+	}
+
+	// All the instances on the node belong to the node's queue
+	var queueInfo models.Queue
+	queues := l.queueStore.ListQueues([]string{nodes[0].Queue})
+	if len(queues) != 0 {
+		queueInfo = queues[0].Queue
+	}
+
+	l.store.LockInstances()
+	defer l.store.UnlockInstances()
+
+	now := time.Now()
+	var reported = make(map[string]bool)
+	var known = make(map[string]bool)
+	var finished = make(map[string]bool)
+	var updated []*data.TaskInstance
+	var res = &models.NodeTaskAssignment{
+		Shutdown: nodes[0].State == models.NodeStateEnumShuttingDown,
+	}
+
+	for _, st := range l.params.TaskStates {
+		if st == nil {
+			continue
+		}
+		known[st.InstanceID] = true
+
+		inst, ok := l.store.GetTaskInstance(st.InstanceID)
+		if !ok || !isInstanceOnNode(inst, nodeId) || !isSameAttempt(inst, st) {
+			// The runner has an instance that it shouldn't be running.
+			// Finished instances are simply acknowledged. The instance
+			// might have been requeued to this node again after the runner
+			// has reported an earlier attempt, then the report is ignored.
+			if st.TaskState != models.TaskStateEnumDone {
+				res.KillInstances = append(res.KillInstances, st.InstanceID)
+			}
+			continue
+		}
+		reported[st.InstanceID] = true
+
+		var newInst *data.TaskInstance
+		switch st.TaskState {
+		case models.TaskStateEnumRunning:
+			if inst.State == models.TaskStateEnumRunning {
+				continue
+			}
+			instCopy := *inst
+			instCopy.State = models.TaskStateEnumRunning
+			instCopy.StartedOn = data.FromTime(now)
+			newInst = &instCopy
+		case models.TaskStateEnumDone:
+			task, ok := l.store.GetTask(inst.InstanceKey.ParentKey)
+			if !ok {
+				continue
+			}
+			// The instance without the exit code has failed to start
+			exitCode := -1
+			if st.ExitCode != nil {
+				exitCode = int(*st.ExitCode)
+			}
+			newInst = l.retryPolicy.OnInstanceFinished(inst, task, exitCode,
+				st.FailureReason, now)
+			finished[inst.Key] = true
+		default:
+			// The runner has accepted the instance but hasn't started it yet
+			continue
+		}
+		utils.CL(l.ctx).Infof("Task instance %s is now %s", inst.Key, newInst.State)
+		updated = append(updated, newInst)
+	}
+
+	// The cancelled instances that the runner no longer has are gone,
+	// their resources are released
+	released := l.store.ListTaskInstances(func(inst *data.TaskInstance) bool {
+		return inst.AssignedNode == nodeId && isCancelledOnNode(inst) && !known[inst.Key]
+	})
+	for _, inst := range released {
+		instCopy := *inst
+		instCopy.PreviousNode = instCopy.AssignedNode
+		instCopy.AssignedNode = ""
+		updated = append(updated, &instCopy)
+	}
+
+	// Now find the instances that the runner doesn't know about
+	var started []*data.TaskInstance
+	assigned := l.store.ListTaskInstances(func(inst *data.TaskInstance) bool {
+		return isInstanceOnNode(inst, nodeId) && !reported[inst.Key]
+	})
+	for _, inst := range assigned {
+		task, ok := l.store.GetTask(inst.InstanceKey.ParentKey)
+		if !ok {
+			continue
+		}
+
+		if inst.State == models.TaskStateEnumRunning {
+			// The runner has lost the instance (most likely it was restarted),
+			// so we need to start it again.
+			instCopy := *inst
+			instCopy.State = models.TaskStateEnumScheduled
+			updated = append(updated, &instCopy)
+		}
+
+		res.StartInstances = append(res.StartInstances, &models.TaskInstanceAssignment{
+			InstanceID: inst.Key,
+			TaskID:     task.Key,
+			Index:      int64(inst.InstanceKey.Index),
+			RetryNum:   int64(inst.RetryNum),
+			Attempt:    int64(inst.Attempt),
+			Task:       &task.TaskStruct,
+
+			DockerRepository: queueInfo.DockerRepository,
+			DockerLogin:      queueInfo.DockerLogin,
+			DockerPassword:   queueInfo.DockerPassword,
+		})
+		started = append(started, inst)
+	}
+
+	err := l.store.StoreTaskInstances(updated)
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err)
+	}
+
+	// The tokens are issued only once the instances are stored. If this
+	// fails, the runner doesn't get the instances and asks for them again,
+	// and the tokens that are already issued are replaced.
+	for i, inst := range started {
+		taskToken, err := issueTaskToken(l.tokenStore, inst, nodeId)
+		if err != nil {
+			return l.respondWithError(http.StatusInternalServerError, err)
+		}
+		res.StartInstances[i].TaskToken = taskToken
+	}
+
+	// The retried instances get new tokens when they are assigned again
+	err = revokeTaskTokens(l.tokenStore, finished)
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err)
+	}
+
+	return node.NewPostNodeTasksOK().WithPayload(res)
+}
@@ -0,0 +1,220 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/node"
+	"apollo/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func syncNode(t *testing.T, ts *data.TaskStore, qs *data.QueueStore, ns *data.NodeStore,
+	tokens *data.TokenStore, nodeId string, states []*models.TaskStatus) *models.NodeTaskAssignment {
+
+	res, ok := trySyncNode(ts, qs, ns, tokens, nodeId, states).(*node.PostNodeTasksOK)
+	assert.True(t, ok)
+	return res.Payload
+}
+
+func trySyncNode(ts *data.TaskStore, qs *data.QueueStore, ns *data.NodeStore,
+	tokens *data.TokenStore, nodeId string, states []*models.TaskStatus) interface{} {
+
+	req := httptest.NewRequest("POST", "/node/tasks", nil)
+	req = req.WithContext(utils.SaveReqIdToContext(req.Context(), "test-req"))
+
+	sp := NodeTasksSyncProcessor{
+		ctx:        req.Context(),
+		store:      ts,
+		queueStore: qs,
+		nodeStore:  ns,
+		tokenStore: tokens,
+		retryPolicy: &RetryPolicy{
+			Backoff: time.Second, MaxBackoff: time.Minute, MaxNodeLossRetries: 1},
+		principal: data.AuthToken{Type: data.NodeToken, EntityKey: nodeId},
+		params: node.PostNodeTasksParams{
+			HTTPRequest: req,
+			NodeID:      nodeId,
+			TaskStates:  states,
+		},
+	}
+	return sp.Enact()
+}
+
+func TestNodeTasksSync(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	qs := data.NewQueueStore(store)
+	tokens := data.NewTokenStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{
+		Name: "q1", DockerRepository: "repo.example.com", DockerLogin: "login"}}))
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 4096, 8)))
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 2, 1024, 1024)))
+	assert.NoError(t, newTestScheduler(store, ts, ns).Schedule())
+
+	// The runner knows nothing, it gets both instances
+	res := syncNode(t, ts, qs, ns, tokens, "n1", nil)
+	assert.Equal(t, 2, len(res.StartInstances))
+	assert.Equal(t, 0, len(res.KillInstances))
+	assert.Equal(t, "repo.example.com", res.StartInstances[0].DockerRepository)
+
+	// Each instance gets its own task token
+	var taskTokens = make(map[string]string)
+	for _, a := range res.StartInstances {
+		token, ok := tokens.GetTokenByKey(a.TaskToken)
+		assert.True(t, ok)
+		assert.Equal(t, data.TokenType(data.TaskToken), token.Type)
+		assert.Equal(t, a.InstanceID, token.EntityKey)
+		taskTokens[a.InstanceID] = a.TaskToken
+	}
+	assert.Equal(t, 2, len(taskTokens))
+
+	// The same request again results in the same answer, but the task
+	// tokens are replaced since the old ones can't be recovered
+	res = syncNode(t, ts, qs, ns, tokens, "n1", nil)
+	assert.Equal(t, 2, len(res.StartInstances))
+	for _, a := range res.StartInstances {
+		assert.NotEqual(t, taskTokens[a.InstanceID], a.TaskToken)
+		_, ok := tokens.GetTokenByKey(taskTokens[a.InstanceID])
+		assert.False(t, ok)
+		taskTokens[a.InstanceID] = a.TaskToken
+	}
+	assert.Equal(t, 2, len(tokens.ListTokens(nil)))
+
+	// Now the runner reports one instance as running and an unknown instance
+	exitCode := int64(0)
+	res = syncNode(t, ts, qs, ns, tokens, "n1", []*models.TaskStatus{
+		{InstanceID: "1-0", TaskState: models.TaskStateEnumRunning},
+		{InstanceID: "1-1", TaskState: models.TaskStateEnumDone, ExitCode: &exitCode},
+		{InstanceID: "5-1", TaskState: models.TaskStateEnumRunning},
+	})
+	assert.Equal(t, 0, len(res.StartInstances))
+	assert.Equal(t, []string{"5-1"}, res.KillInstances)
+
+	inst, _ := ts.GetTaskInstance("1-0")
+	assert.Equal(t, models.TaskStateEnumRunning, inst.State)
+	inst, _ = ts.GetTaskInstance("1-1")
+	assert.Equal(t, models.TaskStateEnumDone, inst.State)
+	assert.Equal(t, 0, *inst.ExitCode)
+
+	// The token of the finished instance is revoked
+	_, ok := tokens.GetTokenByKey(taskTokens["1-1"])
+	assert.False(t, ok)
+	_, ok = tokens.GetTokenByKey(taskTokens["1-0"])
+	assert.True(t, ok)
+
+	// The runner restarts and forgets everything, the running instance must
+	// be restarted.
+	res = syncNode(t, ts, qs, ns, tokens, "n1", nil)
+	assert.Equal(t, 1, len(res.StartInstances))
+	assert.Equal(t, "1-0", res.StartInstances[0].InstanceID)
+	inst, _ = ts.GetTaskInstance("1-0")
+	assert.Equal(t, models.TaskStateEnumScheduled, inst.State)
+}
+
+func TestReapTaskTokens(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	qs := data.NewQueueStore(store)
+	tokens := data.NewTokenStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}}))
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 4096, 8)))
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 2, 1024, 1024)))
+	assert.NoError(t, newTestScheduler(store, ts, ns).Schedule())
+
+	res := syncNode(t, ts, qs, ns, tokens, "n1", nil)
+	assert.Equal(t, 2, len(res.StartInstances))
+	assert.NoError(t, ReapTaskTokens(tokens, ts))
+	assert.Equal(t, 2, len(tokens.ListTokens(nil)))
+
+	// The instance is cancelled behind the runner's back
+	inst, _ := ts.GetTaskInstance("1-0")
+	instCopy := *inst
+	instCopy.State = models.TaskStateEnumCancelled
+	assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{&instCopy}))
+
+	assert.NoError(t, ReapTaskTokens(tokens, ts))
+	left := tokens.ListTokens(nil)
+	assert.Equal(t, 1, len(left))
+	assert.Equal(t, "1-1", left[0].EntityKey)
+
+	// The tasks can't pose as nodes
+	assert.False(t, nodeMatchesPrincipal(ns.ListNodes([]string{"n1"}, nil)[0], left[0]))
+}
+
+func TestSyncWithFailedInstanceStore(t *testing.T) {
+	_, faulty, store := makeFaultyStores()
+	ts := data.NewTaskStore(store)
+	ns := data.NewNodeStore(store)
+	qs := data.NewQueueStore(store)
+	tokens := data.NewTokenStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}}))
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 4096, 8)))
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 1, 1024, 1024)))
+	assert.NoError(t, newTestScheduler(store, ts, ns).Schedule())
+
+	res := syncNode(t, ts, qs, ns, tokens, "n1", nil)
+	taskToken := res.StartInstances[0].TaskToken
+	syncNode(t, ts, qs, ns, tokens, "n1", []*models.TaskStatus{
+		{InstanceID: "1-0", TaskState: models.TaskStateEnumRunning},
+	})
+
+	// The restarted runner gets the instance again, but the instance
+	// can't be stored. The token of the instance must stay intact.
+	faulty.AddRule(data.FaultRule{Table: data.TaskInstanceTable, Times: 1})
+	_, ok := trySyncNode(ts, qs, ns, tokens, "n1", nil).(*node.PostNodeTasksDefault)
+	assert.True(t, ok)
+	_, ok = tokens.GetTokenByKey(taskToken)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(tokens.ListTokens(nil)))
+
+	// The retry succeeds and replaces the token
+	res = syncNode(t, ts, qs, ns, tokens, "n1", nil)
+	assert.Equal(t, 1, len(res.StartInstances))
+	_, ok = tokens.GetTokenByKey(res.StartInstances[0].TaskToken)
+	assert.True(t, ok)
+	_, ok = tokens.GetTokenByKey(taskToken)
+	assert.False(t, ok)
+}
+
+func TestStaleAttemptReports(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	qs := data.NewQueueStore(store)
+	tokens := data.NewTokenStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}}))
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 4096, 8)))
+	task := makeTestTask("1", "q1", 0, 1, 1024, 1024)
+	task.Retries = 3
+	assert.NoError(t, ts.StoreTask(task))
+	sched := newTestScheduler(store, ts, ns)
+	assert.NoError(t, sched.Schedule())
+
+	res := syncNode(t, ts, qs, ns, tokens, "n1", nil)
+	assert.Equal(t, int64(0), res.StartInstances[0].Attempt)
+
+	// The first attempt fails, and the instance is retried on the same node
+	attempt, exitCode := int64(0), int64(1)
+	failed := []*models.TaskStatus{{InstanceID: "1-0", Attempt: &attempt,
+		TaskState: models.TaskStateEnumDone, ExitCode: &exitCode}}
+	syncNode(t, ts, qs, ns, tokens, "n1", failed)
+	inst, _ := ts.GetTaskInstance("1-0")
+	assert.Equal(t, 1, inst.RetryNum)
+	assert.Equal(t, 1, inst.Attempt)
+
+	retried := *inst
+	retried.NotBefore = 0
+	assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{&retried}))
+	assert.NoError(t, sched.Schedule())
+	inst, _ = ts.GetTaskInstance("1-0")
+	assert.Equal(t, models.TaskStateEnumScheduled, inst.State)
+
+	// The runner hasn't got the response and reports the old attempt again,
+	// the report is ignored and the new attempt is assigned
+	res = syncNode(t, ts, qs, ns, tokens, "n1", failed)
+	assert.Equal(t, 0, len(res.KillInstances))
+	assert.Equal(t, 1, len(res.StartInstances))
+	assert.Equal(t, int64(1), res.StartInstances[0].Attempt)
+	inst, _ = ts.GetTaskInstance("1-0")
+	assert.Equal(t, models.TaskStateEnumScheduled, inst.State)
+	assert.Equal(t, 1, inst.RetryNum)
+}
@@ -6,10 +6,13 @@ import (
 	"apollo/proto/gen/restapi/operations/task"
 	"apollo/utils"
 	"context"
+	"fmt"
 	"github.com/go-openapi/runtime/middleware"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,6 +20,7 @@ type TaskSubmitProcessor struct {
 	ctx context.Context
 	store *data.TaskStore
 	queueStore *data.QueueStore
+	jobStore *data.JobStore
 	kvStore data.KVStore
 	principal data.AuthToken
 	params task.PutTaskParams
@@ -29,6 +33,15 @@ func (l *TaskSubmitProcessor) respondWithError(code int64, error string) middlew
 }
 
 func (l *TaskSubmitProcessor) Enact() middleware.Responder {
+	scope, err := getTaskScope(l.store, l.principal)
+	if err != nil {
+		return l.respondWithError(http.StatusForbidden, err.Error())
+	}
+	if !scope.canSubmit(l.params.Task) {
+		return l.respondWithError(http.StatusForbidden,
+			"tasks can only submit the tasks of their own job")
+	}
+
 	val, err := l.kvStore.GetCounter("TaskCounter")
 	if err != nil {
 		return l.respondWithError(http.StatusInternalServerError, err.Error())
@@ -62,9 +75,42 @@ func (l *TaskSubmitProcessor) Enact() middleware.Responder {
 			"Task queue is not found: " + l.params.Task.Queue)
 	}
 
-	err = l.store.StoreTask(&st)
+	err = validateDependencies(l.store, st.Key, l.params.Task)
 	if err != nil {
-		return l.respondWithError(http.StatusInternalServerError, err.Error())
+		return l.respondWithError(http.StatusBadRequest, err.Error())
+	}
+
+	if l.params.Task.Job == nil {
+		err = l.store.StoreTask(&st)
+		if err != nil {
+			return l.respondWithError(http.StatusInternalServerError, err.Error())
+		}
+	} else {
+		// Lock the jobs so the job can't be created or failed concurrently
+		l.jobStore.LockJobs()
+		defer l.jobStore.UnlockJobs()
+
+		existing, ok := l.jobStore.GetJob(l.params.Task.Job.JobName)
+		if ok && existing.State == models.JobStateEnumFailed {
+			return l.respondWithError(http.StatusBadRequest,
+				fmt.Sprintf("job %s has already failed", existing.JobName))
+		}
+
+		// The task is stored first, so a failed submission doesn't leave
+		// an empty job behind
+		err = l.store.StoreTask(&st)
+		if err != nil {
+			return l.respondWithError(http.StatusInternalServerError, err.Error())
+		}
+		if !ok {
+			err = l.jobStore.StoreJob(newJobInfo(l.params.Task.Job, time.Now()))
+			if err != nil {
+				// The task is already visible, the scheduler will create
+				// the missing job
+				logrus.Warnf("Failed to store the job of the task %s: %s",
+					st.Key, err.Error())
+			}
+		}
 	}
 
 	return task.NewPutTaskOK().WithPayload(&task.PutTaskOKBody{
@@ -76,19 +122,29 @@ func (l *TaskSubmitProcessor) Enact() middleware.Responder {
 type ListTasksProcessor struct {
 	ctx context.Context
 	store *data.TaskStore
+	jobStore *data.JobStore
+	principal data.AuthToken
 	params task.GetTaskListParams
 }
 
-func (l *ListTasksProcessor) respondWithError(err error) middleware.Responder {
+func (l *ListTasksProcessor) respondWithError(code int64, err error) middleware.Responder {
 	logrus.Warnf("Failed to list tasks: %+v", err.Error())
-	return task.NewGetTaskListDefault(http.StatusInternalServerError).
+	return task.NewGetTaskListDefault(int(code)).
 		WithPayload(&models.Error{
-			Code: http.StatusInternalServerError, Message: err.Error(),
+			Code: code, Message: err.Error(),
 			RequestID: utils.GetReqIdFromContext(l.ctx)})
 }
 
 func (l *ListTasksProcessor) Enact() middleware.Responder {
+	scope, err := getTaskScope(l.store, l.principal)
+	if err != nil {
+		return l.respondWithError(http.StatusForbidden, err)
+	}
+
 	tasks := l.store.ListTasks(l.params.ID, func(task *data.StoredTask) bool {
+		if !scope.canView(task) {
+			return false
+		}
 		if l.params.Job != nil && (task.Job == nil || task.Job.JobName != *l.params.Job) {
 			return false
 		}
@@ -98,9 +154,19 @@ func (l *ListTasksProcessor) Enact() middleware.Responder {
 		return true
 	})
 
+	var instancesByTask = make(map[string][]*data.TaskInstance)
+	for _, inst := range l.store.ListTaskInstances(nil) {
+		parent := inst.InstanceKey.ParentKey
+		instancesByTask[parent] = append(instancesByTask[parent], inst)
+	}
+
 	// Format tasks
 	var resArr []*task.GetTaskListOKBodyItems0
 	for _, t := range tasks {
+		status := summarizeInstances(t, instancesByTask[t.Key])
+		if l.params.State != nil && !hasInstancesInState(status, *l.params.State) {
+			continue
+		}
 		taskStruct := &(t.TaskStruct)
 
 		if l.params.WithEnv == nil || !*l.params.WithEnv {
@@ -110,11 +176,162 @@ func (l *ListTasksProcessor) Enact() middleware.Responder {
 			taskStruct = &tsCopy
 		}
 
-		resArr = append(resArr, &task.GetTaskListOKBodyItems0{
-			TaskID:     t.Key,
-			TaskStruct: taskStruct,
-		})
+		item := &task.GetTaskListOKBodyItems0{
+			TaskID:         t.Key,
+			TaskStruct:     taskStruct,
+			InstanceStatus: status,
+		}
+		if t.Job != nil {
+			if job, ok := l.jobStore.GetJob(t.Job.JobName); ok {
+				item.JobFailedTaskCount = int64(job.FailedCount)
+				item.JobState = job.State
+			}
+		}
+
+		resArr = append(resArr, item)
 	}
 
 	return &task.GetTaskListOK{Payload: resArr}
 }
+
+// The order of the states in the instance summaries
+var summaryStateOrder = []models.TaskStateEnum{
+	models.TaskStateEnumWaiting,
+	models.TaskStateEnumScheduled,
+	models.TaskStateEnumRunning,
+	models.TaskStateEnumDone,
+	models.TaskStateEnumFailed,
+	models.TaskStateEnumCancelled,
+}
+
+// Count the instances of a task array in each state and collect their indexes
+func summarizeInstances(t *data.StoredTask,
+	instances []*data.TaskInstance) []*models.InstanceStateSummary {
+
+	var indexes = make(map[models.TaskStateEnum][]int)
+	for _, inst := range instances {
+		indexes[inst.State] = append(indexes[inst.State], inst.InstanceKey.Index)
+	}
+	if len(instances) == 0 {
+		// The task hasn't been expanded by the scheduler yet
+		for i := t.StartArrayIndex; i < t.EndArrayIndex; i++ {
+			indexes[models.TaskStateEnumWaiting] = append(
+				indexes[models.TaskStateEnumWaiting], int(i))
+		}
+	}
+
+	var res []*models.InstanceStateSummary
+	for _, state := range summaryStateOrder {
+		if len(indexes[state]) == 0 {
+			continue
+		}
+		res = append(res, &models.InstanceStateSummary{
+			State:   state,
+			Count:   int64(len(indexes[state])),
+			Indexes: renderIndexRanges(indexes[state]),
+		})
+	}
+	return res
+}
+
+func hasInstancesInState(status []*models.InstanceStateSummary, state string) bool {
+	for _, st := range status {
+		if string(st.State) == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Render the array indexes as compact ranges: "0-15,20"
+func renderIndexRanges(indexes []int) string {
+	sorted := append([]int(nil), indexes...)
+	sort.Ints(sorted)
+
+	var res []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			res = append(res, strconv.Itoa(sorted[i]))
+		} else {
+			res = append(res, strconv.Itoa(sorted[i])+"-"+strconv.Itoa(sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(res, ",")
+}
+
+type CancelTasksProcessor struct {
+	ctx context.Context
+	store *data.TaskStore
+	principal data.AuthToken
+	params task.PostTaskCancelParams
+}
+
+func (l *CancelTasksProcessor) respondWithError(code int64, error string) middleware.Responder {
+	logrus.Warnf("Failed to cancel tasks: %+v", error)
+	return task.NewPostTaskCancelDefault(int(code)).WithPayload(&models.Error{
+		Code: code, Message: error, RequestID: utils.GetReqIdFromContext(l.ctx)})
+}
+
+func (l *CancelTasksProcessor) Enact() middleware.Responder {
+	req := l.params.Cancellation
+	if len(req.Tasks) == 0 && req.JobName == "" {
+		return l.respondWithError(http.StatusBadRequest,
+			"Either task IDs or a job name must be specified")
+	}
+
+	tasks := l.store.ListTasks(req.Tasks, func(t *data.StoredTask) bool {
+		return req.JobName == "" || (t.Job != nil && t.Job.JobName == req.JobName)
+	})
+	if len(tasks) == 0 {
+		return l.respondWithError(http.StatusNotFound, "No matching tasks found")
+	}
+
+	var indexes = make(map[int]bool)
+	for _, idx := range req.Indexes {
+		indexes[int(idx)] = true
+	}
+
+	l.store.LockInstances()
+	defer l.store.UnlockInstances()
+
+	now := data.FromTime(time.Now())
+	var cancelled []*data.TaskInstance
+	for _, t := range tasks {
+		// The task might not have been seen by the scheduler yet
+		err := expandTask(l.store, t)
+		if err != nil {
+			return l.respondWithError(http.StatusInternalServerError, err.Error())
+		}
+
+		instances := l.store.ListTaskInstances(func(inst *data.TaskInstance) bool {
+			if inst.InstanceKey.ParentKey != t.Key || !isInstanceLive(inst) {
+				return false
+			}
+			return len(indexes) == 0 || indexes[inst.InstanceKey.Index]
+		})
+		for _, inst := range instances {
+			// The running instances will be killed by their runners
+			// during the next synchronization.
+			instCopy := *inst
+			instCopy.State = models.TaskStateEnumCancelled
+			instCopy.FinishedOn = now
+			cancelled = append(cancelled, &instCopy)
+		}
+	}
+
+	err := l.store.StoreTaskInstances(cancelled)
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err.Error())
+	}
+	utils.CL(l.ctx).Infof("%s has cancelled %d task instances",
+		l.principal.RenderEntity(), len(cancelled))
+
+	return task.NewPostTaskCancelOK().WithPayload(&task.PostTaskCancelOKBody{
+		CancelledCount: int64(len(cancelled)),
+	})
+}
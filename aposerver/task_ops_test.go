@@ -0,0 +1,223 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/task"
+	"apollo/utils"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+)
+
+func cancelTasks(ts *data.TaskStore, req *models.TaskCancellation) interface{} {
+	httpReq := httptest.NewRequest("POST", "/task/cancel", nil)
+	httpReq = httpReq.WithContext(utils.SaveReqIdToContext(httpReq.Context(), "test-req"))
+
+	cp := CancelTasksProcessor{
+		ctx:       httpReq.Context(),
+		store:     ts,
+		principal: data.AuthToken{Type: data.UserToken, EntityKey: "user"},
+		params: task.PostTaskCancelParams{
+			HTTPRequest:  httpReq,
+			Cancellation: req,
+		},
+	}
+	return cp.Enact()
+}
+
+func TestCancelTasks(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	qs := data.NewQueueStore(store)
+	tokens := data.NewTokenStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}}))
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 4096, 8)))
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 2, 1024, 1024)))
+	assert.NoError(t, newTestScheduler(store, ts, ns).Schedule())
+
+	// The task that hasn't been expanded by the scheduler yet
+	assert.NoError(t, ts.StoreTask(makeTestTask("2", "q1", 0, 4, 1024, 1024)))
+
+	// Nothing to cancel
+	_, ok := cancelTasks(ts, &models.TaskCancellation{}).(*task.PostTaskCancelDefault)
+	assert.True(t, ok)
+	_, ok = cancelTasks(ts, &models.TaskCancellation{
+		Tasks: []string{"5"}}).(*task.PostTaskCancelDefault)
+	assert.True(t, ok)
+
+	// Cancel a part of the second task
+	res, ok := cancelTasks(ts, &models.TaskCancellation{
+		Tasks: []string{"2"}, Indexes: []int64{1, 3}}).(*task.PostTaskCancelOK)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), res.Payload.CancelledCount)
+	inst, _ := ts.GetTaskInstance("2-1")
+	assert.Equal(t, models.TaskStateEnumCancelled, inst.State)
+	inst, _ = ts.GetTaskInstance("2-2")
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+
+	// Cancel the running task, the runner is asked to kill its instances
+	res, ok = cancelTasks(ts, &models.TaskCancellation{
+		Tasks: []string{"1"}}).(*task.PostTaskCancelOK)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), res.Payload.CancelledCount)
+
+	assignment := syncNode(t, ts, qs, ns, tokens, "n1", []*models.TaskStatus{
+		{InstanceID: "1-0", TaskState: models.TaskStateEnumRunning},
+	})
+	assert.Equal(t, []string{"1-0"}, assignment.KillInstances)
+	assert.Equal(t, 0, len(assignment.StartInstances))
+
+	// The cancelled instances are reported separately from the failed ones
+	task2, _ := ts.GetTask("2")
+	summary := summarizeInstances(task2, ts.ListTaskInstances(func(inst *data.TaskInstance) bool {
+		return inst.InstanceKey.ParentKey == "2"
+	}))
+	assert.Equal(t, []*models.InstanceStateSummary{
+		{State: models.TaskStateEnumWaiting, Count: 2, Indexes: "0,2"},
+		{State: models.TaskStateEnumCancelled, Count: 2, Indexes: "1,3"},
+	}, summary)
+}
+
+func TestCancelledInstancesHoldNode(t *testing.T) {
+	store, ts, ns := makeTestStores()
+	qs := data.NewQueueStore(store)
+	tokens := data.NewTokenStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}}))
+	assert.NoError(t, ns.StoreNode(makeTestNode("n1", "q1", 2048, 2)))
+	assert.NoError(t, ts.StoreTask(makeTestTask("1", "q1", 0, 2, 1024, 1024)))
+	sched := newTestScheduler(store, ts, ns)
+	assert.NoError(t, sched.Schedule())
+	running := []*models.TaskStatus{
+		{InstanceID: "1-0", TaskState: models.TaskStateEnumRunning},
+		{InstanceID: "1-1", TaskState: models.TaskStateEnumRunning},
+	}
+	syncNode(t, ts, qs, ns, tokens, "n1", running)
+
+	// The node is full until the runner has killed the cancelled instances
+	_, ok := cancelTasks(ts, &models.TaskCancellation{
+		Tasks: []string{"1"}}).(*task.PostTaskCancelOK)
+	assert.True(t, ok)
+	assert.NoError(t, ts.StoreTask(makeTestTask("2", "q1", 0, 1, 1024, 1024)))
+	assert.NoError(t, sched.Schedule())
+	inst, _ := ts.GetTaskInstance("2-0")
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+
+	res := syncNode(t, ts, qs, ns, tokens, "n1", running)
+	assert.Equal(t, 2, len(res.KillInstances))
+	assert.NoError(t, sched.Schedule())
+	inst, _ = ts.GetTaskInstance("2-0")
+	assert.Equal(t, models.TaskStateEnumWaiting, inst.State)
+
+	// The runner no longer has the instances, the node is released
+	syncNode(t, ts, qs, ns, tokens, "n1", nil)
+	inst, _ = ts.GetTaskInstance("1-0")
+	assert.Equal(t, models.TaskStateEnumCancelled, inst.State)
+	assert.Equal(t, "", inst.AssignedNode)
+	assert.Equal(t, "n1", inst.PreviousNode)
+
+	assert.NoError(t, sched.Schedule())
+	inst, _ = ts.GetTaskInstance("2-0")
+	assert.Equal(t, models.TaskStateEnumScheduled, inst.State)
+	assert.Equal(t, "n1", inst.AssignedNode)
+}
+
+func TestInstanceSummary(t *testing.T) {
+	assert.Equal(t, "", renderIndexRanges(nil))
+	assert.Equal(t, "0-15,20", renderIndexRanges([]int{20, 3, 0, 1, 2,
+		4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}))
+	assert.Equal(t, "1,3-4,7", renderIndexRanges([]int{7, 4, 3, 1}))
+
+	// The tasks without instances are waiting
+	task := makeTestTask("1", "q1", 5, 10, 1024, 1024)
+	assert.Equal(t, []*models.InstanceStateSummary{
+		{State: models.TaskStateEnumWaiting, Count: 5, Indexes: "5-9"},
+	}, summarizeInstances(task, nil))
+}
+
+func TestTaskTokenScope(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apollo-logs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, ts, _ := makeTestStores()
+	qs := data.NewQueueStore(store)
+	assert.NoError(t, qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}}))
+
+	inJob := func(key string, job string) *data.StoredTask {
+		res := makeTestTask(key, "q1", 0, 1, 1024, 1024)
+		if job != "" {
+			res.Job = &models.Job{JobName: job}
+		}
+		return res
+	}
+	assert.NoError(t, ts.StoreTask(inJob("1", "j1")))
+	assert.NoError(t, ts.StoreTask(inJob("2", "j1")))
+	assert.NoError(t, ts.StoreTask(inJob("3", "j2")))
+	assert.NoError(t, ts.StoreTask(inJob("4", "")))
+	for _, key := range []string{"1", "4"} {
+		instKey := data.TaskInstanceKey{ParentKey: key, Index: 0}
+		assert.NoError(t, ts.StoreTaskInstances([]*data.TaskInstance{{Key: instKey.String(),
+			InstanceKey: instKey, State: models.TaskStateEnumRunning}}))
+	}
+	jobTask := data.AuthToken{Type: data.TaskToken, EntityKey: "1-0"}
+	loneTask := data.AuthToken{Type: data.TaskToken, EntityKey: "4-0"}
+
+	listTasks := func(principal data.AuthToken) []string {
+		req := httptest.NewRequest("GET", "/task/list", nil)
+		lp := ListTasksProcessor{
+			ctx:       req.Context(),
+			store:     ts,
+			jobStore:  data.NewJobStore(store),
+			principal: principal,
+			params:    task.GetTaskListParams{HTTPRequest: req},
+		}
+		res, ok := lp.Enact().(*task.GetTaskListOK)
+		assert.True(t, ok)
+		var keys []string
+		for _, item := range res.Payload {
+			keys = append(keys, item.TaskID)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	// The tasks only see their own job
+	assert.Equal(t, []string{"1", "2"}, listTasks(jobTask))
+	assert.Equal(t, []string{"4"}, listTasks(loneTask))
+	assert.Equal(t, 4, len(listTasks(data.AuthToken{Type: data.UserToken, EntityKey: "u"})))
+
+	readLogs := func(principal data.AuthToken, taskId string) interface{} {
+		req := httptest.NewRequest("GET", "/task/logs", nil)
+		lp := TaskLogsProcessor{
+			ctx:       req.Context(),
+			store:     ts,
+			logStore:  &TaskLogStore{dir: dir, maxSize: 100},
+			principal: principal,
+			params:    task.GetTaskLogsParams{HTTPRequest: req, TaskID: taskId},
+		}
+		return lp.Enact()
+	}
+	_, ok := readLogs(jobTask, "2").(*task.GetTaskLogsOK)
+	assert.True(t, ok)
+	_, ok = readLogs(jobTask, "3").(*task.GetTaskLogsDefault)
+	assert.True(t, ok)
+
+	// The children can only be submitted into the same job
+	child := inJob("", "j1").TaskStruct
+	_, ok = submitTask(store, ts, qs, jobTask, child).(*task.PutTaskOK)
+	assert.True(t, ok)
+	_, ok = submitTask(store, ts, qs, jobTask, inJob("", "j2").TaskStruct).(*task.PutTaskDefault)
+	assert.True(t, ok)
+	_, ok = submitTask(store, ts, qs, jobTask, inJob("", "").TaskStruct).(*task.PutTaskDefault)
+	assert.True(t, ok)
+	_, ok = submitTask(store, ts, qs, loneTask, child).(*task.PutTaskDefault)
+	assert.True(t, ok)
+
+	// The tokens of the unknown instances can't do anything
+	_, ok = submitTask(store, ts, qs, data.AuthToken{Type: data.TaskToken,
+		EntityKey: "9-0"}, child).(*task.PutTaskDefault)
+	assert.True(t, ok)
+}
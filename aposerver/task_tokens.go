@@ -0,0 +1,111 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/utils"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// Get the token of the task instance that is being started. The token is
+// valid while the instance is scheduled or running. The runner may ask for
+// the same instance again after a restart, in this case the old token is
+// replaced since only its hash is stored.
+func issueTaskToken(store *data.TokenStore, inst *data.TaskInstance,
+	nodeId string) (string, error) {
+
+	err := revokeTaskTokens(store, map[string]bool{inst.Key: true})
+	if err != nil {
+		return "", err
+	}
+
+	token := data.AuthToken{
+		Key:         *utils.GenerateRandIdSized(16),
+		Expires:     data.NeverExpires, // Revoked once the instance finishes
+		Type:        data.TaskToken,
+		EntityKey:   inst.Key,
+		RequestedBy: "node/" + nodeId,
+		RequestedOn: data.FromTime(time.Now()),
+	}
+	err = store.StoreToken(token)
+	if err != nil {
+		return "", err
+	}
+	return token.Key, nil
+}
+
+// Revoke the tokens of the given task instances
+func revokeTaskTokens(store *data.TokenStore, instanceKeys map[string]bool) error {
+	if len(instanceKeys) == 0 {
+		return nil
+	}
+	return store.RevokeTokens(func(token data.AuthToken) bool {
+		return token.Type == data.TaskToken && instanceKeys[token.EntityKey]
+	})
+}
+
+// Revoke the tokens of the task instances that are no longer running. The
+// instances can be finished in many ways (cancellation, node loss, job
+// failure), so the tokens are cleaned up in the background.
+func ReapTaskTokens(store *data.TokenStore, taskStore *data.TaskStore) error {
+	var stale = make(map[string]bool)
+	for _, token := range store.ListTokens(nil) {
+		if token.Type != data.TaskToken {
+			continue
+		}
+		inst, ok := taskStore.GetTaskInstance(token.EntityKey)
+		if !ok || !isInstanceActive(inst) {
+			stale[token.EntityKey] = true
+		}
+	}
+	if len(stale) != 0 {
+		logrus.Infof("Revoking the tokens of %d finished task instances", len(stale))
+	}
+	return revokeTaskTokens(store, stale)
+}
+
+// The tasks that a task token can access: the tasks of the job of its own
+// task, or only its own task if it's not a part of a job.
+type taskScope struct {
+	taskKey string
+	jobName string
+}
+
+// Get the scope of the principal, nil means that the principal is not
+// limited to a job.
+func getTaskScope(store *data.TaskStore, principal data.AuthToken) (*taskScope, error) {
+	if principal.Type != data.TaskToken {
+		return nil, nil
+	}
+	inst, ok := store.GetTaskInstance(principal.EntityKey)
+	if !ok {
+		return nil, fmt.Errorf("task instance %s is not found", principal.EntityKey)
+	}
+	t, ok := store.GetTask(inst.InstanceKey.ParentKey)
+	if !ok {
+		return nil, fmt.Errorf("task %s is not found", inst.InstanceKey.ParentKey)
+	}
+
+	scope := &taskScope{taskKey: t.Key}
+	if t.Job != nil {
+		scope.jobName = t.Job.JobName
+	}
+	return scope, nil
+}
+
+func (s *taskScope) canView(t *data.StoredTask) bool {
+	if s == nil || t.Key == s.taskKey {
+		return true
+	}
+	return s.jobName != "" && t.Job != nil && t.Job.JobName == s.jobName
+}
+
+// The tasks can only submit the tasks into their own job
+func (s *taskScope) canSubmit(t *models.TaskStruct) bool {
+	if s == nil {
+		return true
+	}
+	return s.jobName != "" && t.Job != nil && t.Job.JobName == s.jobName
+}
@@ -0,0 +1,144 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/login"
+	. "apollo/utils"
+	"context"
+	"fmt"
+	"github.com/go-openapi/runtime/middleware"
+	"github.com/go-openapi/strfmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"time"
+)
+
+func isTokenLive(token data.AuthToken, now time.Time) bool {
+	return token.Expires == data.NeverExpires || token.Expires.ToTime().After(now)
+}
+
+func makeTokenInfo(token data.AuthToken) *models.TokenInfo {
+	res := &models.TokenInfo{
+		ID:           token.ID,
+		Type:         string(token.Type),
+		Entity:       token.RenderEntity(),
+		RequestedBy:  token.RequestedBy,
+		RequestedOn:  strfmt.DateTime(token.RequestedOn.ToTime()),
+		NeverExpires: token.Expires == data.NeverExpires,
+	}
+	if !res.NeverExpires {
+		res.Expires = strfmt.DateTime(token.Expires.ToTime())
+	}
+	return res
+}
+
+// List the live tokens, the secret keys are never returned
+type ListTokensProcessor struct {
+	ctx context.Context
+	store *data.TokenStore
+	params login.GetTokensListParams
+}
+
+func (l *ListTokensProcessor) Enact() middleware.Responder {
+	now := time.Now()
+	tokens := l.store.ListTokens(func(token data.AuthToken) bool {
+		if !isTokenLive(token, now) {
+			return false
+		}
+		if l.params.Type != "" && string(token.Type) != l.params.Type {
+			return false
+		}
+		if l.params.Entity != "" && token.RenderEntity() != l.params.Entity {
+			return false
+		}
+		return true
+	})
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].RequestedOn < tokens[j].RequestedOn
+	})
+
+	res := make([]*models.TokenInfo, 0, len(tokens))
+	for _, t := range tokens {
+		res = append(res, makeTokenInfo(t))
+	}
+	return login.NewGetTokensListOK().WithPayload(res)
+}
+
+// Revoke a token by its ID, all the tokens of an entity, or all the tokens
+// of an account. The tokens are removed from the store right away, so they
+// stop working with the next request.
+type RevokeTokensProcessor struct {
+	ctx context.Context
+	store *data.TokenStore
+	principal data.AuthToken
+	params login.PostTokensRevokeParams
+}
+
+func (l *RevokeTokensProcessor) respondWithError(code int64, err error) middleware.Responder {
+	logrus.Warnf("Failed to revoke tokens: %+v", err.Error())
+	return login.NewPostTokensRevokeDefault(int(code)).WithPayload(&models.Error{
+		Code: code, Message: err.Error(),
+		RequestID: GetReqIdFromContext(l.ctx)})
+}
+
+func (l *RevokeTokensProcessor) makeFilter() (func(token data.AuthToken) bool, error) {
+	var filter func(token data.AuthToken) bool
+	var numSet = 0
+	if l.params.TokenID != "" {
+		numSet++
+		filter = func(token data.AuthToken) bool {
+			return token.ID == l.params.TokenID
+		}
+	}
+	if l.params.Entity != "" {
+		numSet++
+		filter = func(token data.AuthToken) bool {
+			return token.RenderEntity() == l.params.Entity
+		}
+	}
+	if l.params.Account != "" {
+		numSet++
+		// The account's own tokens and the ones it has given out
+		acct := l.params.Account
+		filter = func(token data.AuthToken) bool {
+			return (token.Type == data.UserToken && token.EntityKey == acct) ||
+				token.RequestedBy == "user/"+acct ||
+				token.RequestedBy == "account/"+acct
+		}
+	}
+	if numSet != 1 {
+		return nil, fmt.Errorf("exactly one of tokenId, entity or account must be set")
+	}
+	return filter, nil
+}
+
+func (l *RevokeTokensProcessor) Enact() middleware.Responder {
+	filter, err := l.makeFilter()
+	if err != nil {
+		return l.respondWithError(http.StatusBadRequest, err)
+	}
+
+	revoked := l.store.ListTokens(filter)
+	if l.params.TokenID != "" && len(revoked) == 0 {
+		return l.respondWithError(http.StatusNotFound,
+			fmt.Errorf("token %s is not found", l.params.TokenID))
+	}
+
+	keys := make(map[string]bool)
+	for _, t := range revoked {
+		keys[t.Key] = true
+	}
+	err = l.store.RevokeTokens(func(token data.AuthToken) bool {
+		return keys[token.Key]
+	})
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err)
+	}
+	CL(l.ctx).Infof("%s has revoked %d tokens", l.principal.RenderEntity(), len(revoked))
+
+	return login.NewPostTokensRevokeOK().WithPayload(&login.PostTokensRevokeOKBody{
+		Revoked: int64(len(revoked)),
+	})
+}
@@ -0,0 +1,89 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/restapi/operations/login"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func listTokens(tokens *data.TokenStore, params login.GetTokensListParams) *login.GetTokensListOK {
+	params.HTTPRequest = httptest.NewRequest("GET", "/tokens/list", nil)
+	lp := ListTokensProcessor{
+		ctx:    params.HTTPRequest.Context(),
+		store:  tokens,
+		params: params,
+	}
+	return lp.Enact().(*login.GetTokensListOK)
+}
+
+func revokeTokens(tokens *data.TokenStore, params login.PostTokensRevokeParams) interface{} {
+	params.HTTPRequest = httptest.NewRequest("POST", "/tokens/revoke", nil)
+	rp := RevokeTokensProcessor{
+		ctx:       params.HTTPRequest.Context(),
+		store:     tokens,
+		principal: data.AuthToken{Type: data.UserToken, EntityKey: "admin"},
+		params:    params,
+	}
+	return rp.Enact()
+}
+
+func TestListAndRevokeTokens(t *testing.T) {
+	tokens, _, _ := makeJoinTestStores()
+	now := time.Now()
+	for _, tok := range []data.AuthToken{
+		{Key: "u1", Type: data.UserToken, EntityKey: "111",
+			Expires: data.FromTime(now.Add(time.Hour)), RequestedBy: "account/111"},
+		{Key: "u2", Type: data.UserToken, EntityKey: "222",
+			Expires: data.FromTime(now.Add(time.Hour)), RequestedBy: "account/222"},
+		{Key: "n1", Type: data.NodeToken, EntityKey: "node1",
+			Expires: data.NeverExpires, RequestedBy: "user/111"},
+		{Key: "old", Type: data.UserToken, EntityKey: "111",
+			Expires: data.FromTime(now.Add(-time.Hour)), RequestedBy: "account/111"},
+	} {
+		assert.NoError(t, tokens.StoreToken(tok))
+	}
+
+	// The expired tokens are not listed, and the keys are never shown
+	all := listTokens(tokens, login.GetTokensListParams{}).Payload
+	assert.Equal(t, 3, len(all))
+	for _, info := range all {
+		assert.NotEqual(t, "", info.ID)
+		for _, key := range []string{"u1", "u2", "n1"} {
+			assert.NotEqual(t, key, info.ID)
+		}
+	}
+
+	nodes := listTokens(tokens, login.GetTokensListParams{Type: data.NodeToken}).Payload
+	assert.Equal(t, 1, len(nodes))
+	assert.Equal(t, "node/node1", nodes[0].Entity)
+	assert.True(t, nodes[0].NeverExpires)
+
+	users := listTokens(tokens, login.GetTokensListParams{Entity: "user/222"}).Payload
+	assert.Equal(t, 1, len(users))
+
+	// Exactly one selector must be set
+	_, ok := revokeTokens(tokens, login.PostTokensRevokeParams{}).(*login.PostTokensRevokeDefault)
+	assert.True(t, ok)
+	_, ok = revokeTokens(tokens, login.PostTokensRevokeParams{TokenID: users[0].ID,
+		Account: "111"}).(*login.PostTokensRevokeDefault)
+	assert.True(t, ok)
+	_, ok = revokeTokens(tokens, login.PostTokensRevokeParams{
+		TokenID: "nope"}).(*login.PostTokensRevokeDefault)
+	assert.True(t, ok)
+
+	// Revoke by ID, the token stops working right away
+	res := revokeTokens(tokens, login.PostTokensRevokeParams{
+		TokenID: users[0].ID}).(*login.PostTokensRevokeOK)
+	assert.Equal(t, int64(1), res.Payload.Revoked)
+	_, ok = tokens.GetTokenByKey("u2")
+	assert.False(t, ok)
+
+	// Revoke the account: its own tokens and the node token it has requested
+	res = revokeTokens(tokens, login.PostTokensRevokeParams{
+		Account: "111"}).(*login.PostTokensRevokeOK)
+	assert.Equal(t, int64(3), res.Payload.Revoked)
+	assert.Equal(t, 0, len(tokens.ListTokens(nil)))
+}
@@ -136,7 +136,7 @@ func (l *GetNodeTokenProcessor) Enact() middleware.Responder {
 		RequestedBy: l.principal.RenderEntity(),
 		RequestedOn: data.FromTime(time.Now()),
 	}
-	CL(l.ctx).Infof("Storing token: %s", token.String())
+	CL(l.ctx).Infof("Storing a token for %s", token.RenderEntity())
 
 	err := l.store.StoreToken(token)
 	if err != nil {
@@ -149,3 +149,130 @@ func (l *GetNodeTokenProcessor) Enact() middleware.Responder {
 	}
 	return login.NewGetNodeTokenOK().WithPayload(&greeting)
 }
+
+
+const DefaultJoinTokenTTL = time.Hour
+const MaxJoinTokenTTL = 7 * 24 * time.Hour
+
+// Create a single-use token that allows a runner to join the queue
+type CreateJoinTokenProcessor struct {
+	ctx context.Context
+	store *data.TokenStore
+	queueStore *data.QueueStore
+	principal data.AuthToken
+	params login.PostJoinTokenParams
+}
+
+func (l *CreateJoinTokenProcessor) respondWithError(code int64, err error) middleware.Responder {
+	logrus.Warnf("Failed to create a join token: %+v", err.Error())
+	return login.NewPostJoinTokenDefault(int(code)).WithPayload(&models.Error{
+		Code: code, Message: err.Error(),
+		RequestID: GetReqIdFromContext(l.ctx)})
+}
+
+func (l *CreateJoinTokenProcessor) Enact() middleware.Responder {
+	if l.principal.Type != data.UserToken {
+		return l.respondWithError(http.StatusForbidden,
+			fmt.Errorf("only users can create join tokens"))
+	}
+	if len(l.queueStore.ListQueues([]string{l.params.Queue})) == 0 {
+		return l.respondWithError(http.StatusNotFound,
+			fmt.Errorf("queue %s is not found", l.params.Queue))
+	}
+
+	ttl := DefaultJoinTokenTTL
+	if l.params.TTLSeconds != nil {
+		ttl = time.Duration(*l.params.TTLSeconds) * time.Second
+	}
+	if ttl > MaxJoinTokenTTL {
+		return l.respondWithError(http.StatusBadRequest,
+			fmt.Errorf("the join token can't be valid for longer than %s",
+				MaxJoinTokenTTL.String()))
+	}
+
+	now := time.Now()
+	token := data.AuthToken{
+		Key:         *GenerateRandIdSized(16),
+		Expires:     data.FromTime(now.Add(ttl)),
+		Type:        data.JoinToken,
+		EntityKey:   l.params.Queue,
+		RequestedBy: l.principal.RenderEntity(),
+		RequestedOn: data.FromTime(now),
+	}
+	err := l.store.StoreToken(token)
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err)
+	}
+	CL(l.ctx).Infof("Created a join token for queue %s, valid until %s",
+		l.params.Queue, token.Expires.ToTime().String())
+
+	return login.NewPostJoinTokenOK().WithPayload(&login.PostJoinTokenOKBody{
+		JoinToken: token.Key,
+		Expires:   strfmt.DateTime(token.Expires.ToTime()),
+	})
+}
+
+
+// Trade a join token for a new unmanaged node and its token
+type JoinNodeProcessor struct {
+	ctx context.Context
+	store *data.TokenStore
+	nodeStore *data.NodeStore
+	queueStore *data.QueueStore
+	serverCert string
+	params login.PostJoinParams
+}
+
+func (l *JoinNodeProcessor) respondWithError(code int64, err error) middleware.Responder {
+	logrus.Warnf("Failed to join a node: %+v", err.Error())
+	return login.NewPostJoinDefault(int(code)).WithPayload(&models.Error{
+		Code: code, Message: err.Error(),
+		RequestID: GetReqIdFromContext(l.ctx)})
+}
+
+func (l *JoinNodeProcessor) Enact() middleware.Responder {
+	CL(l.ctx).Infof("Invoking JoinNodeProcessor")
+
+	// Don't tell the caller why the token is not accepted
+	invalidToken := fmt.Errorf("the join token is invalid or expired")
+	joinToken, ok := l.store.GetTokenByKey(l.params.JoinToken)
+	if !ok || joinToken.Type != data.JoinToken ||
+		joinToken.Expires.ToTime().Before(time.Now()) {
+		return l.respondWithError(http.StatusUnauthorized, invalidToken)
+	}
+
+	// The token is used up even if the node can't be created
+	joinToken, ok, err := l.store.ConsumeToken(l.params.JoinToken)
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err)
+	}
+	if !ok {
+		// Somebody has used it concurrently
+		return l.respondWithError(http.StatusUnauthorized, invalidToken)
+	}
+
+	newNode, err := registerUnmanagedNode(l.queueStore, l.nodeStore, joinToken.EntityKey)
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err)
+	}
+
+	token := data.AuthToken{
+		Key:         *GenerateRandIdSized(16),
+		Expires:     data.NeverExpires, // Node tokens are reaped once the node dies
+		Type:        data.NodeToken,
+		EntityKey:   newNode.Key,
+		RequestedBy: joinToken.RequestedBy,
+		RequestedOn: data.FromTime(time.Now()),
+	}
+	err = l.store.StoreToken(token)
+	if err != nil {
+		return l.respondWithError(http.StatusInternalServerError, err)
+	}
+	CL(l.ctx).Infof("Node %s has joined queue %s", newNode.Key, newNode.Queue)
+
+	return login.NewPostJoinOK().WithPayload(&login.PostJoinOKBody{
+		NodeID:      newNode.Key,
+		AuthToken:   token.Key,
+		Certificate: l.serverCert,
+	})
+}
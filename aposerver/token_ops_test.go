@@ -0,0 +1,124 @@
+package aposerver
+
+import (
+	"apollo/data"
+	"apollo/proto/gen/models"
+	"apollo/proto/gen/restapi/operations/login"
+	"apollo/proto/gen/restapi/operations/node"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func makeJoinTestStores() (*data.TokenStore, *data.QueueStore, *data.NodeStore) {
+	store, _, ns := makeTestStores()
+	store.InitSchema(map[string]int64{data.TokenStoreTable: 5})
+	qs := data.NewQueueStore(store)
+	qs.StoreQueue(&data.StoredQueue{Key: "q1", Queue: models.Queue{Name: "q1"}})
+	return data.NewTokenStore(store), qs, ns
+}
+
+func createJoinToken(tokens *data.TokenStore, qs *data.QueueStore,
+	principal data.AuthToken, queue string) interface{} {
+
+	req := httptest.NewRequest("POST", "/join-token", nil)
+	jp := CreateJoinTokenProcessor{
+		ctx:        req.Context(),
+		store:      tokens,
+		queueStore: qs,
+		principal:  principal,
+		params:     login.PostJoinTokenParams{HTTPRequest: req, Queue: queue},
+	}
+	return jp.Enact()
+}
+
+func joinNode(tokens *data.TokenStore, qs *data.QueueStore, ns *data.NodeStore,
+	joinToken string) interface{} {
+
+	req := httptest.NewRequest("POST", "/join", nil)
+	jp := JoinNodeProcessor{
+		ctx:        req.Context(),
+		store:      tokens,
+		nodeStore:  ns,
+		queueStore: qs,
+		serverCert: "cert",
+		params:     login.PostJoinParams{HTTPRequest: req, JoinToken: joinToken},
+	}
+	return jp.Enact()
+}
+
+func TestJoinToken(t *testing.T) {
+	tokens, qs, ns := makeJoinTestStores()
+	user := data.AuthToken{Type: data.UserToken, EntityKey: "123456"}
+
+	// Only users can create the join tokens, and only for the existing queues
+	_, ok := createJoinToken(tokens, qs, data.AuthToken{Type: data.NodeToken,
+		EntityKey: "n1"}, "q1").(*login.PostJoinTokenDefault)
+	assert.True(t, ok)
+	_, ok = createJoinToken(tokens, qs, user, "nope").(*login.PostJoinTokenDefault)
+	assert.True(t, ok)
+
+	res, ok := createJoinToken(tokens, qs, user, "q1").(*login.PostJoinTokenOK)
+	assert.True(t, ok)
+	joinToken := res.Payload.JoinToken
+
+	joined, ok := joinNode(tokens, qs, ns, joinToken).(*login.PostJoinOK)
+	assert.True(t, ok)
+	nodeId := joined.Payload.NodeID
+	assert.Equal(t, "cert", joined.Payload.Certificate)
+
+	nodes := ns.ListNodes([]string{nodeId}, nil)
+	assert.Equal(t, 1, len(nodes))
+	assert.Equal(t, "q1", nodes[0].Queue)
+	assert.False(t, nodes[0].Managed)
+	assert.Equal(t, models.NodeStateEnumInitializing, nodes[0].State)
+
+	nodeToken, ok := tokens.GetTokenByKey(joined.Payload.AuthToken)
+	assert.True(t, ok)
+	assert.Equal(t, data.TokenType(data.NodeToken), nodeToken.Type)
+	assert.Equal(t, nodeId, nodeToken.EntityKey)
+	assert.Equal(t, data.AbsoluteTime(data.NeverExpires), nodeToken.Expires)
+	assert.Equal(t, "user/123456", nodeToken.RequestedBy)
+
+	// The join token is single-use
+	_, ok = joinNode(tokens, qs, ns, joinToken).(*login.PostJoinDefault)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(ns.ListNodes(nil, nil)))
+
+	// Other tokens can't be used to join
+	_, ok = joinNode(tokens, qs, ns, joined.Payload.AuthToken).(*login.PostJoinDefault)
+	assert.True(t, ok)
+	_, ok = tokens.GetTokenByKey(joined.Payload.AuthToken)
+	assert.True(t, ok)
+
+	// Expired tokens are rejected
+	assert.NoError(t, tokens.StoreToken(data.AuthToken{
+		Key:       "expired",
+		Type:      data.JoinToken,
+		EntityKey: "q1",
+		Expires:   data.FromTime(time.Now().Add(-time.Minute)),
+	}))
+	_, ok = joinNode(tokens, qs, ns, "expired").(*login.PostJoinDefault)
+	assert.True(t, ok)
+}
+
+func TestPutUnmanagedNode(t *testing.T) {
+	_, qs, ns := makeJoinTestStores()
+
+	req := httptest.NewRequest("PUT", "/unmanaged-node", nil)
+	pp := PutUnmanagedNodeProcessor{
+		ctx:        req.Context(),
+		store:      ns,
+		queueStore: qs,
+		principal:  data.AuthToken{Type: data.UserToken, EntityKey: "123456"},
+		params: node.PutUnmanagedNodeParams{HTTPRequest: req,
+			Node: node.PutUnmanagedNodeBody{Queue: "q1"}},
+	}
+	res, ok := pp.Enact().(*node.PutUnmanagedNodeOK)
+	assert.True(t, ok)
+
+	nodes := ns.ListNodes([]string{res.Payload.NodeID}, nil)
+	assert.Equal(t, 1, len(nodes))
+	assert.Equal(t, "q1", nodes[0].Queue)
+}
@@ -46,15 +46,21 @@ func main() {
 	// Login
 	rootCmd.AddCommand(apoclient.MakeLoginCmd())
 	rootCmd.AddCommand(apoclient.MakeGetNodeTokenCmd())
+	rootCmd.AddCommand(apoclient.MakeCreateJoinTokenCmd())
 	rootCmd.AddCommand(apoclient.MakePingCmd())
+	rootCmd.AddCommand(apoclient.MakeTokensCmd())
 	// Task
 	rootCmd.AddCommand(apoclient.MakeSubmitCmd())
+	rootCmd.AddCommand(apoclient.MakeCancelCmd())
 	rootCmd.AddCommand(apoclient.MakeListCmd())
 	rootCmd.AddCommand(apoclient.MakeDescribeCommand())
+	rootCmd.AddCommand(apoclient.MakeLogsCmd())
 	// Queue
 	rootCmd.AddCommand(apoclient.MakeQueueListCmd())
 	rootCmd.AddCommand(apoclient.MakePutQueueCommand())
 	rootCmd.AddCommand(apoclient.MakeDeleteQueueCommand())
+	// Nodes
+	rootCmd.AddCommand(apoclient.MakeDrainNodeCommand())
 
 	err := rootCmd.Execute()
 	if err != nil {
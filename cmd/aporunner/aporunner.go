@@ -8,13 +8,17 @@ import (
 	"apollo/proto/gen/restcli/login"
 	"apollo/utils"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/docker/docker/client"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"io/ioutil"
 	"net"
 	"os"
+	"path"
+	"strings"
 	"time"
 )
 
@@ -46,34 +50,79 @@ func SdNotify(state string) error {
 }
 
 
-func connectRunner(cmd *cobra.Command) (*restcli.Apollo, error) {
-	host := utils.GetFlagS(cmd, "host")
-	var tokenStr string
-	if host != "" {
-		// Do the SigV4 login flow
-		v4Res, err := apoclient.SendSigv4Auth(utils.GetFlagS(cmd, "profile"), host)
-		if err != nil {
-			return nil, err
+// Trade the join token for the node identity, it's saved so that the runner
+// can restart (the join token can be used only once).
+func joinQueue(joinStr, stateFile string) (string, string, error) {
+	state, err := ioutil.ReadFile(stateFile)
+	if err == nil {
+		logrus.Infof("The node has already joined, using the identity from %s", stateFile)
+		lines := strings.SplitN(string(state), "\n", 2)
+		if len(lines) != 2 {
+			return "", "", fmt.Errorf("the node state file %s is corrupted", stateFile)
 		}
-		tokenStr = host + "#" + v4Res.AuthToken + "#" + v4Res.ServerCert
-	} else {
+		return lines[0], strings.TrimSpace(lines[1]), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", "", err
+	}
+
+	res, err := apoclient.DoJoin(joinStr)
+	if err != nil {
+		return "", "", err
+	}
+	logrus.Infof("Joined as node %s", res.NodeID)
+
+	tokenStr := res.ServerUrl + "#" + res.AuthToken + "#" + res.ServerCert
+	err = os.MkdirAll(path.Dir(stateFile), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(stateFile, []byte(res.NodeID+"\n"+tokenStr+"\n"), 0600)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to save the node identity: %s", err.Error())
+	}
+	return res.NodeID, tokenStr, nil
+}
+
+func connectRunner(cmd *cobra.Command, tokenStr string) (*restcli.Apollo,
+	aporunner.ServerEndpoint, error) {
+
+	host := utils.GetFlagS(cmd, "host")
+	if tokenStr == "" {
 		// Obtain connection from the environment
 		tokenStr = os.Getenv(apoclient.ApolloConnectionKey)
-		if tokenStr == "" {
-			return nil, fmt.Errorf("there's no APOLLO_CONNECTION environment variable and host is not specified")
+	}
+	if host != "" || tokenStr == "" {
+		// Do the SigV4 login flow. If the host is not specified, it's discovered
+		// from the user data of the managed node and the instance profile
+		// credentials are used (unless the profile is set explicitly).
+		profile := utils.GetFlagS(cmd, "profile")
+		if host == "" && !cmd.Flags().Changed("profile") {
+			profile = ""
 		}
+		v4Res, err := apoclient.SendSigv4Auth(profile, host, "")
+		if err != nil {
+			return nil, aporunner.ServerEndpoint{}, fmt.Errorf(
+				"there's no APOLLO_CONNECTION environment "+
+				"variable and the SigV4 login has failed: %s", err.Error())
+		}
+		tokenStr = v4Res.ServerUrl + "#" + v4Res.AuthToken + "#" + v4Res.ServerCert
 	}
 
 	info, err := apoclient.DecodeTokenString(tokenStr)
 	if err != nil {
-		return nil, err
+		return nil, aporunner.ServerEndpoint{}, err
 	}
 
 	apollo, err := apoclient.MakeConnection(info)
 	if err != nil {
-		return nil, err
+		return nil, aporunner.ServerEndpoint{}, err
+	}
+	// The tasks connect to the same server as the runner
+	server := aporunner.ServerEndpoint{
+		Host: info.Host,
+		Cert: base64.StdEncoding.EncodeToString(info.ServerCert.Raw),
 	}
-	return apollo, nil
+	return apollo, server, nil
 }
 
 func main() {
@@ -100,9 +149,27 @@ func main() {
 			}
 			logrus.Info("Docker connection is operable")
 
+			apoclient.MetadataUrl = utils.GetFlagS(cmd, "metadata-url")
+			nodeId := utils.GetFlagS(cmd, "node-id")
+			var tokenStr string
+			if joinStr := utils.GetFlagS(cmd, "join"); joinStr != "" {
+				nodeId, tokenStr, err = joinQueue(joinStr, utils.GetFlagS(cmd, "node-state-file"))
+				if err != nil {
+					return err
+				}
+			}
+			if nodeId == "" {
+				// The managed nodes are identified by their instance IDs
+				nodeId, err = apoclient.LookupInstanceId()
+				if err != nil {
+					logrus.Warnf("The node ID is not specified and can't be " +
+						"discovered from the instance metadata: %s", err.Error())
+				}
+			}
+
 			// Connect to Apollo
 			logrus.Info("Connecting to Apollo")
-			apollo, err := connectRunner(cmd)
+			apollo, server, err := connectRunner(cmd, tokenStr)
 			if err != nil {
 				return err
 			}
@@ -115,8 +182,10 @@ func main() {
 			logrus.Info("Apollo connection is operable")
 
 			logrus.Info("Running the server")
-			ctx := aporunner.NewRunnerContext(apollo, dockerCli,
-				time.Duration(utils.GetFlagI(cmd, "suicide-delay-sec"))*time.Second)
+			logs := aporunner.NewLogCollector(utils.GetFlagS(cmd, "log-dir"),
+				utils.GetFlagI(cmd, "max-log-size-mb")*1024*1024)
+			ctx := aporunner.NewRunnerContext(nodeId, apollo, server, dockerCli,
+				logs, time.Duration(utils.GetFlagI(cmd, "suicide-delay-sec"))*time.Second)
 
 			// All is OK - notify systemd (if it's used)
 			if err = SdNotifyReady(); err != SdNotifyNoSocketErr {
@@ -132,8 +201,21 @@ func main() {
 	runnerCmd.PersistentFlags().BoolP("verbose", "v", false, "Verbose output")
 	runnerCmd.PersistentFlags().StringP("profile", "p", "default", "AWS profile")
 	runnerCmd.PersistentFlags().StringP("host", "s", "", "Server's host and port")
+	runnerCmd.PersistentFlags().StringP("node-id", "n", "", "The ID of this node, " +
+		"the EC2 instance ID is used by default")
+	runnerCmd.PersistentFlags().String("join", "", "The join token from " +
+		"'apollo create-join-token', the node joins its queue as an unmanaged node")
+	runnerCmd.PersistentFlags().String("node-state-file", "/var/lib/apollo/node-identity",
+		"The file for the node identity obtained with the join token")
+	runnerCmd.PersistentFlags().String("metadata-url", apoclient.DefaultMetadataUrl,
+		"The EC2 metadata endpoint used to discover the server and the node ID")
 	runnerCmd.PersistentFlags().Int64("suicide-delay-sec", 2000, "The node suicide delay " +
 		"if the connection is lost")
+	runnerCmd.PersistentFlags().String("log-dir", aporunner.DefaultLogDir,
+		"The directory for the task logs")
+	runnerCmd.PersistentFlags().Int64("max-log-size-mb",
+		aporunner.DefaultMaxLogFileSize/(1024*1024), "The maximum size of a task log " +
+		"file, the log is rotated when it's exceeded")
 
 	// Run the cmdline parser
 	if err := runnerCmd.Execute(); err != nil {
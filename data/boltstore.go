@@ -0,0 +1,212 @@
+package data
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"reflect"
+	"time"
+)
+
+// The store backed by an embedded bbolt database file, for the single-host
+// deployments that need durable state without AWS. Each table is a bucket
+// with the JSON-encoded values stored under their keys.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	// Don't hang forever if another server holds the database
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, NewStoreError("failed to open the database "+path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+func (bs *BoltStore) getBucket(tx *bolt.Tx, table string) (*bolt.Bucket, error) {
+	bucket := tx.Bucket([]byte(table))
+	if bucket == nil {
+		return nil, fmt.Errorf("table %s doesn't exist", table)
+	}
+	return bucket, nil
+}
+
+func (bs *BoltStore) StoreValues(table string, data interface{}) (error, map[string]bool) {
+	val := reflect.ValueOf(data)
+	if val.Kind() != reflect.Array && val.Kind() != reflect.Slice {
+		panic("A slice or an array is expected")
+	}
+
+	// The values are written in one transaction, so either all of them
+	// are stored or none.
+	var success = make(map[string]bool)
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := bs.getBucket(tx, table)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < val.Len(); i++ {
+			value := val.Index(i)
+			key := value.FieldByName("Key").String()
+
+			bytes, err := json.Marshal(value.Interface())
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(key), bytes)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err, success
+	}
+
+	for i := 0; i < val.Len(); i++ {
+		success[val.Index(i).FieldByName("Key").String()] = true
+	}
+	return nil, success
+}
+
+func (bs *BoltStore) StoreValue(table string, value interface{},
+	expectedVersion int64) error {
+
+	key, _ := getKeyAndVersion(value)
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	// The read and the write are in the same transaction, bbolt has only
+	// one writer at a time.
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := bs.getBucket(tx, table)
+		if err != nil {
+			return err
+		}
+
+		var curVersion int64
+		cur := bucket.Get([]byte(key))
+		if cur != nil {
+			curVersion, err = getDocVersion(cur)
+			if err != nil {
+				return err
+			}
+		}
+		if curVersion != expectedVersion || (cur == nil && expectedVersion != 0) {
+			return &VersionConflictError{Table: table, Key: key,
+				ExpectedVersion: expectedVersion}
+		}
+		return bucket.Put([]byte(key), bytes)
+	})
+}
+
+func (bs *BoltStore) DeleteValue(table string, key string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := bs.getBucket(tx, table)
+		if err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (bs *BoltStore) GetValue(table string, key string, output interface{}) (bool, error) {
+	var found bool
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket, err := bs.getBucket(tx, table)
+		if err != nil {
+			return err
+		}
+		value := bucket.Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, output)
+	})
+	return found, err
+}
+
+func (bs *BoltStore) LoadTable(table string, output interface{}) error {
+	outputVal := reflect.ValueOf(output)
+	if outputVal.Kind() != reflect.Ptr || reflect.Indirect(outputVal).Kind() != reflect.Slice {
+		panic("Was expecting a pointer to a slice")
+	}
+
+	sliceType := reflect.Indirect(outputVal).Type()
+	result := reflect.MakeSlice(sliceType, 0, 0)
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket, err := bs.getBucket(tx, table)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var res = reflect.New(sliceType.Elem())
+			err := json.Unmarshal(v, res.Interface())
+			if err != nil {
+				return err
+			}
+			result = reflect.Append(result, reflect.Indirect(res))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	outputVal.Elem().Set(result)
+	return nil
+}
+
+// The counters are incremented in a transaction, so unlike the DDB store
+// there's no need to allocate them in blocks.
+func (bs *BoltStore) GetCounter(counterName string) (int64, error) {
+	var res int64
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := bs.getBucket(tx, counterTableName)
+		if err != nil {
+			return err
+		}
+
+		res = 1
+		cur := bucket.Get([]byte(counterName))
+		if cur != nil {
+			res = int64(binary.BigEndian.Uint64(cur)) + 1
+		}
+
+		var next [8]byte
+		binary.BigEndian.PutUint64(next[:], uint64(res))
+		return bucket.Put([]byte(counterName), next[:])
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res, nil
+}
+
+// Create the missing tables, the existing ones are kept intact
+func (bs *BoltStore) InitSchema(tables map[string]int64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(counterTableName))
+		if err != nil {
+			return err
+		}
+		for k := range tables {
+			_, err = tx.CreateBucketIfNotExists([]byte(k))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,85 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dbFile := path.Join(dir, "apollo.db")
+
+	store, err := NewBoltStore(dbFile)
+	assert.NoError(t, err)
+	assert.NoError(t, store.InitSchema(map[string]int64{"table1": 100, "table2": 200}))
+
+	numItems := 1000
+	allData := make([]TestTaskData, numItems)
+	for i := 0; i < numItems; i++ {
+		allData[i] = TestTaskData{
+			Key:           "key" + strconv.Itoa(i),
+			Cmd:           "cmd--" + strconv.Itoa(i),
+			Env:           map[string]string{"env1": "env2"},
+			TimeoutMillis: int64(i),
+		}
+	}
+	err, stored := store.StoreValues("table1", allData)
+	assert.NoError(t, err)
+	assert.Equal(t, numItems, len(stored))
+	assert.NoError(t, store.DeleteValue("table1", "key1"))
+	// Deleting a missing value is a no-op
+	assert.NoError(t, store.DeleteValue("table1", "key1"))
+
+	for i := 0; i < 10; i++ {
+		counter, err := store.GetCounter("tasks")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i+1), counter)
+	}
+
+	// Unknown tables are errors
+	var data []TestTaskData
+	assert.Error(t, store.LoadTable("nope", &data))
+	err, _ = store.StoreValues("nope", allData)
+	assert.Error(t, err)
+
+	// Everything survives the restart, including the counters
+	assert.NoError(t, store.Close())
+	store, err = NewBoltStore(dbFile)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.InitSchema(map[string]int64{"table1": 100}))
+
+	assert.NoError(t, store.LoadTable("table1", &data))
+	assert.Equal(t, numItems-1, len(data))
+	for _, d := range data {
+		assert.NotEqual(t, "key1", d.Key)
+		if d.Key == "key5" {
+			assert.Equal(t, allData[5], d)
+		}
+	}
+
+	counter, err := store.GetCounter("tasks")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), counter)
+	counter, err = store.GetCounter("jobs")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), counter)
+}
+
+func TestBoltStoreConditionalWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(path.Join(dir, "apollo.db"))
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.InitSchema(map[string]int64{"table1": 100}))
+	checkConditionalWrites(t, store)
+}
@@ -1,5 +1,10 @@
 package data
 
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
 
 type StoreError interface {
 	error
@@ -37,3 +42,61 @@ func (e storeError) OrigErr() error {
 func NewStoreError(message string, orig error) StoreError {
 	return storeError{message: message, origErr: orig}
 }
+
+// Returned by the conditional writes if the stored value has a different
+// version than expected, i.e. somebody else has modified it.
+type VersionConflictError struct {
+	Table string
+	Key string
+	ExpectedVersion int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return "version conflict in " + e.Table + "/" + e.Key + ", expected version " +
+		strconv.FormatInt(e.ExpectedVersion, 10)
+}
+
+// Returned by the batch writes that attempt all the values, contains the
+// errors by the keys of the values that failed.
+type BatchError struct {
+	Errors map[string]error
+}
+
+func (e *BatchError) Error() string {
+	var keys []string
+	for k := range e.Errors {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var msgs []string
+	for _, k := range keys {
+		msgs = append(msgs, k+": "+e.Errors[k].Error())
+	}
+	return "failed to write " + strconv.Itoa(len(keys)) + " values: " +
+		strings.Join(msgs, "; ")
+}
+
+// Check if the error (possibly wrapped into StoreError) is a version
+// conflict, or a batch error with at least one conflict
+func IsVersionConflict(err error) bool {
+	for err != nil {
+		if _, ok := err.(*VersionConflictError); ok {
+			return true
+		}
+		if be, ok := err.(*BatchError); ok {
+			for _, e := range be.Errors {
+				if IsVersionConflict(e) {
+					return true
+				}
+			}
+			return false
+		}
+		se, ok := err.(StoreError)
+		if !ok {
+			return false
+		}
+		err = se.OrigErr()
+	}
+	return false
+}
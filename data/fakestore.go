@@ -38,6 +38,38 @@ func (fs *FakeMemStore) StoreValues(tableName string, data interface{}) (error,
 	return nil, success
 }
 
+func (fs *FakeMemStore) StoreValue(tableName string, value interface{},
+	expectedVersion int64) error {
+
+	fs.theMutex.Lock()
+	defer fs.theMutex.Unlock()
+
+	key, _ := getKeyAndVersion(value)
+	table := fs.data[tableName]
+
+	// Compare-and-swap under the store's lock
+	var curVersion int64
+	cur, exists := table[key]
+	if exists {
+		var err error
+		curVersion, err = getDocVersion([]byte(cur))
+		if err != nil {
+			return err
+		}
+	}
+	if curVersion != expectedVersion || (!exists && expectedVersion != 0) {
+		return &VersionConflictError{Table: tableName, Key: key,
+			ExpectedVersion: expectedVersion}
+	}
+
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	table[key] = string(bytes)
+	return nil
+}
+
 func (fs *FakeMemStore) DeleteValue(table string, key string) error {
 	fs.theMutex.Lock()
 	defer fs.theMutex.Unlock()
@@ -45,6 +77,17 @@ func (fs *FakeMemStore) DeleteValue(table string, key string) error {
 	return nil
 }
 
+func (fs *FakeMemStore) GetValue(table string, key string, output interface{}) (bool, error) {
+	fs.theMutex.Lock()
+	defer fs.theMutex.Unlock()
+
+	value, ok := fs.data[table][key]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal([]byte(value), output)
+}
+
 func (fs *FakeMemStore) LoadTable(table string, output interface{}) error {
 	fs.theMutex.Lock()
 	defer fs.theMutex.Unlock()
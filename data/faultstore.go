@@ -0,0 +1,272 @@
+package data
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type StoreOp string
+
+const (
+	OpStoreValues StoreOp = "StoreValues"
+	OpStoreValue  StoreOp = "StoreValue"
+	OpDeleteValue StoreOp = "DeleteValue"
+	OpGetValue    StoreOp = "GetValue"
+	OpLoadTable   StoreOp = "LoadTable"
+	OpGetCounter  StoreOp = "GetCounter"
+)
+
+type FaultType int
+
+const (
+	// The call fails without touching the data
+	FaultFail FaultType = iota
+	// The call is performed, but a failure is reported anyway (e.g. the
+	// connection dropped before the response arrived)
+	FaultAppliedButFailed
+	// Only the first half of a StoreValues batch is written, the rest is
+	// reported as unprocessed. Works like FaultFail for the other calls.
+	FaultPartialWrite
+	// The call only gets the rule's latency
+	FaultDelay
+)
+
+// A rule of the FaultyStore. The rules are checked in order for each call,
+// the delay rules add their latency and the first other rule that fires
+// decides the outcome of the call.
+type FaultRule struct {
+	// The calls the rule applies to, empty means all of them
+	Ops []StoreOp
+	// The table the rule applies to, empty means all of them. The counter
+	// name is used as the table for GetCounter.
+	Table string
+
+	Fault FaultType
+	// The error to return, InjectedFaultError by default
+	Err error
+	// Mark the default error as ambiguous, so that the write recovery
+	// treats it as a timeout
+	Ambiguous bool
+
+	// The latency added to the call, plus a random jitter up to LatencyJitter
+	Latency       time.Duration
+	LatencyJitter time.Duration
+
+	// The chance of firing for each matching call, zero means every call
+	Probability float64
+	// Skip this many matching calls before firing
+	Skip int
+	// Fire at most this many times, zero means no limit
+	Times int
+
+	matched, fired int
+}
+
+func (r *FaultRule) matches(op StoreOp, table string) bool {
+	if r.Table != "" && r.Table != table {
+		return false
+	}
+	if len(r.Ops) == 0 {
+		return true
+	}
+	for _, o := range r.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+type InjectedFaultError struct {
+	Op          StoreOp
+	Table       string
+	IsAmbiguous bool
+}
+
+func (e *InjectedFaultError) Error() string {
+	return fmt.Sprintf("injected fault in %s for %s", e.Op, e.Table)
+}
+
+func (e *InjectedFaultError) Ambiguous() bool {
+	return e.IsAmbiguous
+}
+
+// The decorator that injects faults and latency into the calls of the wrapped
+// store, for testing the server against an unreliable database and for
+// simulating a remote database during the local development. The random
+// decisions use a seeded source, so the runs are reproducible.
+type FaultyStore struct {
+	store KVStore
+
+	mutex    sync.Mutex
+	random   *rand.Rand
+	rules    []*FaultRule
+	injected int
+}
+
+func NewFaultyStore(store KVStore, seed int64) *FaultyStore {
+	return &FaultyStore{
+		store:  store,
+		random: rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (fs *FaultyStore) AddRule(rule FaultRule) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.rules = append(fs.rules, &rule)
+}
+
+func (fs *FaultyStore) ClearRules() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.rules = nil
+}
+
+// The number of the calls that got a fault (not counting the delays)
+func (fs *FaultyStore) InjectedFaults() int {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.injected
+}
+
+func (fs *FaultyStore) Close() error {
+	if closer, ok := fs.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Find the fault for the call and sleep for the latency. Returns nil if
+// the call should proceed normally.
+func (fs *FaultyStore) pickFault(op StoreOp, table string) *FaultRule {
+	var latency time.Duration
+	var fault *FaultRule
+
+	fs.mutex.Lock()
+	for _, r := range fs.rules {
+		if !r.matches(op, table) {
+			continue
+		}
+		r.matched++
+		if r.matched <= r.Skip || (r.Times != 0 && r.fired >= r.Times) {
+			continue
+		}
+		if r.Probability != 0 && fs.random.Float64() >= r.Probability {
+			continue
+		}
+		r.fired++
+
+		latency += r.Latency
+		if r.LatencyJitter > 0 {
+			latency += time.Duration(fs.random.Int63n(int64(r.LatencyJitter)))
+		}
+		if r.Fault != FaultDelay {
+			fs.injected++
+			fault = r
+			break
+		}
+	}
+	fs.mutex.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return fault
+}
+
+func (fs *FaultyStore) faultError(rule *FaultRule, op StoreOp, table string) error {
+	if rule.Err != nil {
+		return rule.Err
+	}
+	return &InjectedFaultError{Op: op, Table: table, IsAmbiguous: rule.Ambiguous}
+}
+
+// Run the call according to the fault
+func (fs *FaultyStore) inject(op StoreOp, table string, call func() error) error {
+	fault := fs.pickFault(op, table)
+	if fault == nil {
+		return call()
+	}
+	if fault.Fault == FaultAppliedButFailed {
+		_ = call()
+	}
+	return fs.faultError(fault, op, table)
+}
+
+func (fs *FaultyStore) StoreValues(table string, data interface{}) (error, map[string]bool) {
+	fault := fs.pickFault(OpStoreValues, table)
+	if fault == nil {
+		return fs.store.StoreValues(table, data)
+	}
+
+	switch fault.Fault {
+	case FaultAppliedButFailed:
+		_, success := fs.store.StoreValues(table, data)
+		return fs.faultError(fault, OpStoreValues, table), success
+	case FaultPartialWrite:
+		val := reflect.ValueOf(data)
+		err, success := fs.store.StoreValues(table, val.Slice(0, val.Len()/2).Interface())
+		if err != nil {
+			return err, success
+		}
+		return fs.faultError(fault, OpStoreValues, table), success
+	default:
+		return fs.faultError(fault, OpStoreValues, table), map[string]bool{}
+	}
+}
+
+func (fs *FaultyStore) StoreValue(table string, value interface{},
+	expectedVersion int64) error {
+
+	return fs.inject(OpStoreValue, table, func() error {
+		return fs.store.StoreValue(table, value, expectedVersion)
+	})
+}
+
+func (fs *FaultyStore) DeleteValue(table string, key string) error {
+	return fs.inject(OpDeleteValue, table, func() error {
+		return fs.store.DeleteValue(table, key)
+	})
+}
+
+func (fs *FaultyStore) GetValue(table string, key string, output interface{}) (bool, error) {
+	var found bool
+	err := fs.inject(OpGetValue, table, func() error {
+		var err error
+		found, err = fs.store.GetValue(table, key, output)
+		return err
+	})
+	return found, err
+}
+
+func (fs *FaultyStore) LoadTable(table string, output interface{}) error {
+	return fs.inject(OpLoadTable, table, func() error {
+		return fs.store.LoadTable(table, output)
+	})
+}
+
+func (fs *FaultyStore) GetCounter(counterName string) (int64, error) {
+	var res int64
+	err := fs.inject(OpGetCounter, counterName, func() error {
+		var err error
+		res, err = fs.store.GetCounter(counterName)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res, nil
+}
+
+func (fs *FaultyStore) NormalizeValue(value interface{}, output interface{}) error {
+	return normalizeValue(fs.store, value, output)
+}
+
+func (fs *FaultyStore) InitSchema(tables map[string]int64) error {
+	return fs.store.InitSchema(tables)
+}
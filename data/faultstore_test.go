@@ -0,0 +1,100 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func makeTestFaultyStore(seed int64) (*FakeMemStore, *FaultyStore) {
+	mem := NewFakeMemStore()
+	mem.InitSchema(map[string]int64{QueueTable: 5, NodeTable: 5})
+	return mem, NewFaultyStore(mem, seed)
+}
+
+func TestFaultRules(t *testing.T) {
+	mem, fs := makeTestFaultyStore(1)
+	queues := []StoredQueue{{Key: "q1"}, {Key: "q2"}, {Key: "q3"}}
+
+	// Skip the first write of the queue table, then fail the next two
+	fs.AddRule(FaultRule{Ops: []StoreOp{OpStoreValues}, Table: QueueTable,
+		Skip: 1, Times: 2})
+	err, _ := fs.StoreValues(QueueTable, queues[:1])
+	assert.NoError(t, err)
+	err, _ = fs.StoreValues(NodeTable, []StoredNode{{Key: "n1"}})
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		err, success := fs.StoreValues(QueueTable, queues[1:])
+		assert.Error(t, err)
+		assert.Equal(t, 0, len(success))
+		assert.False(t, IsAmbiguousWriteError(err))
+	}
+	err, _ = fs.StoreValues(QueueTable, queues[1:2])
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fs.InjectedFaults())
+
+	var stored []StoredQueue
+	assert.NoError(t, mem.LoadTable(QueueTable, &stored))
+	assert.Equal(t, 2, len(stored))
+
+	// The applied writes are in the database despite the error
+	fs.ClearRules()
+	fs.AddRule(FaultRule{Ops: []StoreOp{OpDeleteValue}, Ambiguous: true,
+		Fault: FaultAppliedButFailed})
+	err = fs.DeleteValue(QueueTable, "q1")
+	assert.True(t, IsAmbiguousWriteError(err))
+	found, err := fs.GetValue(QueueTable, "q1", &StoredQueue{})
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// The partial writes store only the first half of the batch
+	fs.ClearRules()
+	fs.AddRule(FaultRule{Fault: FaultPartialWrite})
+	err, success := fs.StoreValues(QueueTable, []StoredQueue{
+		{Key: "p1"}, {Key: "p2"}, {Key: "p3"}, {Key: "p4"}})
+	assert.Error(t, err)
+	assert.Equal(t, map[string]bool{"p1": true, "p2": true}, success)
+	found, _ = mem.GetValue(QueueTable, "p3", &StoredQueue{})
+	assert.False(t, found)
+}
+
+func TestRandomFaults(t *testing.T) {
+	runFaults := func(seed int64) []bool {
+		_, fs := makeTestFaultyStore(seed)
+		fs.AddRule(FaultRule{Ops: []StoreOp{OpGetCounter}, Probability: 0.5})
+
+		var res []bool
+		for i := 0; i < 100; i++ {
+			_, err := fs.GetCounter("cnt")
+			res = append(res, err != nil)
+		}
+		return res
+	}
+
+	// The same seed gives the same faults
+	faults := runFaults(42)
+	assert.Equal(t, faults, runFaults(42))
+	var numFaults = 0
+	for _, f := range faults {
+		if f {
+			numFaults++
+		}
+	}
+	assert.True(t, numFaults > 20 && numFaults < 80)
+}
+
+func TestFaultLatency(t *testing.T) {
+	_, fs := makeTestFaultyStore(1)
+	fs.AddRule(FaultRule{Fault: FaultDelay, Latency: 20 * time.Millisecond})
+	fs.AddRule(FaultRule{Ops: []StoreOp{OpLoadTable}})
+
+	// The delays don't stop the other rules
+	start := time.Now()
+	var stored []StoredQueue
+	assert.Error(t, fs.LoadTable(QueueTable, &stored))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	err, _ := fs.StoreValues(QueueTable, []StoredQueue{{Key: "q1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fs.InjectedFaults())
+}
@@ -0,0 +1,84 @@
+package data
+
+import (
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+const JobTable = "job"
+
+type JobStore struct {
+	store KVStore
+	mutex sync.RWMutex
+	// Serializes the read-modify-write updates of jobs
+	jobMutex sync.Mutex
+
+	jobsByName map[string]*JobInfo
+}
+
+func NewJobStore(store KVStore) *JobStore {
+	return &JobStore{
+		store: store,
+		jobsByName: make(map[string]*JobInfo),
+	}
+}
+
+// Lock the jobs for an update based on their current state
+func (ts *JobStore) LockJobs() {
+	ts.jobMutex.Lock()
+}
+
+func (ts *JobStore) UnlockJobs() {
+	ts.jobMutex.Unlock()
+}
+
+func (ts *JobStore) Hydrate() error {
+	var data []*JobInfo
+	err := ts.store.LoadTable(JobTable, &data)
+	if err != nil {
+		return NewStoreError("failed hydrate the JobStore", err)
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for _, t := range data {
+		ts.jobsByName[t.Key] = t
+	}
+
+	return nil
+}
+
+// Store the job, the jobs are replaced as a whole so callers
+// must not modify the jobs obtained from the store in-place.
+func (ts *JobStore) StoreJob(job *JobInfo) error {
+	logrus.Infof("Storing job: %s", job.String())
+
+	err, _ := ts.store.StoreValues(JobTable, []JobInfo{*job})
+	if err != nil {
+		return NewStoreError("failed to store job: " + job.String(), err)
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	ts.jobsByName[job.Key] = job
+	return nil
+}
+
+func (ts *JobStore) GetJob(name string) (*JobInfo, bool) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	job, ok := ts.jobsByName[name]
+	return job, ok
+}
+
+func (ts *JobStore) ListJobs() []*JobInfo {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	var res = make([]*JobInfo, 0, len(ts.jobsByName))
+	for _, v := range ts.jobsByName {
+		res = append(res, v)
+	}
+	return res
+}
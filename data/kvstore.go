@@ -1,7 +1,9 @@
 package data
 
 import (
+	"encoding/json"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
 	"github.com/sirupsen/logrus"
@@ -17,10 +19,21 @@ type KVStore interface {
 	// keys[] are the list of successfully inserted keys
 	StoreValues(table string, data interface{}) (error, map[string]bool)
 
+	// Store a single value only if the stored value has the expected version,
+	// zero means that the value must not exist (or has no version yet). The
+	// value must have the Key and Version fields, the caller sets the new
+	// version. Returns VersionConflictError if the versions don't match.
+	StoreValue(table string, value interface{}, expectedVersion int64) error
+
 	// Delete the value from the database, if the item
 	// doesn't exist it's a no-op.
 	DeleteValue(table string, key string) error
 
+	// Read a single value with the given key into the "output" parameter,
+	// it must be a pointer to a struct. Returns false if there's no such
+	// value. The reads are consistent, they see all the completed writes.
+	GetValue(table string, key string, output interface{}) (bool, error)
+
 	// Load the entire table into the "output" parameter. It must be a
 	// pointer to a slice:
 	//
@@ -56,6 +69,7 @@ type DynamoDBStore struct {
 const numParallel = 5
 const dynamoBatchSize = 25
 const keyAttributeName = "Key"
+const versionAttributeName = "Version"
 const counterIops = 20
 const counterTableName = "counter"
 const counterBlockSize = 50
@@ -126,6 +140,60 @@ func (db *DynamoDBStore) StoreValues(table string, data interface{}) (error, map
 	return nil, success
 }
 
+func getValueKey(value interface{}) string {
+	return reflect.Indirect(reflect.ValueOf(value)).FieldByName(keyAttributeName).String()
+}
+
+// Get the key and the version of a value for the conditional writes
+func getKeyAndVersion(value interface{}) (string, int64) {
+	val := reflect.Indirect(reflect.ValueOf(value))
+	version := val.FieldByName(versionAttributeName)
+	if !version.IsValid() {
+		panic("The value must have the Version field")
+	}
+	return val.FieldByName(keyAttributeName).String(), version.Int()
+}
+
+// Get the version of a JSON-encoded value
+func getDocVersion(doc []byte) (int64, error) {
+	var versioned struct {
+		Version int64
+	}
+	err := json.Unmarshal(doc, &versioned)
+	return versioned.Version, err
+}
+
+func (db *DynamoDBStore) StoreValue(table string, value interface{},
+	expectedVersion int64) error {
+
+	item, err := dynamodbattribute.MarshalMap(value)
+	if err != nil {
+		return err
+	}
+
+	// The missing items have no version, they match the zero version
+	condition := "#v = :v"
+	if expectedVersion == 0 {
+		condition = "attribute_not_exists(#v) OR #v = :v"
+	}
+	req := db.Svc.PutItemRequest(&dynamodb.PutItemInput{
+		TableName: aws.String(db.TablePrefix + table),
+		Item: item,
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]string{"#v": versionAttributeName},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":v": {N: aws.String(strconv.FormatInt(expectedVersion, 10))}},
+	})
+	_, err = req.Send()
+	if aerr, ok := err.(awserr.Error); ok &&
+		aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		key, _ := getKeyAndVersion(value)
+		return &VersionConflictError{Table: table, Key: key,
+			ExpectedVersion: expectedVersion}
+	}
+	return err
+}
+
 func (db *DynamoDBStore) DeleteValue(table string, key string) error {
 	req := db.Svc.DeleteItemRequest(&dynamodb.DeleteItemInput{
 		TableName: aws.String(db.TablePrefix + table),
@@ -136,6 +204,33 @@ func (db *DynamoDBStore) DeleteValue(table string, key string) error {
 	return err
 }
 
+func (db *DynamoDBStore) GetValue(table string, key string, output interface{}) (bool, error) {
+	req := db.Svc.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(db.TablePrefix + table),
+		Key: map[string]dynamodb.AttributeValue{keyAttributeName: {S: &key},},
+		ConsistentRead: aws.Bool(true),
+	})
+
+	resp, err := req.Send()
+	if err != nil {
+		return false, err
+	}
+	if len(resp.Item) == 0 {
+		return false, nil
+	}
+	return true, dynamodbattribute.UnmarshalMap(resp.Item, output)
+}
+
+// The DynamoDB encoding drops the empty values, so the values read back
+// don't always match the written ones
+func (db *DynamoDBStore) NormalizeValue(value interface{}, output interface{}) error {
+	item, err := dynamodbattribute.MarshalMap(value)
+	if err != nil {
+		return err
+	}
+	return dynamodbattribute.UnmarshalMap(item, output)
+}
+
 func (db *DynamoDBStore) LoadTable(table string, output interface{}) error {
 	var done = make(chan error, numParallel)
 	var mutex sync.Mutex
@@ -209,13 +304,46 @@ func (db *DynamoDBStore) LoadTable(table string, output interface{}) error {
 }
 
 func (db *DynamoDBStore) GetCounter(counterName string) (int64, error) {
-	db.counterMutex.Lock()
-	cnt, present := db.counters[counterName]
+	cnt := getCounterValue(&db.counterMutex, db.counters, counterName)
+	return cnt.next(counterName, func() (int64, error) {
+		// Here we do an atomic increment on the counter field, we'll get the
+		// new value in the response.
+		input := &dynamodb.UpdateItemInput{
+			Key:              map[string]dynamodb.AttributeValue{
+				keyAttributeName: {S: aws.String(counterName)}},
+			TableName:        aws.String(db.TablePrefix + counterTableName),
+			UpdateExpression: aws.String("add CounterValue :val"),
+			ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+				":val": {N: aws.String(strconv.Itoa(counterBlockSize))}},
+			ReturnValues: "UPDATED_NEW",
+		}
+
+		output, e := db.Svc.UpdateItemRequest(input).Send()
+		if e != nil {
+			return 0, e
+		}
+		return strconv.ParseInt(*output.Attributes["CounterValue"].N, 10, 64)
+	})
+}
+
+func getCounterValue(mutex *sync.Mutex, counters map[string]*counterValue,
+	counterName string) *counterValue {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	cnt, present := counters[counterName]
 	if !present {
 		cnt = &counterValue{}
-		db.counters[counterName] = cnt
+		counters[counterName] = cnt
 	}
-	db.counterMutex.Unlock()
+	return cnt
+}
+
+// Get the next counter value, the values are allocated from the database
+// in blocks of counterBlockSize. The grabBlock function must atomically
+// increment the stored counter by counterBlockSize and return the new value.
+func (cnt *counterValue) next(counterName string,
+	grabBlock func() (int64, error)) (int64, error) {
 
 	cnt.mutex.Lock()
 	defer cnt.mutex.Unlock()
@@ -227,36 +355,19 @@ func (db *DynamoDBStore) GetCounter(counterName string) (int64, error) {
 		return res, nil
 	}
 
-	// Need to grab another block of numbers from the DDB.
-	// Here we do an atomic increment on the counter field, we'll get the new value
-	// in the response.
-	input := &dynamodb.UpdateItemInput{
-		Key:              map[string]dynamodb.AttributeValue{
-			keyAttributeName: {S: aws.String(counterName)}},
-		TableName:        aws.String(db.TablePrefix + counterTableName),
-		UpdateExpression: aws.String("add CounterValue :val"),
-		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
-			":val": {N: aws.String(strconv.Itoa(counterBlockSize))}},
-		ReturnValues: "UPDATED_NEW",
-	}
-
-	output, e := db.Svc.UpdateItemRequest(input).Send()
-	if e != nil {
-		return 0, e
-	}
-	newVal, e := strconv.ParseInt(*output.Attributes["CounterValue"].N, 10, 64)
+	// Need to grab another block of numbers from the database, the block
+	// is (newVal-counterBlockSize, newVal]. The other servers (or our
+	// previous incarnations) might have used the numbers before it.
+	newVal, e := grabBlock()
 	if e != nil {
 		return 0, e
 	}
-	if cnt.maxVal >= newVal {
+	if newVal < cnt.maxVal {
 		panic("Counter " + counterName + " is going down")
 	}
 
-	cnt.maxVal = newVal
-	// Skip the zero value
-	if cnt.curVal == 0 {
-		cnt.curVal++
-	}
+	cnt.curVal = newVal - counterBlockSize + 1
+	cnt.maxVal = newVal + 1
 
 	res := cnt.curVal
 	cnt.curVal++
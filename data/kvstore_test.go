@@ -168,6 +168,47 @@ func TestCounterPanic(t *testing.T) {
 	})
 }
 
+func TestCounterBlocks(t *testing.T) {
+	// The counter in the database, updated like the DynamoDB atomic "ADD"
+	var stored int64
+	grabBlock := func() (int64, error) {
+		stored += counterBlockSize
+		return stored, nil
+	}
+
+	// The values from the successive blocks follow each other
+	cnt := &counterValue{}
+	for i := 0; i < counterBlockSize*3; i++ {
+		val, err := cnt.next("tasks", grabBlock)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i+1), val)
+	}
+
+	// The restarted server (or another one) continues after the used blocks,
+	// and the blocks of the two servers don't overlap
+	restarted := &counterValue{}
+	seen := make(map[int64]bool)
+	for i := 0; i < counterBlockSize*2; i++ {
+		for _, c := range []*counterValue{cnt, restarted} {
+			val, err := c.next("tasks", grabBlock)
+			assert.NoError(t, err)
+			assert.True(t, val > counterBlockSize*3 && val <= counterBlockSize*7)
+			assert.False(t, seen[val])
+			seen[val] = true
+		}
+	}
+	assert.Equal(t, int64(counterBlockSize*7), stored)
+	assert.Equal(t, counterBlockSize*4, len(seen))
+
+	// The counter can't go backwards
+	stored = 0
+	assert.Panics(t, func() {
+		for i := 0; i <= counterBlockSize; i++ {
+			restarted.next("tasks", grabBlock)
+		}
+	})
+}
+
 func TestFakeMemStore(t *testing.T) {
 	store := NewFakeMemStore()
 
@@ -197,4 +238,61 @@ func TestFakeMemStore(t *testing.T) {
 	err = store.LoadTable("table1", &data)
 	assert.NoError(t, err)
 	assert.Equal(t, numItems, len(data))
-}
\ No newline at end of file
+}
+
+type versionedData struct {
+	Key     string
+	Version int64
+	Cmd     string
+}
+
+// Check the conditional write semantics, "table1" must exist
+func checkConditionalWrites(t *testing.T, store KVStore) {
+	// A new value can only be stored with the zero expected version
+	err := store.StoreValue("table1", versionedData{Key: "v1", Version: 1, Cmd: "a"}, 1)
+	assert.True(t, IsVersionConflict(err))
+	assert.NoError(t, store.StoreValue("table1",
+		versionedData{Key: "v1", Version: 1, Cmd: "a"}, 0))
+
+	// A stale write is rejected
+	err = store.StoreValue("table1", versionedData{Key: "v1", Version: 1, Cmd: "b"}, 0)
+	assert.True(t, IsVersionConflict(err))
+	assert.NoError(t, store.StoreValue("table1",
+		versionedData{Key: "v1", Version: 2, Cmd: "c"}, 1))
+	err = store.StoreValue("table1", versionedData{Key: "v1", Version: 2, Cmd: "d"}, 1)
+	assert.True(t, IsVersionConflict(err))
+
+	var data []versionedData
+	assert.NoError(t, store.LoadTable("table1", &data))
+	for _, d := range data {
+		if d.Key == "v1" {
+			assert.Equal(t, versionedData{Key: "v1", Version: 2, Cmd: "c"}, d)
+		}
+	}
+
+	// The values written without the version match the zero version
+	err, _ = store.StoreValues("table1", []TestTaskData{{Key: "v2", Cmd: "x"}})
+	assert.NoError(t, err)
+	assert.NoError(t, store.StoreValue("table1",
+		versionedData{Key: "v2", Version: 1, Cmd: "y"}, 0))
+
+	// The deleted values can't be updated
+	assert.NoError(t, store.DeleteValue("table1", "v2"))
+	err = store.StoreValue("table1", versionedData{Key: "v2", Version: 2, Cmd: "z"}, 1)
+	assert.True(t, IsVersionConflict(err))
+}
+
+func TestConditionalWrites(t *testing.T) {
+	context := prepareContext(t)
+	defer func() { closeContext(context) }()
+
+	store := NewDynamoDbStore(context.conn, "test_")
+	assert.NoError(t, store.InitSchema(map[string]int64{"table1": 100}))
+	checkConditionalWrites(t, store)
+}
+
+func TestFakeMemStoreConditionalWrites(t *testing.T) {
+	store := NewFakeMemStore()
+	assert.NoError(t, store.InitSchema(map[string]int64{"table1": 100}))
+	checkConditionalWrites(t, store)
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"apollo/proto/gen/models"
 	"encoding/json"
+	"strconv"
 	"time"
 )
 
@@ -10,6 +11,8 @@ type TokenType string
 const UserToken = "UserToken"
 const NodeToken = "NodeToken"
 const TaskToken = "TaskToken"
+// A single-use token that allows a runner to join a queue (the EntityKey)
+const JoinToken = "JoinToken"
 
 type AbsoluteTime int64
 
@@ -25,6 +28,8 @@ func FromTime(tm time.Time) AbsoluteTime {
 // each of them linked to a different entity: node, user, or task
 type AuthToken struct {
 	Key     string
+	// The public token ID, it can be shown to the users unlike the key
+	ID      string
 	Expires AbsoluteTime
 	Type    TokenType
 	// The entity key this token is linked to (or account ID for user tokens)
@@ -56,6 +61,9 @@ func (a *AuthToken) RenderEntity() string {
 	if a.Type == TaskToken {
 		return "task/" + a.EntityKey
 	}
+	if a.Type == JoinToken {
+		return "join/" + a.EntityKey
+	}
 	panic("Unknown token type: " + a.Type)
 }
 
@@ -74,9 +82,20 @@ func (a *StoredQueue) String() string {
 
 // Job Info
 type JobInfo struct {
+	// The job name
+	Key string
 	JobName string
-	MaxFailedPercentage float64
 	MaxFailedCount int
+
+	State models.JobStateEnum
+	// The number of permanently failed task instances within the job
+	FailedCount int
+	CreatedOn AbsoluteTime
+	FailedOn AbsoluteTime
+}
+
+func (a *JobInfo) String() string {
+	return jsonString(a)
 }
 
 // Node
@@ -84,13 +103,21 @@ type StoredNode struct {
 	Key string
 	Queue string
 	CloudID string
+	// The cloud instance type of a managed node
+	InstanceType string
 
 	Managed bool
 	State models.NodeStateEnum
 	CreatedOn AbsoluteTime
 	LastTransitionTime AbsoluteTime
+	// The time of the last state report from the node's runner
+	LastHeartbeat AbsoluteTime
+	// The instances of a draining node are requeued after this time (if set)
+	DrainDeadline AbsoluteTime
 
 	Info models.NodeInfo
+	// Incremented on every write, a stale copy of the node can't be stored
+	Version int64
 }
 
 func (a *StoredNode) String() string {
@@ -116,12 +143,41 @@ type TaskInstanceKey struct {
 	Index int
 }
 
+// Render the instance key in the "parent-index" form, it's used as the
+// primary key of the task instance.
+func (k TaskInstanceKey) String() string {
+	return k.ParentKey + "-" + strconv.Itoa(k.Index)
+}
+
+// A single instance of the task array
 type TaskInstance struct {
 	Key string
 	InstanceKey TaskInstanceKey
 
+	State models.TaskStateEnum
+	// The node this instance is assigned to, empty if it's not assigned
+	AssignedNode string
+	// The node the instance was assigned to before it was requeued, it
+	// can still upload the rest of the instance's output
+	PreviousNode string
+	ScheduledOn AbsoluteTime
+	StartedOn AbsoluteTime
+	FinishedOn AbsoluteTime
+
 	ExitCode *int
+	FailureReason models.FailureReasonEnum
+	// The number of retries due to the task failures
 	RetryNum int
+	// The number of retries due to the node losses, they are not charged
+	// to the task's retry budget.
+	NodeLossRetries int
+	// The attempt to run the instance, incremented every time the instance
+	// is requeued. The runner's reports of the other attempts are ignored.
+	Attempt int
+	// The instance must not be scheduled before this time (retry backoff)
+	NotBefore AbsoluteTime
+	// Incremented on every write, a stale copy of the instance can't be stored
+	Version int64
 }
 
 func (a *TaskInstance) String() string {
@@ -10,6 +10,8 @@ const NodeTable = "node"
 type NodeStore struct {
 	store KVStore
 	mutex sync.RWMutex
+	// Serializes the read-modify-write node updates
+	updateMutex sync.Mutex
 
 	NodesByName map[string]*StoredNode
 }
@@ -56,11 +58,22 @@ func (ts *NodeStore) Hydrate() error {
 	return nil
 }
 
+// Store the node, it's written only if the stored node still has the
+// node's version. So a stale copy of the node (e.g. one modified by another
+// server) can't overwrite the newer state. The node's version is incremented.
+// In case of a version conflict the node is reloaded from the database, so
+// that the next update can succeed.
 func (ts *NodeStore) StoreNode(q *StoredNode) error {
 	logrus.Infof("Storing new node: %s", q.String())
 
-	err, _ := ts.store.StoreValues(NodeTable, []StoredNode{*q})
+	expectedVersion := q.Version
+	q.Version++
+	err := ts.store.StoreValue(NodeTable, *q, expectedVersion)
 	if err != nil {
+		q.Version = expectedVersion
+		if IsVersionConflict(err) {
+			ts.reloadNode(q.Key)
+		}
 		return NewStoreError("failed to store node: " + q.String(), err)
 	}
 
@@ -71,6 +84,59 @@ func (ts *NodeStore) StoreNode(q *StoredNode) error {
 	return nil
 }
 
+// Replace the cached node with its stored state
+func (ts *NodeStore) reloadNode(key string) {
+	var cur StoredNode
+	found, err := ts.store.GetValue(NodeTable, key, &cur)
+	if err != nil {
+		logrus.Warnf("Failed to reload the node %s: %s", key, err.Error())
+		return
+	}
+
+	ts.FullLock()
+	defer ts.FullUnlock()
+	if found {
+		ts.NodesByName[key] = &cur
+	} else {
+		delete(ts.NodesByName, key)
+	}
+}
+
+// The number of attempts to update a node that is concurrently modified
+const maxNodeUpdateAttempts = 3
+
+// Atomically update the node. The updater gets a copy of the node and returns
+// false if the node doesn't need to be changed. If the node has been changed
+// by another server, the updater is run again on the reloaded node. Returns
+// the resulting node or nil if the node doesn't exist.
+func (ts *NodeStore) UpdateNode(key string, updater func(node *StoredNode) bool) (
+	*StoredNode, error) {
+
+	ts.updateMutex.Lock()
+	defer ts.updateMutex.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		ts.mutex.RLock()
+		existing, ok := ts.NodesByName[key]
+		ts.mutex.RUnlock()
+		if !ok {
+			return nil, nil
+		}
+
+		nodeCopy := *existing
+		if !updater(&nodeCopy) {
+			return existing, nil
+		}
+		err := ts.StoreNode(&nodeCopy)
+		if err == nil {
+			return &nodeCopy, nil
+		}
+		if !IsVersionConflict(err) || attempt >= maxNodeUpdateAttempts {
+			return existing, err
+		}
+	}
+}
+
 func (ts *NodeStore) ListNodes(IDs []string, filter func(node *StoredNode) bool) []*StoredNode {
 	ts.WriteLock()
 	defer ts.WriteUnlock()
@@ -0,0 +1,86 @@
+package data
+
+import (
+	"apollo/proto/gen/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStaleNodeWrites(t *testing.T) {
+	fakeMemStore := NewFakeMemStore()
+	fakeMemStore.InitSchema(map[string]int64{NodeTable: 5})
+	ns := NewNodeStore(fakeMemStore)
+
+	node := &StoredNode{Key: "n1", Queue: "q1", State: models.NodeStateEnumActive}
+	assert.NoError(t, ns.StoreNode(node))
+	assert.Equal(t, int64(1), node.Version)
+
+	// Another server loads the node and updates it
+	ns2 := NewNodeStore(fakeMemStore)
+	assert.NoError(t, ns2.Hydrate())
+	updated, err := ns2.UpdateNode("n1", func(node *StoredNode) bool {
+		node.State = models.NodeStateEnumShuttingDown
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), updated.Version)
+
+	// Our copy is stale now, it can't overwrite the newer state
+	stale := *node
+	stale.State = models.NodeStateEnumDead
+	assert.True(t, IsVersionConflict(ns.StoreNode(&stale)))
+	assert.Equal(t, int64(1), stale.Version)
+
+	// The node is reloaded after the conflict
+	cur := ns.ListNodes([]string{"n1"}, nil)[0]
+	assert.Equal(t, int64(2), cur.Version)
+	assert.Equal(t, models.NodeStateEnumShuttingDown, cur.State)
+
+	ns3 := NewNodeStore(fakeMemStore)
+	assert.NoError(t, ns3.Hydrate())
+	assert.Equal(t, models.NodeStateEnumShuttingDown,
+		ns3.ListNodes([]string{"n1"}, nil)[0].State)
+}
+
+func TestConcurrentNodeUpdates(t *testing.T) {
+	fakeMemStore := NewFakeMemStore()
+	fakeMemStore.InitSchema(map[string]int64{NodeTable: 5})
+	ns := NewNodeStore(fakeMemStore)
+	assert.NoError(t, ns.StoreNode(&StoredNode{Key: "n1", Queue: "q1",
+		State: models.NodeStateEnumActive}))
+
+	// Another server updates the node
+	ns2 := NewNodeStore(fakeMemStore)
+	assert.NoError(t, ns2.Hydrate())
+	_, err := ns2.UpdateNode("n1", func(node *StoredNode) bool {
+		node.State = models.NodeStateEnumShuttingDown
+		return true
+	})
+	assert.NoError(t, err)
+
+	// The update is retried on the node from the database
+	var seenStates []models.NodeStateEnum
+	updated, err := ns.UpdateNode("n1", func(node *StoredNode) bool {
+		seenStates = append(seenStates, node.State)
+		node.CloudID = "i-1"
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []models.NodeStateEnum{models.NodeStateEnumActive,
+		models.NodeStateEnumShuttingDown}, seenStates)
+	assert.Equal(t, int64(3), updated.Version)
+	assert.Equal(t, models.NodeStateEnumShuttingDown, updated.State)
+
+	// The later updates work without conflicts
+	_, err = ns.UpdateNode("n1", func(node *StoredNode) bool {
+		node.State = models.NodeStateEnumDead
+		return true
+	})
+	assert.NoError(t, err)
+
+	ns3 := NewNodeStore(fakeMemStore)
+	assert.NoError(t, ns3.Hydrate())
+	cur := ns3.ListNodes([]string{"n1"}, nil)[0]
+	assert.Equal(t, models.NodeStateEnumDead, cur.State)
+	assert.Equal(t, "i-1", cur.CloudID)
+}
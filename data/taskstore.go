@@ -12,6 +12,8 @@ const TaskInstanceTable = "task_instance"
 type TaskStore struct {
 	store KVStore
 	mutex sync.RWMutex
+	// Serializes the state transitions of task instances
+	instanceMutex sync.Mutex
 
 	tasksByKey map[string]*StoredTask
 	taskInstancesByKey map[string]*TaskInstance
@@ -28,6 +30,15 @@ func (ts *TaskStore) WriteUnlock() {
 	ts.mutex.RUnlock()
 }
 
+// Lock the task instances for a state transition
+func (ts *TaskStore) LockInstances() {
+	ts.instanceMutex.Lock()
+}
+
+func (ts *TaskStore) UnlockInstances() {
+	ts.instanceMutex.Unlock()
+}
+
 func NewTaskStore(store KVStore) *TaskStore {
 	return &TaskStore{
 		store: store,
@@ -51,6 +62,17 @@ func (ts *TaskStore) Hydrate() error {
 		ts.tasksByKey[t.Key] = t
 	}
 
+	var instances []*TaskInstance
+	err = ts.store.LoadTable(TaskInstanceTable, &instances)
+	if err != nil {
+		return NewStoreError("failed hydrate the TaskStore instances", err)
+	}
+
+	for _, inst := range instances {
+		ts.taskInstancesByKey[inst.Key] = inst
+		ts.taskInstancesByParent[inst.InstanceKey] = inst
+	}
+
 	return nil
 }
 
@@ -94,3 +116,106 @@ func (ts *TaskStore) ListTasks(IDs []string, filter func(*StoredTask)(bool)) []*
 		return res
 	}
 }
+
+func (ts *TaskStore) GetTask(key string) (*StoredTask, bool) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	task, ok := ts.tasksByKey[key]
+	return task, ok
+}
+
+// Get the array indexes of the task that don't have instances yet. The
+// expansion can be interrupted midway, so all the indexes are checked.
+func (ts *TaskStore) MissingInstances(task *StoredTask) []int {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	var res []int
+	for i := int(task.StartArrayIndex); i < int(task.EndArrayIndex); i++ {
+		_, ok := ts.taskInstancesByParent[TaskInstanceKey{ParentKey: task.Key, Index: i}]
+		if !ok {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// Store the task instances, the instances are replaced as a whole so callers
+// must not modify the instances obtained from the store in-place. The
+// instances are written only if the stored instance still has the version of
+// the copy, and the new instances (without a version) only if they don't
+// exist yet. So the stale state transitions and the repeated expansions are
+// rejected. All the instances are attempted, the failures are returned as
+// BatchError. The conflicting instances are reloaded from the database, so
+// that the next transition can succeed.
+func (ts *TaskStore) StoreTaskInstances(instances []*TaskInstance) error {
+	if len(instances) == 0 {
+		return nil
+	}
+
+	var errs = make(map[string]error)
+	var stored = make(map[string]bool)
+	var reloaded []*TaskInstance
+
+	for _, inst := range instances {
+		expectedVersion := inst.Version
+		inst.Version++
+		err := ts.store.StoreValue(TaskInstanceTable, *inst, expectedVersion)
+		if err == nil {
+			stored[inst.Key] = true
+			continue
+		}
+		inst.Version = expectedVersion
+		errs[inst.Key] = err
+
+		if IsVersionConflict(err) {
+			var cur TaskInstance
+			found, err := ts.store.GetValue(TaskInstanceTable, inst.Key, &cur)
+			if err != nil {
+				logrus.Warnf("Failed to reload the task instance %s: %s",
+					inst.Key, err.Error())
+			} else if found {
+				reloaded = append(reloaded, &cur)
+			}
+		}
+	}
+
+	// Update the instances that were actually stored, even in case of errors
+	ts.mutex.Lock()
+	for _, inst := range instances {
+		if stored[inst.Key] {
+			ts.taskInstancesByKey[inst.Key] = inst
+			ts.taskInstancesByParent[inst.InstanceKey] = inst
+		}
+	}
+	for _, inst := range reloaded {
+		ts.taskInstancesByKey[inst.Key] = inst
+		ts.taskInstancesByParent[inst.InstanceKey] = inst
+	}
+	ts.mutex.Unlock()
+
+	if len(errs) != 0 {
+		return NewStoreError("failed to store task instances", &BatchError{Errors: errs})
+	}
+	return nil
+}
+
+func (ts *TaskStore) GetTaskInstance(key string) (*TaskInstance, bool) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	inst, ok := ts.taskInstancesByKey[key]
+	return inst, ok
+}
+
+func (ts *TaskStore) ListTaskInstances(filter func(*TaskInstance) bool) []*TaskInstance {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	var res = make([]*TaskInstance, 0, len(ts.taskInstancesByKey))
+	for _, v := range ts.taskInstancesByKey {
+		if filter == nil || filter(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,128 @@
+package data
+
+import (
+	"apollo/proto/gen/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStaleInstanceWrites(t *testing.T) {
+	fakeMemStore := NewFakeMemStore()
+	fakeMemStore.InitSchema(map[string]int64{TaskTable: 5, TaskInstanceTable: 5})
+	ts := NewTaskStore(fakeMemStore)
+
+	key := TaskInstanceKey{ParentKey: "1", Index: 0}
+	assert.NoError(t, ts.StoreTaskInstances([]*TaskInstance{{
+		Key: key.String(), InstanceKey: key, State: models.TaskStateEnumWaiting}}))
+
+	inst, _ := ts.GetTaskInstance("1-0")
+	scheduled := *inst
+	scheduled.State = models.TaskStateEnumScheduled
+	scheduled.AssignedNode = "n1"
+	assert.NoError(t, ts.StoreTaskInstances([]*TaskInstance{&scheduled}))
+	assert.Equal(t, int64(2), scheduled.Version)
+
+	// A transition based on the old state is rejected
+	cancelled := *inst
+	cancelled.State = models.TaskStateEnumCancelled
+	err := ts.StoreTaskInstances([]*TaskInstance{&cancelled})
+	assert.True(t, IsVersionConflict(err))
+	assert.Equal(t, int64(1), cancelled.Version)
+
+	cur, _ := ts.GetTaskInstance("1-0")
+	assert.Equal(t, models.TaskStateEnumScheduled, cur.State)
+
+	// The transition from the current state works
+	cancelled = *cur
+	cancelled.State = models.TaskStateEnumCancelled
+	assert.NoError(t, ts.StoreTaskInstances([]*TaskInstance{&cancelled}))
+
+	ts2 := NewTaskStore(fakeMemStore)
+	assert.NoError(t, ts2.Hydrate())
+	cur, _ = ts2.GetTaskInstance("1-0")
+	assert.Equal(t, models.TaskStateEnumCancelled, cur.State)
+	assert.Equal(t, int64(3), cur.Version)
+}
+
+func TestInstanceWriteFailures(t *testing.T) {
+	mem := NewFakeMemStore()
+	mem.InitSchema(map[string]int64{TaskTable: 5, TaskInstanceTable: 5})
+	faulty := NewFaultyStore(mem, 1)
+	ts := NewTaskStore(faulty)
+
+	var instances []*TaskInstance
+	for i := 0; i < 3; i++ {
+		key := TaskInstanceKey{ParentKey: "1", Index: i}
+		instances = append(instances, &TaskInstance{Key: key.String(),
+			InstanceKey: key, State: models.TaskStateEnumWaiting})
+	}
+	assert.NoError(t, ts.StoreTaskInstances(instances))
+
+	// Another server has scheduled the first instance
+	other := *instances[0]
+	other.State = models.TaskStateEnumScheduled
+	other.Version = 2
+	assert.NoError(t, mem.StoreValue(TaskInstanceTable, other, 1))
+
+	// The second write fails, but the third one is still attempted
+	faulty.AddRule(FaultRule{Ops: []StoreOp{OpStoreValue}, Skip: 1, Times: 1})
+	var cancelled []*TaskInstance
+	for _, inst := range instances {
+		c := *inst
+		c.State = models.TaskStateEnumCancelled
+		cancelled = append(cancelled, &c)
+	}
+	err := ts.StoreTaskInstances(cancelled)
+	assert.True(t, IsVersionConflict(err))
+	batchErr := err.(StoreError).OrigErr().(*BatchError)
+	assert.Equal(t, 2, len(batchErr.Errors))
+	assert.NotNil(t, batchErr.Errors["1-0"])
+	assert.NotNil(t, batchErr.Errors["1-1"])
+
+	// The conflicting instance is reloaded, the failed one is unchanged
+	cur, _ := ts.GetTaskInstance("1-0")
+	assert.Equal(t, models.TaskStateEnumScheduled, cur.State)
+	assert.Equal(t, int64(2), cur.Version)
+	cur, _ = ts.GetTaskInstance("1-1")
+	assert.Equal(t, models.TaskStateEnumWaiting, cur.State)
+	cur, _ = ts.GetTaskInstance("1-2")
+	assert.Equal(t, models.TaskStateEnumCancelled, cur.State)
+
+	// The transition from the reloaded state works
+	reloaded, _ := ts.GetTaskInstance("1-0")
+	c := *reloaded
+	c.State = models.TaskStateEnumCancelled
+	assert.NoError(t, ts.StoreTaskInstances([]*TaskInstance{&c}))
+}
+
+func TestRepeatedInstanceCreation(t *testing.T) {
+	mem := NewFakeMemStore()
+	mem.InitSchema(map[string]int64{TaskTable: 5, TaskInstanceTable: 5})
+	ts := NewTaskStore(mem)
+
+	key := TaskInstanceKey{ParentKey: "1", Index: 0}
+	assert.NoError(t, ts.StoreTaskInstances([]*TaskInstance{{
+		Key: key.String(), InstanceKey: key, State: models.TaskStateEnumWaiting}}))
+	inst, _ := ts.GetTaskInstance("1-0")
+	scheduled := *inst
+	scheduled.State = models.TaskStateEnumScheduled
+	assert.NoError(t, ts.StoreTaskInstances([]*TaskInstance{&scheduled}))
+
+	// A server with a stale cache expands the task again
+	stale := NewTaskStore(mem)
+	err := stale.StoreTaskInstances([]*TaskInstance{{
+		Key: key.String(), InstanceKey: key, State: models.TaskStateEnumWaiting}})
+	assert.True(t, IsVersionConflict(err))
+
+	// The scheduled instance is not overwritten, and the stale server sees it
+	cur, _ := stale.GetTaskInstance("1-0")
+	assert.Equal(t, models.TaskStateEnumScheduled, cur.State)
+	assert.Equal(t, 0, len(stale.MissingInstances(&StoredTask{Key: "1",
+		TaskStruct: models.TaskStruct{StartArrayIndex: 0, EndArrayIndex: 1}})))
+
+	var stored TaskInstance
+	_, err = mem.GetValue(TaskInstanceTable, "1-0", &stored)
+	assert.NoError(t, err)
+	assert.Equal(t, models.TaskStateEnumScheduled, stored.State)
+	assert.Equal(t, int64(2), stored.Version)
+}
@@ -1,6 +1,12 @@
 package data
 
 import (
+	"apollo/utils"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/sirupsen/logrus"
+	"strings"
 	"sync"
 	"time"
 )
@@ -8,10 +14,28 @@ import (
 const TokenStoreTable = "token_store"
 const NeverExpires = -1
 
+// The tokens are stored under the salted hashes of their secret keys, so
+// that reading the table is not enough to impersonate a user or a node.
+// The prefix marks the hashing scheme.
+const hashedKeyPrefix = "h1:"
+// The salt is kept in the token table under this reserved key
+const tokenSaltKey = "salt"
+
+type tokenSalt struct {
+	Key  string
+	Salt string
+	// The salt is created only if there's none, so all servers use the same one
+	Version int64
+}
+
 type TokenStore struct {
 	store KVStore
 	mutex sync.RWMutex
 
+	saltMutex sync.Mutex
+	salt      []byte
+
+	// The tokens by the hashes of their keys
 	tokensByKey map[string]AuthToken
 }
 
@@ -22,10 +46,82 @@ func NewTokenStore(store KVStore) *TokenStore {
 	}
 }
 
+// Load the salt from the store or create it if there's none yet
+func (ts *TokenStore) getSalt() ([]byte, error) {
+	ts.saltMutex.Lock()
+	defer ts.saltMutex.Unlock()
+	if ts.salt != nil {
+		return ts.salt, nil
+	}
+
+	var rows []tokenSalt
+	err := ts.store.LoadTable(TokenStoreTable, &rows)
+	if err != nil {
+		return nil, NewStoreError("failed to load the token salt", err)
+	}
+	for _, r := range rows {
+		if r.Key == tokenSaltKey && r.Salt != "" {
+			return ts.useSalt(r)
+		}
+	}
+
+	newSalt := tokenSalt{Key: tokenSaltKey, Salt: *utils.GenerateRandIdSized(32),
+		Version: 1}
+	err = ts.store.StoreValue(TokenStoreTable, newSalt, 0)
+	if IsVersionConflict(err) {
+		// Another server has created the salt first, use its salt
+		var stored tokenSalt
+		found, err := ts.store.GetValue(TokenStoreTable, tokenSaltKey, &stored)
+		if err != nil {
+			return nil, NewStoreError("failed to load the token salt", err)
+		}
+		if !found || stored.Salt == "" {
+			return nil, NewStoreError("the token salt has disappeared", nil)
+		}
+		return ts.useSalt(stored)
+	}
+	if err != nil {
+		return nil, NewStoreError("failed to store the token salt", err)
+	}
+	return ts.useSalt(newSalt)
+}
+
+// Remember the salt, the salt mutex must be held
+func (ts *TokenStore) useSalt(stored tokenSalt) ([]byte, error) {
+	salt, err := hex.DecodeString(stored.Salt)
+	if err != nil {
+		return nil, NewStoreError("the token salt is corrupted", err)
+	}
+	ts.salt = salt
+	return ts.salt, nil
+}
+
+// Get the storage key of the token's secret key
+func (ts *TokenStore) hashKey(key string) (string, error) {
+	salt, err := ts.getSalt()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(key))
+	return hashedKeyPrefix + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Store the token, its Key must contain the secret key that is given to
+// the token's user. Only the hash of the key is saved.
 func (ts *TokenStore) StoreToken(token AuthToken) error {
-	err, _ := ts.store.StoreValues(TokenStoreTable, []AuthToken{token})
+	if token.ID == "" {
+		token.ID = *utils.GenerateRandIdSized(8)
+	}
+	hashed, err := ts.hashKey(token.Key)
 	if err != nil {
-		return NewStoreError("failed to store token: " + token.String(), err)
+		return err
+	}
+	token.Key = hashed
+
+	err, _ = ts.store.StoreValues(TokenStoreTable, []AuthToken{token})
+	if err != nil {
+		return NewStoreError("failed to store token: " + token.ID, err)
 	}
 
 	ts.mutex.Lock()
@@ -34,13 +130,62 @@ func (ts *TokenStore) StoreToken(token AuthToken) error {
 	return nil
 }
 
+// Find the token by its secret key, the Key of the returned token
+// contains the hashed key.
 func (ts *TokenStore) GetTokenByKey(key string) (AuthToken, bool) {
+	hashed, err := ts.hashKey(key)
+	if err != nil {
+		logrus.Errorf("Failed to hash the token key: %s", err.Error())
+		return AuthToken{}, false
+	}
+
 	ts.mutex.RLock()
 	defer ts.mutex.RUnlock()
-	token, ok := ts.tokensByKey[key]
+	token, ok := ts.tokensByKey[hashed]
 	return token, ok
 }
 
+// List the tokens matching the filter
+func (ts *TokenStore) ListTokens(filter func(token AuthToken) bool) []AuthToken {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	var res []AuthToken
+	for _, v := range ts.tokensByKey {
+		if filter == nil || filter(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Atomically take the token with the given secret key out of the store, so
+// that it can be used only once. Returns false if there's no such token.
+func (ts *TokenStore) ConsumeToken(key string) (AuthToken, bool, error) {
+	hashed, err := ts.hashKey(key)
+	if err != nil {
+		return AuthToken{}, false, err
+	}
+
+	ts.mutex.Lock()
+	token, ok := ts.tokensByKey[hashed]
+	delete(ts.tokensByKey, hashed)
+	ts.mutex.Unlock()
+	if !ok {
+		return AuthToken{}, false, nil
+	}
+
+	err = ts.store.DeleteValue(TokenStoreTable, hashed)
+	if err != nil {
+		// Put the token back, it's still in the database
+		ts.mutex.Lock()
+		ts.tokensByKey[hashed] = token
+		ts.mutex.Unlock()
+		return AuthToken{}, false, NewStoreError("failed to delete token "+token.ID, err)
+	}
+	return token, true, nil
+}
+
 func (ts *TokenStore) Hydrate() error {
 	var data []AuthToken
 
@@ -49,21 +194,80 @@ func (ts *TokenStore) Hydrate() error {
 		return NewStoreError("failed hydrate the TokenStore", err)
 	}
 
+	var legacy []AuthToken
 	ts.mutex.Lock()
-	defer ts.mutex.Unlock()
-
 	for _, t := range data {
+		if t.Key == tokenSaltKey {
+			continue
+		}
+		if !strings.HasPrefix(t.Key, hashedKeyPrefix) {
+			legacy = append(legacy, t)
+			continue
+		}
 		ts.tokensByKey[t.Key] = t
 	}
+	ts.mutex.Unlock()
+
+	return ts.migrateLegacyTokens(legacy)
+}
+
+// The tokens created before the keys were hashed are stored under their
+// secret keys. Re-store them under the hashed keys, their users don't
+// notice anything.
+func (ts *TokenStore) migrateLegacyTokens(legacy []AuthToken) error {
+	if len(legacy) == 0 {
+		return nil
+	}
+	logrus.Infof("Migrating %d tokens to the hashed keys", len(legacy))
 
+	for _, t := range legacy {
+		rawKey := t.Key
+		if t.ID == "" {
+			t.ID = legacyTokenId(rawKey)
+		}
+		// Store the new token first, so it's not lost if we fail midway
+		err := ts.StoreToken(t)
+		if err != nil {
+			return err
+		}
+		err = ts.store.DeleteValue(TokenStoreTable, rawKey)
+		if err != nil {
+			return NewStoreError("failed to delete the legacy token "+t.ID, err)
+		}
+	}
 	return nil
 }
 
+// The tokens created before the token IDs were introduced get an ID
+// derived from their key, so that it stays the same across restarts.
+func legacyTokenId(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (ts *TokenStore) GetTokenById(id string) (AuthToken, bool) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+	for _, v := range ts.tokensByKey {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return AuthToken{}, false
+}
+
 func (ts *TokenStore) ReapTokens(expireAfter time.Time) error {
+	return ts.RevokeTokens(func(token AuthToken) bool {
+		return token.Expires != NeverExpires && token.Expires.ToTime().Before(expireAfter)
+	})
+}
+
+// Delete all the tokens matching the filter
+func (ts *TokenStore) RevokeTokens(filter func(token AuthToken) bool) error {
 	ts.mutex.RLock()
 	tokensToKill := make([]string, 0, 100)
 	for k, v := range ts.tokensByKey {
-		if v.Expires != NeverExpires && v.Expires.ToTime().Before(expireAfter) {
+		if filter(v) {
 			tokensToKill = append(tokensToKill, k)
 		}
 	}
@@ -14,12 +14,14 @@ func TestTokenStore(t *testing.T) {
 	expire := time.Now()
 	at1 := AuthToken{
 		Key:       "key1",
+		ID:        "id1",
 		Expires:   FromTime(expire),
 		Type:      NodeToken,
 		EntityKey: "node-1",
 	}
 	at2 := AuthToken{
 		Key:       "key2",
+		ID:        "id2",
 		Expires:   FromTime(expire.Add(100*time.Second)),
 		Type:      NodeToken,
 		EntityKey: "node-2",
@@ -29,6 +31,9 @@ func TestTokenStore(t *testing.T) {
 
 	token1, ok := store.GetTokenByKey("key1")
 	assert.True(t, ok)
+	// Only the hashed keys are stored
+	assert.NotEqual(t, "key1", token1.Key)
+	at1.Key = token1.Key
 	assert.Equal(t, at1, token1)
 
 	// Create another store and hydrate it
@@ -38,6 +43,8 @@ func TestTokenStore(t *testing.T) {
 	token1, ok = store2.GetTokenByKey("key1")
 	assert.True(t, ok)
 	assert.Equal(t, at1, token1)
+	_, ok = store2.GetTokenByKey(at1.Key)
+	assert.False(t, ok)
 
 	// Reap the first key
 	assert.NoError(t, store2.ReapTokens(expire.Add(1*time.Second)))
@@ -47,5 +54,146 @@ func TestTokenStore(t *testing.T) {
 	// The second key is still here
 	token2, ok := store2.GetTokenByKey("key2")
 	assert.True(t, ok)
+	at2.Key = token2.Key
 	assert.Equal(t, at2, token2)
 }
+
+func TestConsumeToken(t *testing.T) {
+	fakeMemStore := NewFakeMemStore()
+	fakeMemStore.InitSchema(map[string]int64{TokenStoreTable: 200})
+	store := NewTokenStore(fakeMemStore)
+
+	jt := AuthToken{
+		Key:       "join1",
+		ID:        "id1",
+		Expires:   FromTime(time.Now().Add(time.Hour)),
+		Type:      JoinToken,
+		EntityKey: "q1",
+	}
+	assert.NoError(t, store.StoreToken(jt))
+
+	token, ok, err := store.ConsumeToken("join1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	jt.Key = token.Key
+	assert.Equal(t, jt, token)
+
+	// The token can be used only once, even after a restart
+	_, ok, err = store.ConsumeToken("join1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	store2 := NewTokenStore(fakeMemStore)
+	assert.NoError(t, store2.Hydrate())
+	_, ok = store2.GetTokenByKey("join1")
+	assert.False(t, ok)
+}
+
+func TestTokenIds(t *testing.T) {
+	fakeMemStore := NewFakeMemStore()
+	fakeMemStore.InitSchema(map[string]int64{TokenStoreTable: 200})
+	store := NewTokenStore(fakeMemStore)
+
+	// The IDs are assigned to the new tokens
+	assert.NoError(t, store.StoreToken(AuthToken{Key: "key1", Type: UserToken,
+		Expires: NeverExpires}))
+	token1, _ := store.GetTokenByKey("key1")
+	assert.NotEqual(t, "", token1.ID)
+	assert.NotEqual(t, "key1", token1.ID)
+
+	found, ok := store.GetTokenById(token1.ID)
+	assert.True(t, ok)
+	assert.Equal(t, token1, found)
+	_, ok = store.GetTokenById("nope")
+	assert.False(t, ok)
+
+	// The tokens stored without an ID get a stable one on hydration
+	err, _ := fakeMemStore.StoreValues(TokenStoreTable, []AuthToken{{Key: "legacy",
+		Type: UserToken, Expires: NeverExpires}})
+	assert.NoError(t, err)
+
+	store2 := NewTokenStore(fakeMemStore)
+	assert.NoError(t, store2.Hydrate())
+	store3 := NewTokenStore(fakeMemStore)
+	assert.NoError(t, store3.Hydrate())
+
+	legacy2, _ := store2.GetTokenByKey("legacy")
+	legacy3, _ := store3.GetTokenByKey("legacy")
+	assert.NotEqual(t, "", legacy2.ID)
+	assert.Equal(t, legacy2.ID, legacy3.ID)
+}
+
+func TestLegacyTokenMigration(t *testing.T) {
+	fakeMemStore := NewFakeMemStore()
+	fakeMemStore.InitSchema(map[string]int64{TokenStoreTable: 200})
+
+	// The tokens stored by the older versions, under their secret keys
+	err, _ := fakeMemStore.StoreValues(TokenStoreTable, []AuthToken{
+		{Key: "raw1", ID: "id1", Type: UserToken, EntityKey: "123", Expires: NeverExpires},
+		{Key: "raw2", Type: NodeToken, EntityKey: "n1", Expires: NeverExpires},
+	})
+	assert.NoError(t, err)
+
+	store := NewTokenStore(fakeMemStore)
+	assert.NoError(t, store.Hydrate())
+
+	// The users can still log in with their old keys
+	token1, ok := store.GetTokenByKey("raw1")
+	assert.True(t, ok)
+	assert.Equal(t, "id1", token1.ID)
+	assert.Equal(t, "123", token1.EntityKey)
+	token2, ok := store.GetTokenByKey("raw2")
+	assert.True(t, ok)
+	assert.Equal(t, legacyTokenId("raw2"), token2.ID)
+
+	// The secret keys are gone from the table
+	var rows []AuthToken
+	assert.NoError(t, fakeMemStore.LoadTable(TokenStoreTable, &rows))
+	assert.Equal(t, 3, len(rows)) // Including the salt
+	for _, r := range rows {
+		assert.NotEqual(t, "raw1", r.Key)
+		assert.NotEqual(t, "raw2", r.Key)
+	}
+
+	// The migrated tokens survive the restart
+	store2 := NewTokenStore(fakeMemStore)
+	assert.NoError(t, store2.Hydrate())
+	token1, ok = store2.GetTokenByKey("raw1")
+	assert.True(t, ok)
+	assert.Equal(t, "id1", token1.ID)
+	assert.Equal(t, 2, len(store2.ListTokens(nil)))
+}
+
+// The store that hasn't seen the other servers' writes yet when loading tables
+type staleLoadStore struct {
+	*FakeMemStore
+}
+
+func (s *staleLoadStore) LoadTable(table string, output interface{}) error {
+	return nil
+}
+
+func TestConcurrentSaltCreation(t *testing.T) {
+	fakeMemStore := NewFakeMemStore()
+	fakeMemStore.InitSchema(map[string]int64{TokenStoreTable: 200})
+
+	// Two servers start on an empty table, the second one creates the salt
+	// after the first one has found no salt
+	store1 := NewTokenStore(&staleLoadStore{fakeMemStore})
+	store2 := NewTokenStore(fakeMemStore)
+	assert.NoError(t, store2.StoreToken(AuthToken{Key: "key1", ID: "id1",
+		Type: UserToken, Expires: NeverExpires}))
+
+	// The first server uses the stored salt instead of its own
+	hashed1, err := store1.hashKey("key1")
+	assert.NoError(t, err)
+	hashed2, err := store2.hashKey("key1")
+	assert.NoError(t, err)
+	assert.Equal(t, hashed2, hashed1)
+
+	var stored tokenSalt
+	found, err := fakeMemStore.GetValue(TokenStoreTable, tokenSaltKey, &stored)
+	assert.True(t, found)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), stored.Version)
+}
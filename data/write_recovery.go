@@ -0,0 +1,253 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const DefaultWriteConfirmTimeout = time.Minute
+const writeConfirmRetryInterval = time.Second
+
+// The errors that can tell if the write might have been applied
+type AmbiguousError interface {
+	error
+	Ambiguous() bool
+}
+
+// Check if the outcome of the failed write is unknown: the write might
+// have been applied even though we've got an error (timeouts, server errors).
+func IsAmbiguousWriteError(err error) bool {
+	for err != nil {
+		if IsVersionConflict(err) {
+			return false
+		}
+		if err == context.DeadlineExceeded {
+			return true
+		}
+		if ae, ok := err.(AmbiguousError); ok {
+			return ae.Ambiguous()
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return true
+		}
+		if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() >= 500 {
+			return true
+		}
+
+		// Look into the wrapped errors
+		switch e := err.(type) {
+		case awserr.Error:
+			err = e.OrigErr()
+		case StoreError:
+			err = e.OrigErr()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// The stores that don't keep the values as JSON implement this, so that the
+// written values can be compared with the values read back from the store.
+type ValueNormalizer interface {
+	// Pass the value through the store's encoding into the output, it must
+	// be a pointer to a value of the same type
+	NormalizeValue(value interface{}, output interface{}) error
+}
+
+// Pass the value through the store's encoding, so it looks like the same
+// value read back from the store (e.g. with the empty fields dropped)
+func normalizeValue(store KVStore, value interface{}, output interface{}) error {
+	if normalizer, ok := store.(ValueNormalizer); ok {
+		return normalizer.NormalizeValue(value, output)
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, output)
+}
+
+// The write-through decorator implementing the write uncertainty protocol
+// (see docs/data_store.md). If a write fails with an ambiguous error, the
+// writes are blocked and the value is read back to find out if the write has
+// been applied. If the outcome can't be confirmed before the deadline, the
+// server is hard-failed to avoid the in-memory state diverging from the
+// database.
+type RecoveringStore struct {
+	store KVStore
+	// The writes hold it for reading, the recovery holds it exclusively
+	mutex sync.RWMutex
+
+	ConfirmTimeout time.Duration
+	RetryInterval  time.Duration
+	// Called if the write can't be confirmed, kills the server by default
+	FailStop func(err error)
+}
+
+func NewRecoveringStore(store KVStore, confirmTimeout time.Duration) *RecoveringStore {
+	return &RecoveringStore{
+		store:          store,
+		ConfirmTimeout: confirmTimeout,
+		RetryInterval:  writeConfirmRetryInterval,
+		FailStop: func(err error) {
+			logrus.Fatalf("Can't confirm the outcome of a write, "+
+				"stopping to avoid inconsistent data: %s", err.Error())
+		},
+	}
+}
+
+func (rs *RecoveringStore) Close() error {
+	if closer, ok := rs.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Read the value back, retrying until the deadline. Returns false in the
+// second value if the read has never succeeded (after calling FailStop).
+func (rs *RecoveringStore) readBack(table string, key string,
+	output interface{}) (bool, bool) {
+
+	deadline := time.Now().Add(rs.ConfirmTimeout)
+	for {
+		found, err := rs.store.GetValue(table, key, output)
+		if err == nil {
+			return found, true
+		}
+		logrus.Warnf("Failed to read back %s/%s: %s", table, key, err.Error())
+
+		if time.Now().After(deadline) {
+			rs.FailStop(NewStoreError("can't confirm the write to "+table+"/"+key, err))
+			return false, false
+		}
+		time.Sleep(rs.RetryInterval)
+	}
+}
+
+// Check if the value has been written. The values are compared after passing
+// the written value through the store's encoding, which can be lossy. The
+// whole value is compared even if it's versioned, since a concurrent writer
+// could have produced the same version from the same base.
+func (rs *RecoveringStore) isWritten(table string, value interface{}) (bool, bool) {
+	val := reflect.Indirect(reflect.ValueOf(value))
+	readValue := reflect.New(val.Type())
+	found, confirmed := rs.readBack(table, getValueKey(value), readValue.Interface())
+	if !confirmed || !found {
+		return false, confirmed
+	}
+
+	written := reflect.New(val.Type())
+	err := normalizeValue(rs.store, val.Interface(), written.Interface())
+	if err != nil {
+		logrus.Warnf("Failed to encode the value %s/%s: %s", table,
+			getValueKey(value), err.Error())
+		return false, true
+	}
+	return reflect.DeepEqual(written.Elem().Interface(), readValue.Elem().Interface()), true
+}
+
+func (rs *RecoveringStore) StoreValues(table string, data interface{}) (error, map[string]bool) {
+	rs.mutex.RLock()
+	err, success := rs.store.StoreValues(table, data)
+	rs.mutex.RUnlock()
+	if !IsAmbiguousWriteError(err) {
+		return err, success
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	logrus.Warnf("Ambiguous write to %s, reading the values back: %s", table, err.Error())
+
+	if success == nil {
+		success = make(map[string]bool)
+	}
+	val := reflect.ValueOf(data)
+	var allWritten = true
+	for i := 0; i < val.Len(); i++ {
+		value := val.Index(i).Interface()
+		key := getValueKey(value)
+		if success[key] {
+			continue
+		}
+		written, confirmed := rs.isWritten(table, value)
+		if !confirmed {
+			return err, success
+		}
+		if written {
+			success[key] = true
+		} else {
+			allWritten = false
+		}
+	}
+
+	if allWritten {
+		return nil, success
+	}
+	return err, success
+}
+
+func (rs *RecoveringStore) StoreValue(table string, value interface{},
+	expectedVersion int64) error {
+
+	rs.mutex.RLock()
+	err := rs.store.StoreValue(table, value, expectedVersion)
+	rs.mutex.RUnlock()
+	if !IsAmbiguousWriteError(err) {
+		return err
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	logrus.Warnf("Ambiguous write to %s, reading the value back: %s", table, err.Error())
+
+	written, confirmed := rs.isWritten(table, value)
+	if confirmed && written {
+		return nil
+	}
+	return err
+}
+
+func (rs *RecoveringStore) DeleteValue(table string, key string) error {
+	rs.mutex.RLock()
+	err := rs.store.DeleteValue(table, key)
+	rs.mutex.RUnlock()
+	if !IsAmbiguousWriteError(err) {
+		return err
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	logrus.Warnf("Ambiguous delete from %s, reading the value back: %s", table, err.Error())
+
+	// We only need to know if the value is still there
+	var ignored map[string]interface{}
+	found, confirmed := rs.readBack(table, key, &ignored)
+	if confirmed && !found {
+		return nil
+	}
+	return err
+}
+
+func (rs *RecoveringStore) GetValue(table string, key string, output interface{}) (bool, error) {
+	return rs.store.GetValue(table, key, output)
+}
+
+func (rs *RecoveringStore) LoadTable(table string, output interface{}) error {
+	return rs.store.LoadTable(table, output)
+}
+
+func (rs *RecoveringStore) GetCounter(counterName string) (int64, error) {
+	return rs.store.GetCounter(counterName)
+}
+
+func (rs *RecoveringStore) InitSchema(tables map[string]int64) error {
+	return rs.store.InitSchema(tables)
+}
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"apollo/proto/gen/models"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func makeFaultyStore() (*FaultyStore, *RecoveringStore) {
+	mem := NewFakeMemStore()
+	mem.InitSchema(map[string]int64{QueueTable: 5, NodeTable: 5, TaskInstanceTable: 5})
+	faulty := NewFaultyStore(mem, 1)
+	rs := NewRecoveringStore(faulty, time.Second)
+	rs.RetryInterval = time.Millisecond
+	rs.FailStop = func(err error) {
+		panic(err)
+	}
+	return faulty, rs
+}
+
+// Fail the next write of the table with an ambiguous error
+func failNextWrite(faulty *FaultyStore, table string, applied bool) {
+	fault := FaultFail
+	if applied {
+		fault = FaultAppliedButFailed
+	}
+	faulty.AddRule(FaultRule{Ops: []StoreOp{OpStoreValues, OpStoreValue, OpDeleteValue},
+		Table: table, Fault: fault, Ambiguous: true, Times: 1})
+}
+
+func TestAmbiguousWrites(t *testing.T) {
+	faulty, rs := makeFaultyStore()
+	qs := NewQueueStore(rs)
+
+	// The write went through despite the error
+	failNextWrite(faulty, QueueTable, true)
+	assert.NoError(t, qs.StoreQueue(&StoredQueue{Key: "q1"}))
+	assert.Equal(t, 1, len(qs.ListQueues([]string{"q1"})))
+
+	// The write didn't go through, the in-memory state is not changed
+	failNextWrite(faulty, QueueTable, false)
+	assert.Error(t, qs.StoreQueue(&StoredQueue{Key: "q2"}))
+	assert.Equal(t, 0, len(qs.ListQueues([]string{"q2"})))
+
+	// The versioned writes are checked too
+	ns := NewNodeStore(rs)
+	failNextWrite(faulty, NodeTable, true)
+	node := &StoredNode{Key: "n1", State: models.NodeStateEnumActive}
+	assert.NoError(t, ns.StoreNode(node))
+	assert.Equal(t, int64(1), node.Version)
+
+	failNextWrite(faulty, NodeTable, false)
+	_, err := ns.UpdateNode("n1", func(node *StoredNode) bool {
+		node.State = models.NodeStateEnumShuttingDown
+		return true
+	})
+	assert.Error(t, err)
+	assert.Equal(t, models.NodeStateEnumActive, ns.ListNodes([]string{"n1"}, nil)[0].State)
+
+	// The write is lost, but another server has written the same version
+	// of the node. It must not be mistaken for our write.
+	concurrent := *ns.ListNodes([]string{"n1"}, nil)[0]
+	concurrent.State = models.NodeStateEnumDead
+	concurrent.Version++
+	assert.NoError(t, faulty.store.StoreValue(NodeTable, concurrent, concurrent.Version-1))
+	failNextWrite(faulty, NodeTable, false)
+	_, err = ns.UpdateNode("n1", func(node *StoredNode) bool {
+		node.State = models.NodeStateEnumShuttingDown
+		return true
+	})
+	assert.Error(t, err)
+	assert.False(t, IsVersionConflict(err))
+
+	// Deletions are checked too
+	failNextWrite(faulty, QueueTable, true)
+	assert.NoError(t, rs.DeleteValue(QueueTable, "q1"))
+	assert.NoError(t, qs.StoreQueue(&StoredQueue{Key: "q3"}))
+	failNextWrite(faulty, QueueTable, false)
+	assert.Error(t, rs.DeleteValue(QueueTable, "q3"))
+}
+
+func TestClearErrorsAreNotRecovered(t *testing.T) {
+	faulty, rs := makeFaultyStore()
+	ns := NewNodeStore(rs)
+	assert.NoError(t, ns.StoreNode(&StoredNode{Key: "n1"}))
+
+	// A version conflict is a definite answer, nothing is read back
+	faulty.AddRule(FaultRule{Ops: []StoreOp{OpGetValue}})
+	err := rs.StoreValue(NodeTable, StoredNode{Key: "n1", Version: 1}, 0)
+	assert.True(t, IsVersionConflict(err))
+	assert.False(t, IsAmbiguousWriteError(err))
+	assert.Equal(t, 0, faulty.InjectedFaults())
+
+	// So are the non-ambiguous failures
+	faulty.AddRule(FaultRule{Ops: []StoreOp{OpStoreValue}, Times: 1})
+	assert.Error(t, ns.StoreNode(&StoredNode{Key: "n2"}))
+	assert.Equal(t, 1, faulty.InjectedFaults())
+
+	assert.True(t, IsAmbiguousWriteError(NewStoreError("wrapped",
+		&InjectedFaultError{IsAmbiguous: true})))
+	assert.False(t, IsAmbiguousWriteError(fmt.Errorf("bad request")))
+}
+
+func TestWriteConfirmationRetries(t *testing.T) {
+	faulty, rs := makeFaultyStore()
+	qs := NewQueueStore(rs)
+
+	// The read-back is retried until it succeeds
+	failNextWrite(faulty, QueueTable, true)
+	faulty.AddRule(FaultRule{Ops: []StoreOp{OpGetValue}, Times: 3})
+	assert.NoError(t, qs.StoreQueue(&StoredQueue{Key: "q1"}))
+	assert.Equal(t, 4, faulty.InjectedFaults())
+
+	// The server is stopped if the outcome can't be confirmed in time
+	rs.ConfirmTimeout = 10 * time.Millisecond
+	failNextWrite(faulty, QueueTable, true)
+	faulty.AddRule(FaultRule{Ops: []StoreOp{OpGetValue}})
+	assert.Panics(t, func() {
+		_ = qs.StoreQueue(&StoredQueue{Key: "q2"})
+	})
+}
+
+type sparseData struct {
+	Key   string
+	Tags  []string
+	Attrs map[string]string
+}
+
+// Keeps the values like DynamoDB does, with the empty values dropped
+type ddbLikeStore struct {
+	*FakeMemStore
+	codec DynamoDBStore
+}
+
+func (s *ddbLikeStore) GetValue(table string, key string, output interface{}) (bool, error) {
+	var stored sparseData
+	found, err := s.FakeMemStore.GetValue(table, key, &stored)
+	if !found || err != nil {
+		return found, err
+	}
+	return true, s.codec.NormalizeValue(stored, output)
+}
+
+func (s *ddbLikeStore) NormalizeValue(value interface{}, output interface{}) error {
+	return s.codec.NormalizeValue(value, output)
+}
+
+func TestLossyWriteConfirmation(t *testing.T) {
+	mem := NewFakeMemStore()
+	mem.InitSchema(map[string]int64{"sparse": 5})
+	faulty := NewFaultyStore(&ddbLikeStore{FakeMemStore: mem}, 1)
+	rs := NewRecoveringStore(faulty, time.Second)
+	rs.FailStop = func(err error) {
+		panic(err)
+	}
+
+	// The empty values are lost in the store, but the write is confirmed
+	failNextWrite(faulty, "sparse", true)
+	err, _ := rs.StoreValues("sparse", []sparseData{{Key: "k1",
+		Tags: []string{}, Attrs: map[string]string{}}})
+	assert.NoError(t, err)
+
+	failNextWrite(faulty, "sparse", true)
+	err, _ = rs.StoreValues("sparse", []sparseData{{Key: "k1", Tags: []string{"a"}}})
+	assert.NoError(t, err)
+
+	// A different value is not mistaken for the written one
+	failNextWrite(faulty, "sparse", false)
+	err, _ = rs.StoreValues("sparse", []sparseData{{Key: "k1", Tags: []string{"b"}}})
+	assert.Error(t, err)
+}
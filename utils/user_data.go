@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// The markers in the EC2 user data of the managed nodes
+const ServerUrlMarker = "### APOLLO_SERVER_URL IS "
+const CertFingerprintMarker = "### APOLLO_SERVER_CERT_SHA256 IS "
+
+// The server connection info passed to the managed nodes
+type NodeUserData struct {
+	ServerUrl string
+	CertFingerprint string
+}
+
+// Make the user data script for a managed node. The runner is started by
+// its system service and discovers the server by reading the user data.
+func MakeNodeUserData(info NodeUserData) string {
+	return "#!/bin/sh\n" +
+		ServerUrlMarker + info.ServerUrl + "\n" +
+		CertFingerprintMarker + info.CertFingerprint + "\n"
+}
+
+func ParseNodeUserData(userData string) NodeUserData {
+	var res NodeUserData
+	for _, st := range strings.Split(userData, "\n") {
+		if strings.HasPrefix(st, ServerUrlMarker) {
+			res.ServerUrl = strings.TrimSpace(st[len(ServerUrlMarker):])
+		}
+		if strings.HasPrefix(st, CertFingerprintMarker) {
+			res.CertFingerprint = strings.TrimSpace(st[len(CertFingerprintMarker):])
+		}
+	}
+	return res
+}
+
+// Compute the SHA-256 fingerprint of the base64-encoded DER certificate
+func CertFingerprint(certBody string) (string, error) {
+	der, err := base64.StdEncoding.DecodeString(certBody)
+	if err != nil {
+		return "", err
+	}
+	return DerCertFingerprint(der), nil
+}
+
+func DerCertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"github.com/magiconair/properties/assert"
+	"testing"
+)
+
+func TestNodeUserData(t *testing.T) {
+	info := NodeUserData{ServerUrl: "apollo.example.com:9443", CertFingerprint: "abcd"}
+	userData := MakeNodeUserData(info)
+	assert.Equal(t, info, ParseNodeUserData(userData))
+
+	// The markers can be mixed with other commands
+	parsed := ParseNodeUserData("#!/bin/bash\nyum update\n" +
+		"### APOLLO_SERVER_URL IS somewhere.com:443 \n")
+	assert.Equal(t, "somewhere.com:443", parsed.ServerUrl)
+	assert.Equal(t, "", parsed.CertFingerprint)
+
+	_, err := CertFingerprint("not base64!")
+	assert.Equal(t, true, err != nil)
+	fp, err := CertFingerprint("aGVsbG8=")
+	assert.Equal(t, nil, err)
+	// SHA-256 of "hello"
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", fp)
+}